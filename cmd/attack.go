@@ -0,0 +1,88 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/attack"
+	"github.com/mattiasgees/spiffe-demo/pkg/backend"
+	"github.com/spf13/cobra"
+)
+
+var (
+	attackTarget      string
+	attackJWTTarget   string
+	attackJWTAudience string
+	attackXFCCTarget  string
+	attackImpersonate string
+	attackTimeout     time.Duration
+	attackOutput      string
+)
+
+// attackCmd represents the attack command
+var attackCmd = &cobra.Command{
+	Use:   "attack",
+	Short: "Attack the demo services to prove they enforce zero trust",
+	Long: `This runs a battery of attacks against the backend and reports which ones were blocked.
+	It connects without a client certificate, with forged certificates for the SPIFFE ID of
+	an authorized workload, with JWT-SVIDs for the wrong audience or that were already used, and with a
+	spoofed x-forwarded-client-cert header. It exits with an error when an attack got through or its
+	outcome was inconclusive.`,
+	Example:      `  spiffe-demo attack --target https://backend:8443 --impersonate spiffe://example.org/ns/demo/sa/customer --output json`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !slices.Contains(attack.Formats, attackOutput) {
+			return fmt.Errorf("invalid output format %q, valid formats are %v", attackOutput, attack.Formats)
+		}
+		impersonate := attackImpersonate
+		if impersonate == "" {
+			impersonate = spiffeAuthz
+		}
+		report, err := attack.Run(cmd.Context(), attack.Config{
+			Target:      attackTarget,
+			JWTTarget:   attackJWTTarget,
+			JWTAudience: attackJWTAudience,
+			XFCCTarget:  attackXFCCTarget,
+			Impersonate: impersonate,
+			Timeout:     attackTimeout,
+		})
+		if err != nil {
+			return err
+		}
+		if err := report.Write(cmd.OutOrStdout(), attackOutput); err != nil {
+			return err
+		}
+		if !report.Blocked() {
+			return errors.New("at least one attack got through or was inconclusive")
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(attackCmd)
+	attackCmd.PersistentFlags().StringVarP(&attackTarget, "target", "", "https://127.0.0.1:8443", "URL of the SPIFFE mTLS listener of the backend")
+	attackCmd.PersistentFlags().StringVarP(&attackJWTTarget, "jwt-target", "", "", "URL of the JWT-SVID endpoint of the backend, e.g. https://127.0.0.1:8444/jwt. The JWT attacks are skipped when empty")
+	attackCmd.PersistentFlags().StringVarP(&attackJWTAudience, "jwt-audience", "", backend.DefaultJWTAudience, "Audience the JWT-SVID endpoint of the backend accepts")
+	attackCmd.PersistentFlags().StringVarP(&attackXFCCTarget, "xfcc-target", "", "", "URL of the proxy in front of the httpservice. The spoofed XFCC attack is skipped when empty")
+	attackCmd.PersistentFlags().StringVarP(&attackImpersonate, "impersonate", "", "", "SPIFFE ID of an authorized workload the attacks pretend to be. Defaults to --authorized-spiffe")
+	attackCmd.PersistentFlags().DurationVarP(&attackTimeout, "timeout", "", 5*time.Second, "Timeout of every attack")
+	attackCmd.PersistentFlags().StringVarP(&attackOutput, "output", "", attack.FormatTable, "Format of the report: table or json")
+}
@@ -20,16 +20,30 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var (
+	downstreamServices []string
+	ordersFile         string
+	ordersAdmins       []string
+	jwtAddress         string
+	jwtAudience        string
+)
+
 var backendCmd = &cobra.Command{
 	Use:   "backend",
 	Short: "A simple backend service",
 	Long: `This starts a simple backend service that will be exposes as an mTLS SPIFFE Service.
 	It will validate incoming requests based on a SPIFFE identity`,
 	Run: func(cmd *cobra.Command, args []string) {
-		backend.StartServer(spiffeAuthz, serverAddress)
+		setupTracing("backend")
+		backend.StartServer(spiffeAuthz, serverAddress, metricsAddress, downstreamServices, ordersFile, ordersAdmins, jwtAddress, jwtAudience)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(backendCmd)
+	backendCmd.PersistentFlags().StringSliceVarP(&downstreamServices, "downstream", "", []string{}, "Downstream services to call for a call chain request in the format <spiffe-id>=<url>. Can be repeated")
+	backendCmd.PersistentFlags().StringVarP(&ordersFile, "orders-file", "", "", "File to store the orders in. When empty the orders are only kept in memory")
+	backendCmd.PersistentFlags().StringVarP(&jwtAddress, "jwt-address", "", "", "Also serve /jwt at this address, which authenticates callers with a JWT-SVID instead of a client certificate. Disabled when empty")
+	backendCmd.PersistentFlags().StringVarP(&jwtAudience, "jwt-audience", "", backend.DefaultJWTAudience, "Audience a JWT-SVID needs to have to be accepted at /jwt")
+	backendCmd.PersistentFlags().StringSliceVarP(&ordersAdmins, "orders-admin", "", []string{}, "SPIFFE IDs that are allowed to read, update and delete all orders. Can be repeated")
 }
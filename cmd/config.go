@@ -0,0 +1,252 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// Prefix of the environment variables that set flags, --s3-bucket is SPIFFE_DEMO_S3_BUCKET.
+const envPrefix = "SPIFFE_DEMO_"
+
+// Sources a setting can come from, from the highest to the lowest priority.
+const (
+	sourceFlag    = "flag"
+	sourceEnv     = "env"
+	sourceFile    = "config file"
+	sourceDefault = "default"
+)
+
+// Environment variables the customer read before the flags existed. They still work, so existing deployments
+// keep running, but the SPIFFE_DEMO_ variables win.
+var legacyEnv = map[string]string{
+	"gcp-bucket":    "BUCKET_NAME",
+	"gcp-proxy-url": "SPIFFE_GCP_PROXY_URL",
+}
+
+var configFile string
+
+// setting is the effective value of a flag and where it came from.
+type setting struct {
+	name   string
+	value  string
+	source string
+}
+
+// configCmd groups the commands that deal with the configuration.
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration",
+	Long: `Every flag can also be set with an environment variable or in the config file.
+	Flags win over environment variables, which win over the config file.
+	The environment variable of a flag is SPIFFE_DEMO_ followed by the flag name in upper case
+	with dashes replaced by underscores, e.g. --s3-bucket is SPIFFE_DEMO_S3_BUCKET.
+	The config file is YAML with the flag names as keys.`,
+}
+
+// configShowCmd prints the effective configuration of a command.
+var configShowCmd = &cobra.Command{
+	Use:   "show [command] [flags]",
+	Short: "Show the effective configuration of a command and where every value comes from",
+	Example: `  spiffe-demo config show customer --s3-bucket my-bucket
+  SPIFFE_DEMO_SERVER_ADDRESS=0.0.0.0:8080 spiffe-demo config show backend`,
+	// The flags belong to the command that is shown, so they are parsed for that command.
+	DisableFlagParsing: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		target, rest, err := rootCmd.Find(args)
+		if err != nil {
+			return err
+		}
+		if err := target.ParseFlags(rest); err != nil {
+			return err
+		}
+		settings, err := bindFlags(target.Flags())
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "FLAG\tVALUE\tSOURCE\n")
+		for _, s := range settings {
+			fmt.Fprintf(w, "--%s\t%s\t%s\n", s.name, s.value, s.source)
+		}
+		return w.Flush()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configShowCmd)
+}
+
+// bindConfig fills the flags of a command that weren't set on the command line from the environment
+// and the config file. It runs before every command.
+func bindConfig(cmd *cobra.Command, _ []string) error {
+	_, err := bindFlags(cmd.Flags())
+	return err
+}
+
+// bindFlags applies the environment and the config file to the flags that weren't set and returns the
+// effective value and source of every flag, sorted by name.
+func bindFlags(flags *pflag.FlagSet) ([]setting, error) {
+	file, err := loadConfigFile(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	var settings []setting
+	var errs []string
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if flag.Hidden || flag.Name == "help" {
+			return
+		}
+		source, err := bindFlag(flag, file)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		settings = append(settings, setting{name: flag.Name, value: flag.Value.String(), source: source})
+	})
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid configuration: %s", strings.Join(errs, "; "))
+	}
+	return settings, nil
+}
+
+// bindFlag sets a single flag from the highest priority source that has a value for it.
+func bindFlag(flag *pflag.Flag, file map[string]any) (string, error) {
+	if flag.Changed {
+		return sourceFlag, nil
+	}
+
+	for _, env := range envNames(flag.Name) {
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(flag, value); err != nil {
+			return sourceEnv, fmt.Errorf("%s: %w", env, err)
+		}
+		return fmt.Sprintf("%s %s", sourceEnv, env), nil
+	}
+
+	value, ok := file[flag.Name]
+	if !ok {
+		return sourceDefault, nil
+	}
+	if err := setFromFile(flag, value); err != nil {
+		return sourceFile, fmt.Errorf("%s in %s: %w", flag.Name, configFile, err)
+	}
+	return sourceFile, nil
+}
+
+// envNames returns the environment variables of a flag, in the order they are checked.
+func envNames(name string) []string {
+	names := []string{envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))}
+	if legacy, ok := legacyEnv[name]; ok {
+		names = append(names, legacy)
+	}
+	return names
+}
+
+// setFromEnv sets a flag to the value of an environment variable. Flags that can be repeated take a comma
+// separated list, like on the command line.
+func setFromEnv(flag *pflag.Flag, value string) error {
+	slice, ok := flag.Value.(pflag.SliceValue)
+	if !ok {
+		return flag.Value.Set(value)
+	}
+	if value == "" {
+		return slice.Replace(nil)
+	}
+	items, err := csv.NewReader(strings.NewReader(value)).Read()
+	if err != nil {
+		return err
+	}
+	// Replace doesn't mark the flag as set, so a later value replaces this one instead of being appended.
+	return slice.Replace(items)
+}
+
+// setFromFile sets a flag to a value of the config file. Lists are only allowed for flags that can be repeated.
+func setFromFile(flag *pflag.Flag, value any) error {
+	switch value := value.(type) {
+	case []any:
+		slice, ok := flag.Value.(pflag.SliceValue)
+		if !ok {
+			return fmt.Errorf("expected a single value, got a list")
+		}
+		items := make([]string, 0, len(value))
+		for _, item := range value {
+			items = append(items, fmt.Sprint(item))
+		}
+		return slice.Replace(items)
+	case map[string]any:
+		return fmt.Errorf("expected a value, got a map")
+	case nil:
+		return nil
+	default:
+		return flag.Value.Set(fmt.Sprint(value))
+	}
+}
+
+// loadConfigFile reads the config file, if there is one. Its own location can come from the flag or the environment.
+func loadConfigFile(flags *pflag.FlagSet) (map[string]any, error) {
+	if flag := flags.Lookup("config-file"); flag != nil && !flag.Changed {
+		if value, ok := os.LookupEnv(envNames("config-file")[0]); ok {
+			configFile = value
+		}
+	}
+	if configFile == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %w", err)
+	}
+	file := map[string]any{}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("unable to parse config file %s: %w", configFile, err)
+	}
+
+	// One file can configure all commands, so a key only has to be a flag of any of them. This still
+	// catches typos, which would otherwise be ignored silently.
+	known := allFlagNames(rootCmd)
+	for key := range file {
+		if !slices.Contains(known, key) {
+			return nil, fmt.Errorf("unknown setting %q in config file %s", key, configFile)
+		}
+	}
+	return file, nil
+}
+
+func allFlagNames(cmd *cobra.Command) []string {
+	var names []string
+	cmd.PersistentFlags().VisitAll(func(flag *pflag.Flag) { names = append(names, flag.Name) })
+	cmd.LocalNonPersistentFlags().VisitAll(func(flag *pflag.Flag) { names = append(names, flag.Name) })
+	for _, child := range cmd.Commands() {
+		names = append(names, allFlagNames(child)...)
+	}
+	return names
+}
@@ -0,0 +1,111 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testFlags builds a flag set like the ones of the commands, with its own variables.
+func testFlags(t *testing.T, file string) *pflag.FlagSet {
+	t.Helper()
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.String("config-file", "", "")
+	flags.String("server-address", "127.0.0.1:8080", "")
+	flags.String("s3-bucket", "", "")
+	flags.String("gcp-bucket", "", "")
+	flags.String("aws-region", "eu-west-2", "")
+	flags.StringSlice("downstream", []string{}, "")
+
+	configFile = file
+	t.Cleanup(func() { configFile = "" })
+	return flags
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+	return file
+}
+
+func TestBindFlagsPrecedence(t *testing.T) {
+	file := writeConfigFile(t, `
+server-address: 0.0.0.0:9090
+s3-bucket: from-file
+aws-region: us-east-1
+downstream:
+- spiffe://example.org/a=https://a
+- spiffe://example.org/b=https://b
+`)
+	flags := testFlags(t, file)
+	t.Setenv("SPIFFE_DEMO_S3_BUCKET", "from-env")
+	t.Setenv("SPIFFE_DEMO_AWS_REGION", "eu-west-1")
+	t.Setenv("BUCKET_NAME", "legacy")
+	require.NoError(t, flags.Parse([]string{"--aws-region", "eu-central-1"}))
+
+	settings, err := bindFlags(flags)
+	require.NoError(t, err)
+
+	sources := map[string]setting{}
+	for _, s := range settings {
+		sources[s.name] = s
+	}
+	assert.Equal(t, setting{"aws-region", "eu-central-1", sourceFlag}, sources["aws-region"])
+	assert.Equal(t, setting{"s3-bucket", "from-env", "env SPIFFE_DEMO_S3_BUCKET"}, sources["s3-bucket"])
+	assert.Equal(t, setting{"gcp-bucket", "legacy", "env BUCKET_NAME"}, sources["gcp-bucket"])
+	assert.Equal(t, setting{"server-address", "0.0.0.0:9090", sourceFile}, sources["server-address"])
+	assert.Equal(t, setting{"downstream", "[spiffe://example.org/a=https://a,spiffe://example.org/b=https://b]", sourceFile}, sources["downstream"])
+
+	slice, err := flags.GetStringSlice("downstream")
+	require.NoError(t, err)
+	assert.Len(t, slice, 2)
+}
+
+func TestBindFlagsEnvList(t *testing.T) {
+	flags := testFlags(t, "")
+	t.Setenv("SPIFFE_DEMO_DOWNSTREAM", "spiffe://example.org/a=https://a,spiffe://example.org/b=https://b")
+
+	// Binding twice, like `config show` does, must not append the values again.
+	_, err := bindFlags(flags)
+	require.NoError(t, err)
+	_, err = bindFlags(flags)
+	require.NoError(t, err)
+
+	slice, err := flags.GetStringSlice("downstream")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"spiffe://example.org/a=https://a", "spiffe://example.org/b=https://b"}, slice)
+}
+
+func TestBindFlagsInvalidFile(t *testing.T) {
+	tests := map[string]string{
+		"unknown key":         "s3-buckets: typo",
+		"list for a string":   "s3-bucket: [a, b]",
+		"map for a value":     "server-address: {host: a}",
+		"not a map of values": "- a",
+	}
+	for name, content := range tests {
+		flags := testFlags(t, writeConfigFile(t, content))
+		_, err := bindFlags(flags)
+		assert.Error(t, err, name)
+	}
+}
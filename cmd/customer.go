@@ -16,7 +16,11 @@ limitations under the License.
 package cmd
 
 import (
+	"strconv"
+	"time"
+
 	"github.com/mattiasgees/spiffe-demo/pkg/customer"
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
 	"github.com/spf13/cobra"
 )
 
@@ -26,9 +30,23 @@ var (
 	spiffeAuthzHTTPBackend string
 	s3Bucket               string
 	s3Filepath             string
+	s3Endpoint             string
+	s3PathStyle            bool
 	awsRegion              string
+	awsRoleARN             string
+	awsAuth                string
+	awsJWTAudience         string
+	awsTrustAnchorARN      string
+	awsProfileARN          string
 	postgreSQLHost         string
 	postgreSQLUser         string
+	gcpBucket              string
+	gcpProxyURL            string
+	targetsFile            string
+	retries                int
+	retryBackoff           time.Duration
+	breakerThreshold       int
+	breakerCooldown        time.Duration
 )
 
 // customerCmd represents the customer command
@@ -38,19 +56,83 @@ var customerCmd = &cobra.Command{
 	Long: `The customer service is the endpoints that serves requests to customers.
 	It connects to the backend service and relays the message back to the customer`,
 	Run: func(cmd *cobra.Command, args []string) {
-		customer.StartServer(spiffeAuthz, serverAddress, backendService, s3Bucket, s3Filepath, awsRegion, spiffeAuthzHTTPBackend, HTTPBackendService, postgreSQLHost, postgreSQLUser)
+		config, err := targetConfig()
+		if err != nil {
+			logging.Fatal("Unable to load the customer config", err)
+		}
+		setupTracing("customer")
+		resilience := customer.Resilience{
+			Retries:          retries,
+			Backoff:          retryBackoff,
+			BreakerThreshold: breakerThreshold,
+			BreakerCooldown:  breakerCooldown,
+		}
+		customer.StartServer(spiffeAuthz, serverAddress, metricsAddress, backendService, config, resilience)
 	},
 }
 
+// targetConfig returns the targets of the customer. Without a config file they are built from the individual flags.
+func targetConfig() (*customer.Config, error) {
+	if targetsFile != "" {
+		return customer.LoadConfig(targetsFile)
+	}
+	config := &customer.Config{Targets: legacyTargets()}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// legacyTargets builds the targets from the flags the customer had before targets could be configured.
+// The targets get the names of the original routes, so the page works exactly like it used to.
+func legacyTargets() []customer.Target {
+	return []customer.Target{
+		{Name: "mtls", Type: customer.TargetMTLSHTTP, Description: "SPIFFE Native mTLS", Address: backendService, SPIFFEID: spiffeAuthz},
+		{Name: "httpbackend", Type: customer.TargetMTLSHTTP, Description: "SPIFFE with Envoy and an HTTP backend", Address: HTTPBackendService, SPIFFEID: spiffeAuthzHTTPBackend},
+		{Name: "aws", Type: customer.TargetS3, Description: "S3 bucket", Address: s3Bucket, Options: map[string]string{
+			"region":           awsRegion,
+			"filepath":         s3Filepath,
+			"endpoint":         s3Endpoint,
+			"path-style":       strconv.FormatBool(s3PathStyle),
+			"role-arn":         awsRoleARN,
+			"auth":             awsAuth,
+			"audience":         awsJWTAudience,
+			"trust-anchor-arn": awsTrustAnchorARN,
+			"profile-arn":      awsProfileARN,
+		}},
+		{Name: "gcp", Type: customer.TargetGCS, Description: "GCS bucket", Address: gcpBucket, Options: map[string]string{"proxy": gcpProxyURL}},
+		{Name: "postgresql", Type: customer.TargetPostgres, Description: "PostgreSQL", Address: postgreSQLHost, Options: map[string]string{"user": postgreSQLUser}},
+	}
+}
+
+// addTargetFlags adds the flags that configure the targets of the customer, so other commands see the same targets.
+func addTargetFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVarP(&backendService, "backend-service", "b", "https://localhost:8080", "Location on where to reach the backend service")
+	cmd.PersistentFlags().StringVarP(&HTTPBackendService, "httpbackend-service", "", "https://localhost:8080", "Location on where to reach the HTTP backend service")
+	cmd.PersistentFlags().StringVarP(&spiffeAuthzHTTPBackend, "authorized-spiffe-httpbackend", "", "https://localhost:8080", "Location on where to reach the HTTP backend service")
+	cmd.PersistentFlags().StringVarP(&s3Bucket, "s3-bucket", "", "", "Bucket name")
+	cmd.PersistentFlags().StringVarP(&s3Filepath, "s3-filepath", "", "testfile", "Path to the file of the S3 bucket")
+	cmd.PersistentFlags().StringVarP(&s3Endpoint, "s3-endpoint", "", "", "URL of an S3-compatible endpoint, like MinIO, instead of AWS S3")
+	cmd.PersistentFlags().BoolVarP(&s3PathStyle, "s3-path-style", "", false, "Address the bucket in the path instead of the host name, which most S3-compatible endpoints need")
+	cmd.PersistentFlags().StringVarP(&awsRegion, "aws-region", "", "eu-west2", "AWS Region where the S3 bucket can be found")
+	cmd.PersistentFlags().StringVarP(&awsRoleARN, "aws-role-arn", "", "", "AWS role the customer assumes with its SVID. When empty the AWS SDK finds the credentials with its default chain")
+	cmd.PersistentFlags().StringVarP(&awsAuth, "aws-auth", "", customer.AWSAuthJWT, "How the customer assumes --aws-role-arn: jwt exchanges a JWT-SVID with STS, x509 creates an IAM Roles Anywhere session with the X509-SVID")
+	cmd.PersistentFlags().StringVarP(&awsJWTAudience, "aws-jwt-audience", "", customer.DefaultAWSAudience, "Audience of the JWT-SVID that is exchanged for credentials of --aws-role-arn")
+	cmd.PersistentFlags().StringVarP(&awsTrustAnchorARN, "aws-trust-anchor-arn", "", "", "IAM Roles Anywhere trust anchor with the bundle of the trust domain, for --aws-auth=x509")
+	cmd.PersistentFlags().StringVarP(&awsProfileARN, "aws-profile-arn", "", "", "IAM Roles Anywhere profile that allows --aws-role-arn, for --aws-auth=x509")
+	cmd.PersistentFlags().StringVarP(&postgreSQLHost, "postgresql-host", "", "", "Hostname of postgreSQL")
+	cmd.PersistentFlags().StringVarP(&postgreSQLUser, "postgresql-user", "", "", "User to connect to postgreSQL")
+	cmd.PersistentFlags().StringVarP(&gcpBucket, "gcp-bucket", "", "", "Name of the GCS bucket")
+	cmd.PersistentFlags().StringVarP(&gcpProxyURL, "gcp-proxy-url", "", "http://localhost:8080", "Location of the spiffe-gcp-proxy that exchanges the JWT-SVID for a GCP access token")
+	cmd.PersistentFlags().StringVarP(&targetsFile, "targets-file", "", "", "YAML file with the targets to demo. When set, it replaces the targets of the individual flags")
+}
+
 func init() {
 	rootCmd.AddCommand(customerCmd)
-	customerCmd.PersistentFlags().StringVarP(&backendService, "backend-service", "b", "https://localhost:8080", "Location on where to reach the backend service")
-	customerCmd.PersistentFlags().StringVarP(&HTTPBackendService, "httpbackend-service", "", "https://localhost:8080", "Location on where to reach the HTTP backend service")
-	customerCmd.PersistentFlags().StringVarP(&spiffeAuthzHTTPBackend, "authorized-spiffe-httpbackend", "", "https://localhost:8080", "Location on where to reach the HTTP backend service")
-	customerCmd.PersistentFlags().StringVarP(&s3Bucket, "s3-bucket", "", "", "Bucket name")
-	customerCmd.PersistentFlags().StringVarP(&s3Filepath, "s3-filepath", "", "testfile", "Path to the file of the S3 bucket")
-	customerCmd.PersistentFlags().StringVarP(&awsRegion, "aws-region", "", "eu-west2", "AWS Region where the S3 bucket can be found")
-	customerCmd.PersistentFlags().StringVarP(&postgreSQLHost, "postgresql-host", "", "", "Hostname of postgreSQL")
-	customerCmd.PersistentFlags().StringVarP(&postgreSQLUser, "postgresql-user", "", "", "User to connect to postgreSQL")
+	addTargetFlags(customerCmd)
+	customerCmd.PersistentFlags().IntVarP(&retries, "retries", "", 2, "How many times an idempotent call to an mTLS target or the backend is retried after a transient failure")
+	customerCmd.PersistentFlags().DurationVarP(&retryBackoff, "retry-backoff", "", 200*time.Millisecond, "Wait before the first retry, it doubles for every retry up to 30s and is jittered")
+	customerCmd.PersistentFlags().IntVarP(&breakerThreshold, "breaker-threshold", "", 3, "Handshake or authorization failures in a row that open the circuit breaker of a target, 0 disables the breakers")
+	customerCmd.PersistentFlags().DurationVarP(&breakerCooldown, "breaker-cooldown", "", 30*time.Second, "How long an open circuit breaker waits before it lets a trial call through")
 
 }
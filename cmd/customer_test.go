@@ -0,0 +1,57 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"testing"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/customer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setFlag sets the variable of a flag for the test.
+func setFlag[T any](t *testing.T, variable *T, value T) {
+	t.Helper()
+	old := *variable
+	*variable = value
+	t.Cleanup(func() { *variable = old })
+}
+
+func TestTargetConfigFromFlags(t *testing.T) {
+	setFlag(t, &spiffeAuthz, "spiffe://example.org/backend")
+	setFlag(t, &s3Bucket, "bucket")
+	setFlag(t, &awsAuth, customer.AWSAuthJWT)
+	setFlag(t, &postgreSQLHost, "")
+
+	config, err := targetConfig()
+	require.NoError(t, err)
+	var names []string
+	for _, target := range config.Targets {
+		names = append(names, target.Name)
+	}
+	assert.Equal(t, []string{"mtls", "httpbackend", "aws", "gcp", "postgresql"}, names, "the targets keep the names of the original routes")
+
+	// The flags are validated like a targets file.
+	setFlag(t, &awsAuth, "keys")
+	_, err = targetConfig()
+	assert.ErrorContains(t, err, `unknown auth "keys"`)
+
+	// Targets of flags that aren't set are skipped.
+	setFlag(t, &s3Bucket, "")
+	_, err = targetConfig()
+	assert.NoError(t, err)
+}
@@ -0,0 +1,81 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/customer"
+	"github.com/spf13/cobra"
+)
+
+var (
+	doctorSocket        string
+	doctorTrustDomains  []string
+	doctorExpiryWarning time.Duration
+	doctorTimeout       time.Duration
+	doctorOutput        string
+)
+
+// doctorCmd represents the doctor command
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the SPIFFE environment of the customer",
+	Long: `This checks the environment the customer runs in and prints a report.
+	It checks that the Workload API is reachable and returns valid SVIDs, that there is a bundle for
+	every expected trust domain, that the targets of the customer resolve and accept its SVID with the
+	expected SPIFFE ID, and that the customer gets AWS and GCP credentials.
+	It takes the same target flags and config as the customer and exits with an error when a check failed.`,
+	Example: `  spiffe-demo doctor --targets-file targets.yaml
+  spiffe-demo doctor --backend-service https://backend:8443 --authorized-spiffe spiffe://example.org/backend --output json`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !slices.Contains(customer.DoctorFormats, doctorOutput) {
+			return fmt.Errorf("invalid output format %q, valid formats are %v", doctorOutput, customer.DoctorFormats)
+		}
+		config, err := targetConfig()
+		if err != nil {
+			return err
+		}
+		report := customer.Doctor(cmd.Context(), customer.DoctorConfig{
+			Socket:        doctorSocket,
+			TrustDomains:  doctorTrustDomains,
+			ExpiryWarning: doctorExpiryWarning,
+			Timeout:       doctorTimeout,
+			Targets:       config.Targets,
+		})
+		if err := report.Write(cmd.OutOrStdout(), doctorOutput); err != nil {
+			return err
+		}
+		if !report.Healthy() {
+			return errors.New("at least one check failed")
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+	addTargetFlags(doctorCmd)
+	doctorCmd.PersistentFlags().StringVarP(&doctorSocket, "socket", "", "", "Address of the Workload API, e.g. unix:///run/spire/sockets/agent.sock. Defaults to SPIFFE_ENDPOINT_SOCKET")
+	doctorCmd.PersistentFlags().StringSliceVarP(&doctorTrustDomains, "trust-domain", "", nil, "Trust domain that needs a bundle, can be repeated. The trust domains of the SVID and of the targets are always checked")
+	doctorCmd.PersistentFlags().DurationVarP(&doctorExpiryWarning, "expiry-warning", "", 10*time.Minute, "Warn when an SVID expires sooner than this")
+	doctorCmd.PersistentFlags().DurationVarP(&doctorTimeout, "timeout", "", 5*time.Second, "Timeout of every check that connects to something")
+	doctorCmd.PersistentFlags().StringVarP(&doctorOutput, "output", "", customer.DoctorFormatTable, "Format of the report: table or json")
+}
@@ -0,0 +1,46 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/mattiasgees/spiffe-demo/pkg/extauthz"
+	"github.com/spf13/cobra"
+)
+
+var (
+	extAuthzPolicy   string
+	extAuthzAuditLog string
+	extAuthzXFCC     bool
+)
+
+// extAuthzCmd represents the extauthz command
+var extAuthzCmd = &cobra.Command{
+	Use:   "extauthz",
+	Short: "An Envoy external authorization server with a SPIFFE ID policy",
+	Long: `This starts a gRPC server that implements the Envoy ext_authz Check API.
+	It allows or denies every request based on the SPIFFE ID of the caller, the HTTP method and the path,
+	and writes every decision to an audit log.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		extauthz.StartServer(serverAddress, metricsAddress, extAuthzPolicy, extAuthzAuditLog, extAuthzXFCC)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(extAuthzCmd)
+	extAuthzCmd.PersistentFlags().StringVarP(&extAuthzPolicy, "policy", "", "policy.yaml", "YAML file with the authorization policy")
+	extAuthzCmd.PersistentFlags().StringVarP(&extAuthzAuditLog, "audit-log", "", "-", "File to append the audit log to, - for stdout")
+	extAuthzCmd.PersistentFlags().BoolVarP(&extAuthzXFCC, "trust-xfcc", "", false, "Take the caller from the x-forwarded-client-cert header when the request has no source principal, only behind a proxy that sets it")
+}
@@ -20,6 +20,12 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var (
+	xfccEnabled        bool
+	xfccTrustedProxies []string
+	xfccAllowedIDs     []string
+)
+
 // httpserviceCmd represents the httpservice command
 var httpserviceCmd = &cobra.Command{
 	Use:   "httpservice",
@@ -27,11 +33,14 @@ var httpserviceCmd = &cobra.Command{
 	Long: `The point of this demo is that we want to showcase how an HTTP service
 	can be put behind an Envoy proxy and still do zero-trust wih SPIFFE`,
 	Run: func(cmd *cobra.Command, args []string) {
-		httpservice.StartServer(serverAddress)
-
+		setupTracing("httpservice")
+		httpservice.StartServer(serverAddress, metricsAddress, xfccEnabled, xfccTrustedProxies, xfccAllowedIDs)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(httpserviceCmd)
+	httpserviceCmd.PersistentFlags().BoolVarP(&xfccEnabled, "xfcc", "", false, "Read the identity of the caller from the x-forwarded-client-cert header set by the SPIFFE proxy")
+	httpserviceCmd.PersistentFlags().StringSliceVarP(&xfccTrustedProxies, "xfcc-trusted-proxy", "", []string{"127.0.0.1", "::1"}, "IPs or CIDRs of the proxies the x-forwarded-client-cert header is trusted from. Can be repeated")
+	httpserviceCmd.PersistentFlags().StringSliceVarP(&xfccAllowedIDs, "xfcc-allowed-id", "", []string{}, "SPIFFE IDs that are allowed to call the HTTP service. Everybody is allowed when empty. Can be repeated")
 }
@@ -0,0 +1,53 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/mattiasgees/spiffe-demo/pkg/proxy"
+	"github.com/spf13/cobra"
+)
+
+var (
+	proxyMode          string
+	proxyUpstream      string
+	proxyAuthorizedIDs []string
+)
+
+// proxyCmd represents the proxy command
+var proxyCmd = &cobra.Command{
+	Use:   "proxy",
+	Short: "A SPIFFE sidecar proxy",
+	Long: `This starts a small SPIFFE sidecar proxy that can replace Envoy in front of a service that doesn't speak SPIFFE.
+	In inbound mode it terminates SPIFFE mTLS, authorizes the caller and forwards to a plaintext upstream with the identity
+	of the caller in the x-forwarded-client-cert header. In outbound mode it upgrades plaintext calls to SPIFFE mTLS.
+	Every caller of the outbound proxy calls the upstream with the SVID of the workload, so it only listens on a
+	loopback --server-address like 127.0.0.1:8080.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		authorizedIDs := proxyAuthorizedIDs
+		if spiffeAuthz != "" {
+			authorizedIDs = append(authorizedIDs, spiffeAuthz)
+		}
+		setupTracing("proxy")
+		proxy.StartProxy(proxyMode, serverAddress, metricsAddress, proxyUpstream, authorizedIDs)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(proxyCmd)
+	proxyCmd.PersistentFlags().StringVarP(&proxyMode, "mode", "", proxy.ModeInbound, "Mode of the proxy, inbound or outbound. Outbound serves plaintext and calls the upstream with the SVID of the workload, so --server-address has to be a loopback address")
+	proxyCmd.PersistentFlags().StringVarP(&proxyUpstream, "upstream", "", "http://127.0.0.1:8080", "URL of the upstream the proxy forwards to")
+	proxyCmd.PersistentFlags().StringSliceVarP(&proxyAuthorizedIDs, "allowed-id", "", []string{}, "Inbound: SPIFFE IDs or trust domains (spiffe://example.org) that are allowed to call the upstream, in addition to --authorized-spiffe. Can be repeated")
+}
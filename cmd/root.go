@@ -16,14 +16,25 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/mattiasgees/spiffe-demo/pkg/tracing"
 	"github.com/spf13/cobra"
 )
 
 var (
-	spiffeAuthz   string
-	serverAddress string
+	spiffeAuthz     string
+	serverAddress   string
+	metricsAddress  string
+	tracingExporter string
+	otlpEndpoint    string
+	logFormat       string
+	logLevel        string
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -43,9 +54,51 @@ func Execute() {
 	}
 }
 
+// setup fills the flags from the config file and the environment and then sets up the logger, so the log
+// flags can come from either of them too.
+func setup(cmd *cobra.Command, args []string) error {
+	if err := bindConfig(cmd, args); err != nil {
+		return err
+	}
+	return logging.Setup(os.Stderr, logFormat, logLevel)
+}
+
+// How long the spans that haven't been exported yet may take to flush when the process is stopped.
+const tracingShutdownTimeout = 5 * time.Second
+
+// setupTracing sets up the export of the spans of a service. The spans are exported in batches while the server
+// runs. The servers run until the process is stopped with a signal, the spans of the last batch are flushed then.
+func setupTracing(service string) {
+	shutdown, err := tracing.Setup(context.Background(), service, tracingExporter, otlpEndpoint)
+	if err != nil {
+		logging.Fatal("Unable to set up tracing", err)
+	}
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			logging.Fatal("Unable to flush the spans", err)
+		}
+		os.Exit(0)
+	}()
+}
+
 func init() {
+	// Set here, as the binding walks all commands starting from the root command.
+	rootCmd.PersistentPreRunE = setup
+
 	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 
 	rootCmd.PersistentFlags().StringVarP(&spiffeAuthz, "authorized-spiffe", "a", "", "The SPIFFE Identity that is authorized to talk to/from this service")
 	rootCmd.PersistentFlags().StringVarP(&serverAddress, "server-address", "l", "127.0.0.1:8080", "How do we want to expose our server")
+	rootCmd.PersistentFlags().StringVarP(&configFile, "config-file", "", "", "YAML file with settings for the flags, keyed by flag name. Flags and SPIFFE_DEMO_ environment variables take precedence")
+	rootCmd.PersistentFlags().StringVarP(&tracingExporter, "tracing-exporter", "", tracing.ExporterNone, "Where the OpenTelemetry spans of the customer, backend and httpservice are exported to: none, stdout or otlp")
+	rootCmd.PersistentFlags().StringVarP(&otlpEndpoint, "otlp-endpoint", "", "localhost:4318", "Host and port of the OpenTelemetry collector the otlp exporter sends the spans to over OTLP/HTTP")
+	rootCmd.PersistentFlags().StringVarP(&logFormat, "log-format", "", logging.FormatText, "Format of the log lines: text or json")
+	rootCmd.PersistentFlags().StringVarP(&logLevel, "log-level", "", "info", "Lowest level that is logged: debug, info, warn or error")
+	rootCmd.PersistentFlags().StringVarP(&metricsAddress, "metrics-address", "", "", "Expose the Prometheus metrics on a separate plain HTTP listener at this address. When empty they are served at /metrics on the server address")
 }
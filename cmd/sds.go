@@ -0,0 +1,40 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/mattiasgees/spiffe-demo/pkg/sds"
+	"github.com/spf13/cobra"
+)
+
+var sdsSocketPath string
+
+// sdsCmd represents the sds command
+var sdsCmd = &cobra.Command{
+	Use:   "sds",
+	Short: "An Envoy SDS server backed by the Workload API",
+	Long: `This starts an Envoy Secret Discovery Service (SDS) server on a Unix socket.
+	It gets the X509-SVID and trust bundles from the Workload API and serves them to Envoy
+	as tls_certificate and validation_context secrets, pushing updates on every rotation.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		sds.StartServer(sdsSocketPath, metricsAddress)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(sdsCmd)
+	sdsCmd.PersistentFlags().StringVarP(&sdsSocketPath, "socket", "", "/run/spiffe-demo/sds.sock", "Path of the Unix socket to serve SDS on, only its user may connect")
+}
@@ -0,0 +1,329 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package attack runs attacks against the SPIFFE demo services to prove they enforce zero trust. Every scenario
+// is expected to be blocked, a scenario that gets through is a hole in the policy.
+package attack
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/xfcc"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// Scenarios the attack runs.
+const (
+	ScenarioNoClientCert     = "no-client-cert"
+	ScenarioForgedSPIFFEID   = "forged-spiffe-id"
+	ScenarioForeignCA        = "foreign-ca"
+	ScenarioWrongAudienceJWT = "wrong-audience-jwt"
+	ScenarioReplayedJWT      = "replayed-jwt"
+	ScenarioSpoofedXFCC      = "spoofed-xfcc"
+)
+
+// Outcomes of a scenario.
+const (
+	OutcomeBlocked = "blocked"
+	// OutcomeAllowed means the attack got through.
+	OutcomeAllowed = "allowed"
+	// OutcomeSkipped means the scenario couldn't run, e.g. there is no Workload API to get a JWT-SVID from.
+	OutcomeSkipped = "skipped"
+	// OutcomeInconclusive means the target answered with an error that is no denial, like a 404 or a 502, so
+	// it is unknown whether the attack would have got through.
+	OutcomeInconclusive = "inconclusive"
+)
+
+// Formats of the report.
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+)
+
+// Formats lists the valid values of the format.
+var Formats = []string{FormatTable, FormatJSON}
+
+// Audience of the JWT-SVID of the wrong audience scenario.
+const wrongAudience = "spiffe-demo-attack"
+
+// Config describes what to attack.
+type Config struct {
+	// Target is the URL of the SPIFFE mTLS listener of the backend.
+	Target string
+	// JWTTarget is the URL of the JWT-SVID endpoint of the backend. The JWT scenarios are skipped when it is empty.
+	JWTTarget string
+	// JWTAudience is the audience the JWT target accepts.
+	JWTAudience string
+	// XFCCTarget is the URL of the proxy in front of the httpservice. The XFCC scenario is skipped when it is empty.
+	XFCCTarget string
+	// Impersonate is the SPIFFE ID the target authorizes, which the attacks pretend to be.
+	Impersonate string
+	// Timeout of every scenario.
+	Timeout time.Duration
+}
+
+// Result is the outcome of a single scenario.
+type Result struct {
+	Scenario    string `json:"scenario"`
+	Description string `json:"description"`
+	Target      string `json:"target,omitempty"`
+	Outcome     string `json:"outcome"`
+	Detail      string `json:"detail"`
+}
+
+// Report is the outcome of all scenarios.
+type Report struct {
+	Impersonated string    `json:"impersonated"`
+	Time         time.Time `json:"time"`
+	Results      []Result  `json:"results"`
+}
+
+// Blocked returns whether every attack that ran was blocked. An inconclusive attack isn't proven to be blocked.
+func (r Report) Blocked() bool {
+	for _, result := range r.Results {
+		if result.Outcome == OutcomeAllowed || result.Outcome == OutcomeInconclusive {
+			return false
+		}
+	}
+	return true
+}
+
+// Write writes the report as a table or as JSON.
+func (r Report) Write(w io.Writer, format string) error {
+	switch format {
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(r)
+	case FormatTable:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "SCENARIO\tOUTCOME\tDETAIL\n")
+		for _, result := range r.Results {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", result.Scenario, result.Outcome, result.Detail)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("invalid output format %q, valid formats are %v", format, Formats)
+	}
+}
+
+// workload is what the attacker gets from the Workload API of the node it runs on, if any.
+type workload interface {
+	x509SVID(ctx context.Context) (*x509svid.SVID, error)
+	jwtSVID(ctx context.Context, audience string) (string, error)
+}
+
+// workloadAPI gets the SVIDs of the attacker from the Workload API.
+type workloadAPI struct{}
+
+func (workloadAPI) x509SVID(ctx context.Context) (*x509svid.SVID, error) {
+	return workloadapi.FetchX509SVID(ctx)
+}
+
+func (workloadAPI) jwtSVID(ctx context.Context, audience string) (string, error) {
+	svid, err := workloadapi.FetchJWTSVID(ctx, jwtsvid.Params{Audience: audience})
+	if err != nil {
+		return "", err
+	}
+	return svid.Marshal(), nil
+}
+
+// attacker runs the scenarios.
+type attacker struct {
+	config   Config
+	workload workload
+	forger   forger
+	now      func() time.Time
+}
+
+// Run runs all scenarios. The JWT-SVIDs and the SVID for the XFCC scenario come from the Workload API, the
+// scenarios that need them are skipped when it isn't available.
+func Run(ctx context.Context, config Config) (Report, error) {
+	return newAttacker(config, workloadAPI{}).run(ctx)
+}
+
+func newAttacker(config Config, workload workload) *attacker {
+	return &attacker{config: config, workload: workload, forger: forger{now: time.Now}, now: time.Now}
+}
+
+func (a *attacker) run(ctx context.Context) (Report, error) {
+	impersonate, err := spiffeid.FromString(a.config.Impersonate)
+	if err != nil {
+		return Report{}, fmt.Errorf("invalid SPIFFE ID to impersonate %q: %w", a.config.Impersonate, err)
+	}
+
+	scenarios := []struct {
+		name        string
+		description string
+		target      string
+		run         func(context.Context, spiffeid.ID) (string, string)
+	}{
+		{ScenarioNoClientCert, "Connect without a client certificate", a.config.Target, a.noClientCert},
+		{ScenarioForgedSPIFFEID, "Present a self-signed certificate with the SPIFFE ID of an authorized workload", a.config.Target, a.forgedSPIFFEID},
+		{ScenarioForeignCA, "Present a certificate with the SPIFFE ID of an authorized workload, issued by a CA the target doesn't trust", a.config.Target, a.foreignCA},
+		{ScenarioWrongAudienceJWT, "Send a JWT-SVID of the attacker that was issued for another audience", a.config.JWTTarget, a.wrongAudienceJWT},
+		{ScenarioReplayedJWT, "Send the same JWT-SVID twice, like an attacker who captured a token", a.config.JWTTarget, a.replayedJWT},
+		{ScenarioSpoofedXFCC, "Claim the SPIFFE ID of an authorized workload in the x-forwarded-client-cert header", a.config.XFCCTarget, a.spoofedXFCC},
+	}
+
+	report := Report{Impersonated: impersonate.String(), Time: a.now()}
+	for _, scenario := range scenarios {
+		result := Result{Scenario: scenario.name, Description: scenario.description, Target: scenario.target}
+		if scenario.target == "" {
+			result.Outcome, result.Detail = OutcomeSkipped, "no target configured"
+		} else {
+			scenarioCtx, cancel := context.WithTimeout(ctx, a.config.Timeout)
+			result.Outcome, result.Detail = scenario.run(scenarioCtx, impersonate)
+			cancel()
+		}
+		report.Results = append(report.Results, result)
+	}
+	return report, nil
+}
+
+// response is what came back from the target.
+type response struct {
+	status int
+	body   string
+}
+
+// send does a GET with the client certificate, if any. The attacker doesn't care who the server is, so the
+// certificate of the server isn't verified.
+func send(ctx context.Context, target string, cert *tls.Certificate, header http.Header) (response, error) {
+	config := &tls.Config{InsecureSkipVerify: true}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true}}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return response{}, fmt.Errorf("unable to create request: %w", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return response{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return response{}, fmt.Errorf("unable to read body: %w", err)
+	}
+	return response{status: resp.StatusCode, body: strings.TrimSpace(string(body))}, nil
+}
+
+// verdict decides whether the target blocked the request. A failed handshake or a 401 or 403 is blocked and a
+// 2xx or 3xx means the request got through the authentication and authorization. Any other status, like a
+// crashed or misrouted target, proves neither.
+func verdict(resp response, err error) (string, string) {
+	switch {
+	case err != nil:
+		return OutcomeBlocked, fmt.Sprintf("connection rejected: %v", err)
+	case resp.status == http.StatusUnauthorized || resp.status == http.StatusForbidden:
+		return OutcomeBlocked, fmt.Sprintf("%d %s: %s", resp.status, http.StatusText(resp.status), resp.body)
+	case resp.status >= 200 && resp.status < 400:
+		return OutcomeAllowed, fmt.Sprintf("the target answered %d %s: %s", resp.status, http.StatusText(resp.status), resp.body)
+	default:
+		return OutcomeInconclusive, fmt.Sprintf("the target answered %d %s, which is no denial: %s", resp.status, http.StatusText(resp.status), resp.body)
+	}
+}
+
+func (a *attacker) noClientCert(ctx context.Context, _ spiffeid.ID) (string, string) {
+	return verdict(send(ctx, a.config.Target, nil, nil))
+}
+
+func (a *attacker) forgedSPIFFEID(ctx context.Context, id spiffeid.ID) (string, string) {
+	now := a.now()
+	cert, err := a.forger.leaf(id, now.Add(-time.Hour), now.Add(time.Hour), nil, nil)
+	if err != nil {
+		return OutcomeSkipped, err.Error()
+	}
+	return verdict(send(ctx, a.config.Target, cert, nil))
+}
+
+func (a *attacker) foreignCA(ctx context.Context, id spiffeid.ID) (string, string) {
+	ca, caKey, err := a.forger.ca(id.TrustDomain())
+	if err != nil {
+		return OutcomeSkipped, err.Error()
+	}
+	now := a.now()
+	cert, err := a.forger.leaf(id, now.Add(-time.Hour), now.Add(time.Hour), ca, caKey)
+	if err != nil {
+		return OutcomeSkipped, err.Error()
+	}
+	return verdict(send(ctx, a.config.Target, cert, nil))
+}
+
+func bearer(token string) http.Header {
+	return http.Header{"Authorization": []string{"Bearer " + token}}
+}
+
+func (a *attacker) wrongAudienceJWT(ctx context.Context, _ spiffeid.ID) (string, string) {
+	token, err := a.workload.jwtSVID(ctx, wrongAudience)
+	if err != nil {
+		return OutcomeSkipped, fmt.Sprintf("no JWT-SVID from the Workload API: %v", err)
+	}
+	return verdict(send(ctx, a.config.JWTTarget, nil, bearer(token)))
+}
+
+// replayedJWT uses a JWT-SVID for the right audience once, like the workload it was captured from, and then
+// replays it. Only the replay has to be blocked.
+func (a *attacker) replayedJWT(ctx context.Context, _ spiffeid.ID) (string, string) {
+	token, err := a.workload.jwtSVID(ctx, a.config.JWTAudience)
+	if err != nil {
+		return OutcomeSkipped, fmt.Sprintf("no JWT-SVID from the Workload API: %v", err)
+	}
+	first, err := send(ctx, a.config.JWTTarget, nil, bearer(token))
+	if err != nil {
+		return OutcomeSkipped, fmt.Sprintf("the first use of the token failed: %v", err)
+	}
+	outcome, detail := verdict(send(ctx, a.config.JWTTarget, nil, bearer(token)))
+	return outcome, fmt.Sprintf("first use: %d %s, replay: %s", first.status, http.StatusText(first.status), detail)
+}
+
+// spoofedXFCC claims to be the impersonated workload in the XFCC header. The attacker connects with its own SVID,
+// if it has one, so it gets past the TLS handshake of a proxy that authorizes it. The attack only got through
+// when the upstream believed the header.
+func (a *attacker) spoofedXFCC(ctx context.Context, id spiffeid.ID) (string, string) {
+	var cert *tls.Certificate
+	if svid, err := a.workload.x509SVID(ctx); err == nil {
+		cert = &tls.Certificate{PrivateKey: svid.PrivateKey, Leaf: svid.Certificates[0]}
+		for _, c := range svid.Certificates {
+			cert.Certificate = append(cert.Certificate, c.Raw)
+		}
+	}
+
+	element := xfcc.Element{By: id.TrustDomain().ID().String(), URI: id.String()}
+	resp, err := send(ctx, a.config.XFCCTarget, cert, http.Header{xfcc.Header: []string{element.String()}})
+	outcome, detail := verdict(resp, err)
+	if outcome == OutcomeAllowed && !strings.Contains(resp.body, id.String()) {
+		return OutcomeBlocked, fmt.Sprintf("the forged header was dropped, the upstream answered: %s", resp.body)
+	}
+	return outcome, detail
+}
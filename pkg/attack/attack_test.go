@@ -0,0 +1,211 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package attack
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/xfcc"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeWorkload hands out JWT-SVIDs that are simply the audience, and no X509-SVID.
+type fakeWorkload struct{}
+
+func (fakeWorkload) x509SVID(context.Context) (*x509svid.SVID, error) {
+	return nil, errors.New("no Workload API")
+}
+
+func (fakeWorkload) jwtSVID(_ context.Context, audience string) (string, error) {
+	return "token-for-" + audience, nil
+}
+
+// startTLSServer starts a server with the TLS config. StartTLS would add its own certificate.
+func startTLSServer(t *testing.T, config *tls.Config, handler http.Handler) string {
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener = tls.NewListener(server.Listener, config)
+	server.Start()
+	t.Cleanup(server.Close)
+	return strings.Replace(server.URL, "http://", "https://", 1)
+}
+
+// targets are the services the attacks run against.
+type targets struct {
+	mtls string
+	jwt  string
+	xfcc string
+}
+
+// startTargets starts a backend that only accepts the customer over mTLS, a JWT-SVID endpoint and a service
+// behind a proxy. The JWT endpoint and the service can be vulnerable.
+func startTargets(t *testing.T, vulnerable bool) targets {
+	f := forger{now: time.Now}
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	ca, caKey, err := f.ca(td)
+	require.NoError(t, err)
+	backendID := spiffeid.RequireFromString("spiffe://example.org/backend")
+	serverCert, err := f.leaf(backendID, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), ca, caKey)
+	require.NoError(t, err)
+	svid := &x509svid.SVID{ID: backendID, Certificates: []*x509.Certificate{serverCert.Leaf}, PrivateKey: serverCert.PrivateKey.(crypto.Signer)}
+	bundle := x509bundle.FromX509Authorities(td, []*x509.Certificate{ca})
+
+	hello := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("hello")) })
+	mtlsConfig := tlsconfig.MTLSServerConfig(svid, bundle, tlsconfig.AuthorizeID(spiffeid.RequireFromString("spiffe://example.org/customer")))
+
+	var mu sync.Mutex
+	used := map[string]bool{}
+	jwtHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		switch {
+		case token != "token-for-spiffe-demo-backend":
+			http.Error(w, "wrong audience", http.StatusUnauthorized)
+		case used[token] && !vulnerable:
+			http.Error(w, "replayed", http.StatusUnauthorized)
+		default:
+			used[token] = true
+			w.Write([]byte("hello"))
+		}
+	})
+
+	xfccHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller := "spiffe://example.org/attacker"
+		if vulnerable {
+			elements, _ := xfcc.Parse(r.Header.Get(xfcc.Header))
+			caller = elements[0].URI
+		}
+		w.Write([]byte("Caller: " + caller))
+	})
+
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{*serverCert}}
+	return targets{
+		mtls: startTLSServer(t, mtlsConfig, hello),
+		jwt:  startTLSServer(t, serverConfig, jwtHandler),
+		xfcc: startTLSServer(t, serverConfig.Clone(), xfccHandler),
+	}
+}
+
+func runAttack(t *testing.T, targets targets) Report {
+	config := Config{
+		Target:      targets.mtls,
+		JWTTarget:   targets.jwt,
+		JWTAudience: "spiffe-demo-backend",
+		XFCCTarget:  targets.xfcc,
+		Impersonate: "spiffe://example.org/customer",
+		Timeout:     5 * time.Second,
+	}
+	report, err := newAttacker(config, fakeWorkload{}).run(context.Background())
+	require.NoError(t, err)
+	return report
+}
+
+func outcomes(report Report) map[string]string {
+	outcomes := map[string]string{}
+	for _, result := range report.Results {
+		outcomes[result.Scenario] = result.Outcome
+	}
+	return outcomes
+}
+
+func TestAttackIsBlocked(t *testing.T) {
+	report := runAttack(t, startTargets(t, false))
+
+	require.Len(t, report.Results, 6)
+	for _, result := range report.Results {
+		assert.Equal(t, OutcomeBlocked, result.Outcome, "%s: %s", result.Scenario, result.Detail)
+	}
+	assert.True(t, report.Blocked())
+	assert.Equal(t, "spiffe://example.org/customer", report.Impersonated)
+}
+
+func TestAttackFindsHoles(t *testing.T) {
+	report := runAttack(t, startTargets(t, true))
+
+	result := outcomes(report)
+	assert.Equal(t, OutcomeBlocked, result[ScenarioForgedSPIFFEID])
+	assert.Equal(t, OutcomeBlocked, result[ScenarioWrongAudienceJWT])
+	assert.Equal(t, OutcomeAllowed, result[ScenarioReplayedJWT])
+	assert.Equal(t, OutcomeAllowed, result[ScenarioSpoofedXFCC])
+	assert.False(t, report.Blocked())
+}
+
+func TestAttackSkipsScenariosWithoutTarget(t *testing.T) {
+	targets := startTargets(t, false)
+	targets.jwt, targets.xfcc = "", ""
+	report := runAttack(t, targets)
+
+	result := outcomes(report)
+	assert.Equal(t, OutcomeBlocked, result[ScenarioNoClientCert])
+	assert.Equal(t, OutcomeSkipped, result[ScenarioReplayedJWT])
+	assert.Equal(t, OutcomeSkipped, result[ScenarioSpoofedXFCC])
+	assert.True(t, report.Blocked(), "skipped scenarios don't count as a hole")
+
+	_, err := newAttacker(Config{Impersonate: "customer"}, fakeWorkload{}).run(context.Background())
+	assert.Error(t, err)
+}
+
+func TestVerdict(t *testing.T) {
+	for status, outcome := range map[int]string{
+		http.StatusOK:                  OutcomeAllowed,
+		http.StatusFound:               OutcomeAllowed,
+		http.StatusUnauthorized:        OutcomeBlocked,
+		http.StatusForbidden:           OutcomeBlocked,
+		http.StatusNotFound:            OutcomeInconclusive,
+		http.StatusInternalServerError: OutcomeInconclusive,
+		http.StatusBadGateway:          OutcomeInconclusive,
+	} {
+		got, _ := verdict(response{status: status}, nil)
+		assert.Equal(t, outcome, got, status)
+	}
+
+	report := Report{Results: []Result{{Scenario: ScenarioNoClientCert, Outcome: OutcomeInconclusive}}}
+	assert.False(t, report.Blocked(), "an inconclusive attack isn't proven to be blocked")
+}
+
+func TestReportWrite(t *testing.T) {
+	report := Report{Impersonated: "spiffe://example.org/customer", Results: []Result{{Scenario: ScenarioNoClientCert, Outcome: OutcomeBlocked, Detail: "connection rejected"}}}
+
+	var table bytes.Buffer
+	require.NoError(t, report.Write(&table, FormatTable))
+	assert.Contains(t, table.String(), "SCENARIO")
+	assert.Contains(t, table.String(), "no-client-cert  blocked")
+
+	var decoded Report
+	var out bytes.Buffer
+	require.NoError(t, report.Write(&out, FormatJSON))
+	require.NoError(t, json.Unmarshal(out.Bytes(), &decoded))
+	assert.Equal(t, report.Results, decoded.Results)
+
+	assert.Error(t, report.Write(&out, "yaml"))
+}
@@ -0,0 +1,94 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package attack
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"net/url"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// forger creates certificates with any SPIFFE ID an attacker likes. None of them chain up to the trust bundle
+// of the target, which is the whole point: anybody can put a SPIFFE ID in a certificate.
+type forger struct {
+	now func() time.Time
+}
+
+// ca creates a CA of its own for the trust domain of the ID, a foreign CA to the target.
+func (f forger) ca(td spiffeid.TrustDomain) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	now := f.now()
+	template := &x509.Certificate{
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		URIs:                  []*url.URL{td.ID().URL()},
+	}
+	return f.create(template, nil, nil)
+}
+
+// leaf creates a client certificate with the SPIFFE ID. Without a parent it is self-signed.
+func (f forger) leaf(id spiffeid.ID, notBefore, notAfter time.Time, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*tls.Certificate, error) {
+	template := &x509.Certificate{
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		URIs:        []*url.URL{id.URL()},
+	}
+	cert, key, err := f.create(template, parent, parentKey)
+	if err != nil {
+		return nil, err
+	}
+	chain := [][]byte{cert.Raw}
+	if parent != nil {
+		chain = append(chain, parent.Raw)
+	}
+	return &tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: cert}, nil
+}
+
+func (f forger) create(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to generate serial number: %w", err)
+	}
+	template.SerialNumber = serial
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse certificate: %w", err)
+	}
+	return cert, key, nil
+}
@@ -19,31 +19,73 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"time"
 
 	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/mattiasgees/spiffe-demo/pkg/instrument"
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/mattiasgees/spiffe-demo/pkg/metrics"
+	"github.com/mattiasgees/spiffe-demo/pkg/tracing"
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"github.com/spiffe/go-spiffe/v2/spiffetls"
 	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
 )
 
+// Name of the service used in the metrics.
+const serviceName = "backend"
+
 type BackendService struct {
-	spiffeAuthz   string
-	serverAddress string
+	spiffeAuthz string
+	// The SPIFFE ID of --authorized-spiffe, the only caller of the routes other than the orders API.
+	clientID       spiffeid.ID
+	serverAddress  string
+	metricsAddress string
+	downstreams    []downstreamTarget
+	source         *workloadapi.X509Source
+	handshakes     *handshakeMonitor
+	orders         *orderStore
+	orderAdmins    []spiffeid.ID
+	jwtAddress     string
+	jwtAudience    string
 }
 
 // Main function that creates the backend server and starts it. This is called from the CLI.
-func StartServer(spiffeAuthz, serverAddress string) {
+func StartServer(spiffeAuthz, serverAddress, metricsAddress string, downstreams []string, ordersFile string, orderAdmins []string, jwtAddress, jwtAudience string) {
 	backendService := BackendService{
-		spiffeAuthz:   spiffeAuthz,
-		serverAddress: serverAddress,
+		spiffeAuthz:    spiffeAuthz,
+		serverAddress:  serverAddress,
+		metricsAddress: metricsAddress,
+		jwtAddress:     jwtAddress,
+		jwtAudience:    jwtAudience,
+	}
+
+	for _, downstream := range downstreams {
+		target, err := parseDownstream(downstream)
+		if err != nil {
+			logging.Fatal("Invalid downstream", err)
+		}
+		backendService.downstreams = append(backendService.downstreams, target)
+	}
+
+	orders, err := newOrderStore(ordersFile)
+	if err != nil {
+		logging.Fatal("Unable to load the orders", err)
+	}
+	backendService.orders = orders
+
+	for _, admin := range orderAdmins {
+		adminID, err := spiffeid.FromString(admin)
+		if err != nil {
+			logging.Fatal("Invalid SPIFFE ID for orders admin "+admin, err)
+		}
+		backendService.orderAdmins = append(backendService.orderAdmins, adminID)
 	}
 
 	if err := backendService.run(context.Background()); err != nil {
-		log.Fatal(err)
+		logging.Fatal("Backend server stopped", err)
 	}
 }
 
@@ -59,7 +101,26 @@ func (b *BackendService) run(ctx context.Context) error {
 	defer cancel()
 
 	// Set up a `/` resource handler
-	http.HandleFunc("/", b.rootHandler)
+	handle("/", "/", b.onlyClient(b.rootHandler))
+	handle(common.CallChainPath, common.CallChainPath, b.onlyClient(b.chainHandler))
+	handle(common.HandshakeFailuresPath, common.HandshakeFailuresPath, b.onlyClient(b.handshakeFailuresHandler))
+	handle(common.WebSocketPath, common.WebSocketPath, b.onlyClient(b.webSocketHandler))
+
+	// Set up the orders API, which authorizes every record based on the SPIFFE ID that created it.
+	orderPath := common.OrdersPath + "/{id}"
+	handle("GET "+common.OrdersPath, common.OrdersPath, b.listOrdersHandler)
+	handle("POST "+common.OrdersPath, common.OrdersPath, b.createOrderHandler)
+	handle("GET "+orderPath, orderPath, b.getOrderHandler)
+	handle("PUT "+orderPath, orderPath, b.updateOrderHandler)
+	handle("DELETE "+orderPath, orderPath, b.deleteOrderHandler)
+
+	// Prometheus can't scrape the mTLS listener without an SVID of its own, which is why the metrics
+	// are preferably exposed on a separate listener.
+	if b.metricsAddress != "" {
+		metrics.Serve(b.metricsAddress)
+	} else {
+		http.Handle(metrics.Path, metrics.Handler())
+	}
 
 	// SPIFFE CONCEPT: Server-Side X509Source
 	// Just like the client, the server uses X509Source to get its identity from SPIRE.
@@ -71,6 +132,12 @@ func (b *BackendService) run(ctx context.Context) error {
 		return fmt.Errorf("unable to create X509Source: %w", err)
 	}
 	defer source.Close()
+	b.source = source
+	for i := range b.downstreams {
+		b.downstreams[i].client = newDownstreamClient(source, b.downstreams[i].spiffeID)
+	}
+	metrics.RegisterSVIDExpiry(serviceName, source)
+	common.RegisterLocalSVID(source)
 
 	// SPIFFE CONCEPT: Client Authorization
 	// The server specifies which SPIFFE ID(s) are allowed to connect.
@@ -82,6 +149,7 @@ func (b *BackendService) run(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("invalid SPIFFE ID configuration: %w", err)
 	}
+	b.clientID = clientID
 
 	// SPIFFE CONCEPT: mTLS Server Configuration
 	// MTLSServerConfig creates a TLS configuration for mutual TLS on the server side:
@@ -89,11 +157,27 @@ func (b *BackendService) run(ctx context.Context) error {
 	//   - Second 'source' parameter: provides trust bundles to validate client certificates
 	//   - AuthorizeID(clientID): only accept clients with this exact SPIFFE ID
 	// Note: ListenAndServeTLS("", "") works because the TLS config already has the certs!
-	tlsConfig := tlsconfig.MTLSServerConfig(source, source, tlsconfig.AuthorizeID(clientID))
+	// The orders admins need to be able to connect as well, onlyClient keeps them to the orders API.
+	authorizer := tlsconfig.AuthorizeOneOf(append([]spiffeid.ID{clientID}, b.orderAdmins...)...)
+	tlsConfig := tlsconfig.MTLSServerConfig(source, source, metrics.Authorizer(serviceName, authorizer))
+
+	// Only the client is allowed to call the backend with a JWT-SVID.
+	if b.jwtAddress != "" {
+		if err := b.serveJWT(ctx, source, tlsconfig.AuthorizeID(clientID)); err != nil {
+			return err
+		}
+	}
+
+	// Capture and classify every handshake that gets rejected, so we can show who tried to connect and why it failed.
+	b.handshakes = newHandshakeMonitor(serviceName)
+	b.handshakes.hook(tlsConfig)
+
 	server := &http.Server{
 		Addr:              b.serverAddress,
 		TLSConfig:         tlsConfig,
 		ReadHeaderTimeout: time.Second * 10,
+		// net/http reports failed TLS handshakes only to the ErrorLog of the server.
+		ErrorLog: b.handshakes.errorLog(),
 	}
 
 	// Serve the SPIFFE mTLS server.
@@ -104,23 +188,51 @@ func (b *BackendService) run(ctx context.Context) error {
 	return nil
 }
 
+// handle registers a handler for a pattern. The requests are counted and traced by route.
+func handle(pattern, route string, handler http.HandlerFunc) {
+	http.HandleFunc(pattern, instrument.Handler(serviceName, route, handler))
+}
+
+// onlyClient lets only the client call a route. The orders admins pass the handshake as well, but they may only
+// use the orders API.
+func (b *BackendService) onlyClient(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := callerID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if caller != b.clientID {
+			tracing.Deny(r.Context(), "orders admins may only use the orders API")
+			http.Error(w, fmt.Sprintf("%s may only use the orders API", caller), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
 // function that handles calls to `/`. This will just respond with a simple message and the date and time.
 func (b *BackendService) rootHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Request received from %s", r.RemoteAddr)
+	slog.Debug("Request received", logging.RemoteKey, r.RemoteAddr)
 	currentTime := time.Now()
 	formattedTime := currentTime.Format(common.TimeFormat)
 	text := fmt.Sprintf("%s: Successfully connected to the backend service!!!", formattedTime)
 	if _, err := io.WriteString(w, text); err != nil {
-		log.Printf("Error writing response: %v", err)
+		slog.Error("Error writing response", logging.Err(err))
 	}
 
 	// SPIFFE CONCEPT: Identifying the Caller
 	// In a SPIFFE-authenticated connection, we can extract the client's SPIFFE ID
 	// from the TLS connection state. This enables identity-aware logging and
 	// fine-grained authorization decisions within the request handler.
+	if r.TLS == nil {
+		slog.Warn("Wasn't able to determine the SPIFFE ID of the requestor, the request didn't use TLS")
+		return
+	}
 	requestorSPIFFEID, err := spiffetls.PeerIDFromConnectionState(*r.TLS)
 	if err != nil {
-		log.Printf("Wasn't able to determine the SPIFFE ID of the requestor: %v", err)
+		slog.Warn("Wasn't able to determine the SPIFFE ID of the requestor", logging.Err(err))
+		return
 	}
-	log.Printf("Responded to %s with the following message: %s", requestorSPIFFEID.String(), text)
+	slog.Info("Responded to the requestor", logging.PeerIDKey, requestorSPIFFEID.String(), "message", text)
 }
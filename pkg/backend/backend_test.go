@@ -51,6 +51,20 @@ func TestRootHandler(t *testing.T) {
 	assert.Contains(t, body, "Successfully connected to the backend service!!!", "response should contain success message")
 }
 
+func TestRootHandlerWithoutTLS(t *testing.T) {
+	svc := BackendService{
+		spiffeAuthz:   "spiffe://example.org/test",
+		serverAddress: ":8443",
+	}
+
+	req, err := http.NewRequest("GET", "/", nil)
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	assert.NotPanics(t, func() { svc.rootHandler(rr, req) }, "a request without a TLS connection state should not panic")
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
 func TestRootHandlerResponseFormat(t *testing.T) {
 	svc := BackendService{
 		spiffeAuthz:   "spiffe://example.org/test",
@@ -0,0 +1,178 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/mattiasgees/spiffe-demo/pkg/tracing"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// How long a pooled connection to a downstream service may stay idle before it is closed.
+const downstreamIdleConnTimeout = 90 * time.Second
+
+// A downstream service the backend calls when it receives a call chain request.
+type downstreamTarget struct {
+	spiffeID spiffeid.ID
+	address  string
+	// client is created once the X509Source is available and reused for every call chain request.
+	client *http.Client
+}
+
+// parseDownstream parses a downstream target in the format `<spiffe-id>=<url>`.
+func parseDownstream(value string) (downstreamTarget, error) {
+	id, address, found := strings.Cut(value, "=")
+	if !found {
+		return downstreamTarget{}, fmt.Errorf("downstream %q is not in the format <spiffe-id>=<url>", value)
+	}
+
+	spiffeID, err := spiffeid.FromString(id)
+	if err != nil {
+		return downstreamTarget{}, fmt.Errorf("invalid SPIFFE ID for downstream %q: %w", value, err)
+	}
+
+	if _, err := url.ParseRequestURI(address); err != nil {
+		return downstreamTarget{}, fmt.Errorf("invalid URL for downstream %q: %w", value, err)
+	}
+
+	return downstreamTarget{spiffeID: spiffeID, address: address}, nil
+}
+
+// newDownstreamClient creates the mTLS client for a downstream service. It keeps its connections open between
+// call chain requests and closes them after they have been idle for a while.
+func newDownstreamClient(source *workloadapi.X509Source, spiffeID spiffeid.ID) *http.Client {
+	return &http.Client{
+		// The trace context of the call chain is passed on to the downstream service.
+		Transport: tracing.Transport(&http.Transport{
+			TLSClientConfig: tlsconfig.MTLSClientConfig(source, source, tlsconfig.AuthorizeID(spiffeID)),
+			IdleConnTimeout: downstreamIdleConnTimeout,
+		}),
+	}
+}
+
+// function that handles calls to `/chain`. The backend adds itself as a hop and calls all of its downstream services.
+func (b *BackendService) chainHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Call chain request received", logging.RemoteKey, r.RemoteAddr)
+
+	hop := common.Hop{Service: "backend"}
+
+	// SPIFFE CONCEPT: Own Identity vs. Caller Identity
+	// The backend reports both its own SPIFFE ID (from its SVID) and the SPIFFE ID of
+	// the workload that called it (from the mTLS connection).
+	if b.source != nil {
+		if svid, err := b.source.GetX509SVID(); err == nil {
+			hop.SPIFFEID = svid.ID.String()
+		}
+	}
+	if r.TLS != nil {
+		if callerID, err := spiffetls.PeerIDFromConnectionState(*r.TLS); err == nil {
+			hop.CallerID = callerID.String()
+		}
+	}
+
+	hops := 0
+	if value := r.Header.Get(common.CallChainHopsHeader); value != "" {
+		var err error
+		if hops, err = strconv.Atoi(value); err != nil || hops < 0 {
+			http.Error(w, fmt.Sprintf("Invalid %s header %q", common.CallChainHopsHeader, value), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// A cycle in the downstream config would otherwise call around until every hop times out.
+	if hops >= common.MaxCallChainHops && len(b.downstreams) > 0 {
+		hop.Error = fmt.Sprintf("the call chain reached %d hops, not calling the downstream services, check --downstream for a cycle", hops)
+	} else {
+		for _, target := range b.downstreams {
+			hop.Downstream = append(hop.Downstream, b.callDownstream(r.Context(), target, hops+1))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(hop); err != nil {
+		slog.Error("Error writing response", logging.Err(err))
+	}
+}
+
+// callDownstream calls the call chain endpoint of a downstream service over mTLS with the SVID of the backend.
+//
+// SPIFFE CONCEPT: Every Hop Uses Its Own Identity
+// The backend does not forward the certificate of its caller (it can't, it doesn't have the private key).
+// Instead it presents its own X.509-SVID and verifies the SPIFFE ID of the downstream service.
+func (b *BackendService) callDownstream(ctx context.Context, target downstreamTarget, hops int) common.Hop {
+	hop := common.Hop{SPIFFEID: target.spiffeID.String()}
+
+	if target.client == nil {
+		hop.Error = "no X509Source available"
+		return hop
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, common.DefaultTimeout)
+	defer cancel()
+
+	chainURL, err := url.JoinPath(target.address, common.CallChainPath)
+	if err != nil {
+		hop.Error = fmt.Sprintf("invalid downstream address: %v", err)
+		return hop
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, chainURL, nil)
+	if err != nil {
+		hop.Error = fmt.Sprintf("unable to create request: %v", err)
+		return hop
+	}
+	req.Header.Set(common.CallChainHopsHeader, strconv.Itoa(hops))
+
+	resp, err := target.client.Do(req)
+	if err != nil {
+		hop.Error = fmt.Sprintf("error connecting to %q: %v", target.address, err)
+		return hop
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		hop.Error = fmt.Sprintf("%q returned status %d", target.address, resp.StatusCode)
+		return hop
+	}
+
+	var downstream common.Hop
+	if err := json.NewDecoder(resp.Body).Decode(&downstream); err != nil {
+		hop.Error = fmt.Sprintf("unable to decode call chain from %q: %v", target.address, err)
+		return hop
+	}
+
+	// Services behind a SPIFFE proxy (like the httpservice behind Envoy) don't know their own SPIFFE ID.
+	// The identity we verified during the TLS handshake is the one that counts.
+	if downstream.SPIFFEID == "" {
+		downstream.SPIFFEID = hop.SPIFFEID
+	}
+
+	return downstream
+}
@@ -0,0 +1,141 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backend
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDownstream(t *testing.T) {
+	target, err := parseDownstream("spiffe://example.org/backend-2=https://backend-2:8443")
+	require.NoError(t, err)
+	assert.Equal(t, "spiffe://example.org/backend-2", target.spiffeID.String())
+	assert.Equal(t, "https://backend-2:8443", target.address)
+}
+
+func TestParseDownstreamInvalid(t *testing.T) {
+	for _, value := range []string{
+		"spiffe://example.org/backend-2",
+		"not-a-spiffe-id=https://backend-2:8443",
+		"spiffe://example.org/backend-2=not a url",
+	} {
+		_, err := parseDownstream(value)
+		assert.Error(t, err, "parsing %q should fail", value)
+	}
+}
+
+func TestChainHandlerWithoutDownstreams(t *testing.T) {
+	svc := BackendService{spiffeAuthz: "spiffe://example.org/test"}
+
+	req, err := http.NewRequest("GET", common.CallChainPath, nil)
+	require.NoError(t, err)
+	req.TLS = &tls.ConnectionState{}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(svc.chainHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var hop common.Hop
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &hop))
+	assert.Equal(t, "backend", hop.Service)
+	assert.Empty(t, hop.Downstream)
+}
+
+func TestChainHandlerReportsUnreachableDownstream(t *testing.T) {
+	target, err := parseDownstream("spiffe://example.org/backend-2=https://backend-2:8443")
+	require.NoError(t, err)
+	svc := BackendService{downstreams: []downstreamTarget{target}}
+
+	req, err := http.NewRequest("GET", common.CallChainPath, nil)
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(svc.chainHandler).ServeHTTP(rr, req)
+
+	var hop common.Hop
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &hop))
+	require.Len(t, hop.Downstream, 1)
+	assert.Equal(t, "spiffe://example.org/backend-2", hop.Downstream[0].SPIFFEID)
+	assert.NotEmpty(t, hop.Downstream[0].Error)
+}
+
+func TestChainHandlerPassesHopCount(t *testing.T) {
+	var received []string
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get(common.CallChainHopsHeader))
+		json.NewEncoder(w).Encode(common.Hop{Service: "backend-2"})
+	}))
+	t.Cleanup(downstream.Close)
+
+	target, err := parseDownstream("spiffe://example.org/backend-2=" + downstream.URL)
+	require.NoError(t, err)
+	target.client = downstream.Client()
+	svc := BackendService{downstreams: []downstreamTarget{target}}
+
+	// The same client is reused for every request.
+	for range 2 {
+		req := httptest.NewRequest("GET", common.CallChainPath, nil)
+		req.Header.Set(common.CallChainHopsHeader, "2")
+		rr := httptest.NewRecorder()
+		svc.chainHandler(rr, req)
+
+		var hop common.Hop
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &hop))
+		require.Len(t, hop.Downstream, 1)
+		assert.Equal(t, "backend-2", hop.Downstream[0].Service)
+	}
+	assert.Equal(t, []string{"3", "3"}, received)
+}
+
+func TestChainHandlerStopsAtMaxHops(t *testing.T) {
+	called := false
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	t.Cleanup(downstream.Close)
+
+	target, err := parseDownstream("spiffe://example.org/backend=" + downstream.URL)
+	require.NoError(t, err)
+	target.client = downstream.Client()
+	svc := BackendService{downstreams: []downstreamTarget{target}}
+
+	req := httptest.NewRequest("GET", common.CallChainPath, nil)
+	req.Header.Set(common.CallChainHopsHeader, strconv.Itoa(common.MaxCallChainHops))
+	rr := httptest.NewRecorder()
+	svc.chainHandler(rr, req)
+
+	var hop common.Hop
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &hop))
+	assert.Empty(t, hop.Downstream)
+	assert.Contains(t, hop.Error, "check --downstream for a cycle")
+	assert.False(t, called)
+
+	req = httptest.NewRequest("GET", common.CallChainPath, nil)
+	req.Header.Set(common.CallChainHopsHeader, "many")
+	rr = httptest.NewRecorder()
+	svc.chainHandler(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
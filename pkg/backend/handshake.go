@@ -0,0 +1,209 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backend
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/mattiasgees/spiffe-demo/pkg/metrics"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// Number of failed handshakes that are kept in memory.
+const maxHandshakeFailures = 50
+
+// Reasons why a TLS handshake with the backend failed.
+const (
+	reasonNoClientCert     = "no_client_cert"
+	reasonUnknownAuthority = "unknown_authority"
+	reasonNotAuthorized    = "spiffe_id_not_authorized"
+	reasonExpired          = "expired_svid"
+	reasonWrongTrustDomain = "wrong_trust_domain"
+	reasonNotSPIFFE        = "not_a_spiffe_svid"
+	reasonNotTLS           = "not_tls"
+	reasonOther            = "other"
+)
+
+// The order matters: an expired certificate is reported as "could not verify leaf certificate" as well.
+var handshakeErrorClasses = []struct {
+	substring string
+	reason    string
+}{
+	{"didn't provide a certificate", reasonNoClientCert},
+	{"certificate has expired or is not yet valid", reasonExpired},
+	{"no X.509 bundle", reasonWrongTrustDomain},
+	{"unexpected trust domain", reasonWrongTrustDomain},
+	{"unexpected ID", reasonNotAuthorized},
+	{"could not get leaf SPIFFE ID", reasonNotSPIFFE},
+	{"signed by unknown authority", reasonUnknownAuthority},
+	{"could not verify leaf certificate", reasonUnknownAuthority},
+	{"does not look like a TLS handshake", reasonNotTLS},
+}
+
+// net/http logs failed handshakes as "http: TLS handshake error from <address>: <error>".
+var handshakeErrorLine = regexp.MustCompile(`TLS handshake error from (\S+): (.*)`)
+
+// classifyHandshakeError maps the error of a failed TLS handshake to a reason.
+func classifyHandshakeError(message string) string {
+	for _, class := range handshakeErrorClasses {
+		if strings.Contains(message, class.substring) {
+			return class.reason
+		}
+	}
+	return reasonOther
+}
+
+// handshakeMonitor captures and classifies the failed TLS handshakes of a server.
+//
+// SPIFFE CONCEPT: Making Rejections Visible
+// When a workload with the wrong identity (like the rogue customer) connects, the handshake is
+// rejected before any HTTP request reaches our handlers. net/http only writes a generic line to
+// its error log. The monitor verifies the peer itself in VerifyConnection, so it can remember the
+// identity that was presented, and then picks up the error from the server's ErrorLog.
+type handshakeMonitor struct {
+	service string
+
+	mu sync.Mutex
+	// Identity presented by peers whose handshake is failing, by remote address.
+	presented map[string]string
+	failures  []common.HandshakeFailure
+}
+
+func newHandshakeMonitor(service string) *handshakeMonitor {
+	return &handshakeMonitor{
+		service:   service,
+		presented: map[string]string{},
+	}
+}
+
+// hook moves the SPIFFE verification of a server TLS config into VerifyConnection, which runs per connection.
+// This is needed to relate the identity of the peer to the remote address that shows up in the ErrorLog.
+func (m *handshakeMonitor) hook(config *tls.Config) {
+	base := config.Clone()
+	verifyPeerCertificate := base.VerifyPeerCertificate
+	base.VerifyPeerCertificate = nil
+
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		remoteAddr := hello.Conn.RemoteAddr().String()
+
+		connConfig := base.Clone()
+		connConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if verifyPeerCertificate == nil {
+				return nil
+			}
+
+			rawCerts := make([][]byte, 0, len(state.PeerCertificates))
+			for _, cert := range state.PeerCertificates {
+				rawCerts = append(rawCerts, cert.Raw)
+			}
+
+			err := verifyPeerCertificate(rawCerts, nil)
+			if err != nil {
+				m.setPresented(remoteAddr, state.PeerCertificates)
+			}
+			return err
+		}
+		return connConfig, nil
+	}
+}
+
+func (m *handshakeMonitor) setPresented(remoteAddr string, certs []*x509.Certificate) {
+	if len(certs) == 0 {
+		return
+	}
+	id, err := x509svid.IDFromCert(certs[0])
+	if err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.presented[remoteAddr] = id.String()
+}
+
+// record classifies a failed handshake and keeps it in the list of recent failures.
+func (m *handshakeMonitor) record(remoteAddr, message string) {
+	reason := classifyHandshakeError(message)
+	metrics.HandshakeFailed(m.service, reason)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	failure := common.HandshakeFailure{
+		Time:        time.Now(),
+		RemoteAddr:  remoteAddr,
+		Reason:      reason,
+		PresentedID: m.presented[remoteAddr],
+		Error:       message,
+	}
+	delete(m.presented, remoteAddr)
+
+	m.failures = append(m.failures, failure)
+	if len(m.failures) > maxHandshakeFailures {
+		m.failures = m.failures[len(m.failures)-maxHandshakeFailures:]
+	}
+	slog.Warn("TLS handshake failed", logging.RemoteKey, remoteAddr, logging.PeerIDKey, failure.PresentedID, "reason", reason)
+}
+
+// recent returns the most recent failed handshakes, newest first.
+func (m *handshakeMonitor) recent() []common.HandshakeFailure {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	failures := make([]common.HandshakeFailure, 0, len(m.failures))
+	for i := len(m.failures) - 1; i >= 0; i-- {
+		failures = append(failures, m.failures[i])
+	}
+	return failures
+}
+
+// errorLog returns a logger to use as the http.Server ErrorLog, which is the only place net/http reports failed handshakes.
+func (m *handshakeMonitor) errorLog() *log.Logger {
+	return log.New(m, "", 0)
+}
+
+func (m *handshakeMonitor) Write(p []byte) (int, error) {
+	if match := handshakeErrorLine.FindSubmatch(p); match != nil {
+		// record already logs the failure with the SPIFFE ID the peer presented.
+		m.record(string(match[1]), strings.TrimSpace(string(match[2])))
+		return len(p), nil
+	}
+	return logging.ServerErrors(m.service).Write(p)
+}
+
+// function that handles calls to `/handshake-failures`. It returns the most recent failed handshakes as JSON.
+func (b *BackendService) handshakeFailuresHandler(w http.ResponseWriter, r *http.Request) {
+	var failures []common.HandshakeFailure
+	if b.handshakes != nil {
+		failures = b.handshakes.recent()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(failures); err != nil {
+		slog.Error("Error writing response", logging.Err(err))
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backend
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/internal/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyHandshakeError(t *testing.T) {
+	tests := map[string]string{
+		"tls: client didn't provide a certificate":                                                                         reasonNoClientCert,
+		"x509svid: could not verify leaf certificate: x509: certificate signed by unknown authority":                       reasonUnknownAuthority,
+		"x509svid: could not verify leaf certificate: x509: certificate has expired or is not yet valid: current time ...": reasonExpired,
+		`x509svid: could not get X509 bundle: x509bundle: no X.509 bundle for trust domain "evil.org"`:                     reasonWrongTrustDomain,
+		`unexpected ID "spiffe://example.org/rogue"`:                                                                       reasonNotAuthorized,
+		"x509svid: could not get leaf SPIFFE ID: certificate contains no URI SAN":                                          reasonNotSPIFFE,
+		"tls: first record does not look like a TLS handshake":                                                             reasonNotTLS,
+		"EOF": reasonOther,
+	}
+	for message, reason := range tests {
+		assert.Equal(t, reason, classifyHandshakeError(message), message)
+	}
+}
+
+func TestHandshakeMonitorRecordsFailures(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	ca := spiffetest.NewCA(t, td)
+	foreignCA := spiffetest.NewCA(t, td)
+	bundle := x509bundle.FromX509Authorities(td, []*x509.Certificate{ca.Cert})
+
+	serverSVID := ca.Issue(t, "spiffe://example.org/backend")
+	customerID := spiffeid.RequireFromString("spiffe://example.org/customer")
+
+	tlsConfig := tlsconfig.MTLSServerConfig(serverSVID, bundle, tlsconfig.AuthorizeID(customerID))
+	monitor := newHandshakeMonitor("test")
+	monitor.hook(tlsConfig)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = tlsConfig
+	server.Config.ErrorLog = monitor.errorLog()
+	server.StartTLS()
+	defer server.Close()
+
+	call := func(clientSVID *x509svid.SVID) error {
+		var config *tls.Config
+		if clientSVID == nil {
+			config = tlsconfig.TLSClientConfig(bundle, tlsconfig.AuthorizeAny())
+		} else {
+			config = tlsconfig.MTLSClientConfig(clientSVID, bundle, tlsconfig.AuthorizeAny())
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	require.NoError(t, call(ca.Issue(t, customerID.String())))
+	assert.Error(t, call(nil))
+	assert.Error(t, call(ca.Issue(t, "spiffe://example.org/rogue")))
+	assert.Error(t, call(foreignCA.Issue(t, "spiffe://example.org/customer")))
+
+	// The server logs the handshake error asynchronously from the client seeing the failure.
+	require.Eventually(t, func() bool { return len(monitor.recent()) == 3 }, 5*time.Second, 10*time.Millisecond)
+
+	presented := map[string]string{}
+	for _, failure := range monitor.recent() {
+		presented[failure.Reason] = failure.PresentedID
+	}
+	assert.Equal(t, map[string]string{
+		reasonNoClientCert:     "",
+		reasonNotAuthorized:    "spiffe://example.org/rogue",
+		reasonUnknownAuthority: "spiffe://example.org/customer",
+	}, presented)
+}
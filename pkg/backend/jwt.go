@@ -0,0 +1,178 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/instrument"
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/mattiasgees/spiffe-demo/pkg/metrics"
+	"github.com/mattiasgees/spiffe-demo/pkg/tracing"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// JWTPath is the path of the endpoint that authenticates callers with a JWT-SVID.
+const JWTPath = "/jwt"
+
+// DefaultJWTAudience is the audience a JWT-SVID for the backend needs to have.
+const DefaultJWTAudience = "spiffe-demo-backend"
+
+var (
+	errNoBearerToken = errors.New("no bearer token in the Authorization header")
+	errTokenReplayed = errors.New("the JWT-SVID was already used")
+)
+
+// jwtVerifier validates JWT-SVIDs and only accepts every token once.
+//
+// SPIFFE CONCEPT: JWT-SVIDs and Replay
+// A JWT-SVID is a bearer token: whoever has it can use it until it expires. That is why the audience is
+// validated, so a token meant for another service is useless here, and why this endpoint only accepts a token
+// once, so a token that leaked from a request can't be replayed.
+type jwtVerifier struct {
+	bundles    jwtbundle.Source
+	audience   string
+	authorizer tlsconfig.Authorizer
+	now        func() time.Time
+
+	mu sync.Mutex
+	// The hashes of the tokens that were used, until they expire.
+	used map[[sha256.Size]byte]time.Time
+}
+
+func newJWTVerifier(bundles jwtbundle.Source, audience string, authorizer tlsconfig.Authorizer) *jwtVerifier {
+	return &jwtVerifier{
+		bundles:    bundles,
+		audience:   audience,
+		authorizer: authorizer,
+		now:        time.Now,
+		used:       map[[sha256.Size]byte]time.Time{},
+	}
+}
+
+// verify validates the token and returns the SPIFFE ID of the caller. The token is used up, also when the
+// caller isn't authorized.
+func (v *jwtVerifier) verify(token string) (spiffeid.ID, error) {
+	svid, err := jwtsvid.ParseAndValidate(token, v.bundles, []string{v.audience})
+	if err != nil {
+		return spiffeid.ID{}, err
+	}
+
+	hash := sha256.Sum256([]byte(token))
+	v.mu.Lock()
+	now := v.now()
+	for used, expiry := range v.used {
+		if now.After(expiry) {
+			delete(v.used, used)
+		}
+	}
+	_, replayed := v.used[hash]
+	v.used[hash] = svid.Expiry
+	v.mu.Unlock()
+	if replayed {
+		return svid.ID, errTokenReplayed
+	}
+	return svid.ID, nil
+}
+
+// bearerToken returns the token of the Authorization header.
+func bearerToken(r *http.Request) (string, error) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return "", errNoBearerToken
+	}
+	return token, nil
+}
+
+// function that handles calls to `/jwt`. The caller authenticates with a JWT-SVID instead of a client certificate.
+func (v *jwtVerifier) handler(w http.ResponseWriter, r *http.Request) {
+	token, err := bearerToken(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	id, err := v.verify(token)
+	if err != nil {
+		slog.Warn("Rejected JWT-SVID", logging.PeerIDKey, id.String(), logging.Err(err))
+		tracing.Deny(r.Context(), err.Error())
+		http.Error(w, fmt.Sprintf("Invalid JWT-SVID: %v", err), http.StatusUnauthorized)
+		return
+	}
+	tracing.SetPeerID(r.Context(), id.String())
+	logging.SetPeerID(r.Context(), id.String())
+	if err := v.authorizer(id, nil); err != nil {
+		tracing.Deny(r.Context(), err.Error())
+		http.Error(w, fmt.Sprintf("%s is not allowed to call the backend: %v", id, err), http.StatusForbidden)
+		return
+	}
+	tracing.Allow(r.Context(), "JWT-SVID with the audience of the backend")
+
+	if _, err := io.WriteString(w, fmt.Sprintf("Successfully authenticated to the backend with a JWT-SVID as %s", id)); err != nil {
+		slog.Error("Error writing response", logging.Err(err))
+	}
+}
+
+// serveJWT starts the listener that authenticates callers with a JWT-SVID. It only uses TLS to authenticate the
+// backend, the caller doesn't need a client certificate.
+func (b *BackendService) serveJWT(ctx context.Context, svid x509svid.Source, authorizer tlsconfig.Authorizer) error {
+	// Listen before serving, so a port that is in use stops the backend instead of only the JWT listener.
+	listener, err := net.Listen("tcp", b.jwtAddress)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %w", b.jwtAddress, err)
+	}
+
+	bundles, err := workloadapi.NewJWTSource(ctx)
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("unable to create JWTSource: %w", err)
+	}
+
+	verifier := newJWTVerifier(bundles, b.jwtAudience, metrics.Authorizer(serviceName, authorizer))
+	mux := http.NewServeMux()
+	mux.HandleFunc(JWTPath, instrument.Handler(serviceName, JWTPath, verifier.handler))
+	server := &http.Server{
+		Addr:              b.jwtAddress,
+		Handler:           mux,
+		TLSConfig:         tlsconfig.TLSServerConfig(svid),
+		ReadHeaderTimeout: time.Second * 10,
+		ErrorLog:          metrics.HandshakeErrorLog(serviceName),
+	}
+
+	go func() {
+		defer bundles.Close()
+		slog.Info("Serving JWT-SVID authentication", "address", b.jwtAddress, "audience", b.jwtAudience)
+		if err := server.ServeTLS(listener, "", ""); err != nil {
+			slog.Error("JWT server stopped", logging.Err(err))
+		}
+	}()
+	return nil
+}
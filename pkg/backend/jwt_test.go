@@ -0,0 +1,119 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backend
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jwtIssuer signs JWT-SVIDs like SPIRE does.
+type jwtIssuer struct {
+	t      *testing.T
+	signer jose.Signer
+}
+
+func newJWTIssuer(t *testing.T, td spiffeid.TrustDomain) (*jwtIssuer, *jwtbundle.Bundle) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	bundle := jwtbundle.New(td)
+	require.NoError(t, bundle.AddJWTAuthority("key-1", key.Public()))
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "key-1"))
+	require.NoError(t, err)
+	return &jwtIssuer{t: t, signer: signer}, bundle
+}
+
+func (i *jwtIssuer) issue(subject, audience string) string {
+	token, err := jwt.Signed(i.signer).Claims(jwt.Claims{
+		Subject:  subject,
+		Audience: jwt.Audience{audience},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+	}).Serialize()
+	require.NoError(i.t, err)
+	return token
+}
+
+func TestJWTHandler(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	issuer, bundle := newJWTIssuer(t, td)
+	customer := spiffeid.RequireFromString("spiffe://example.org/customer")
+	verifier := newJWTVerifier(bundle, DefaultJWTAudience, tlsconfig.AuthorizeID(customer))
+
+	call := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, JWTPath, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		verifier.handler(rr, req)
+		return rr
+	}
+
+	token := issuer.issue(customer.String(), DefaultJWTAudience)
+	rr := call(token)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), customer.String())
+
+	rr = call(token)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code, "a token is only accepted once")
+	assert.Contains(t, rr.Body.String(), errTokenReplayed.Error())
+
+	assert.Equal(t, http.StatusUnauthorized, call("").Code)
+	assert.Equal(t, http.StatusUnauthorized, call(issuer.issue(customer.String(), "another-service")).Code)
+	assert.Equal(t, http.StatusForbidden, call(issuer.issue("spiffe://example.org/rogue", DefaultJWTAudience)).Code)
+}
+
+func TestJWTVerifierForgetsExpiredTokens(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	issuer, bundle := newJWTIssuer(t, td)
+	verifier := newJWTVerifier(bundle, DefaultJWTAudience, tlsconfig.AuthorizeAny())
+
+	_, err := verifier.verify(issuer.issue("spiffe://example.org/customer", DefaultJWTAudience))
+	require.NoError(t, err)
+	assert.Len(t, verifier.used, 1)
+
+	// Once the first token expired, it is forgotten when the next one is used.
+	verifier.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	_, err = verifier.verify(issuer.issue("spiffe://example.org/other", DefaultJWTAudience))
+	require.NoError(t, err)
+	assert.Len(t, verifier.used, 1)
+}
+
+func TestServeJWTFailsWhenThePortIsInUse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	b := &BackendService{jwtAddress: listener.Addr().String()}
+	err = b.serveJWT(context.Background(), nil, tlsconfig.AuthorizeAny())
+	assert.ErrorContains(t, err, "unable to listen")
+}
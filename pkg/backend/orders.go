@@ -0,0 +1,344 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/mattiasgees/spiffe-demo/pkg/tracing"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls"
+)
+
+var errOrderNotFound = errors.New("order not found")
+
+// orderStore keeps the orders in memory. When a file is configured every change is written to it,
+// so the orders survive a restart of the backend.
+type orderStore struct {
+	mu     sync.Mutex
+	file   string
+	nextID int
+	orders map[string]common.Order
+}
+
+// newOrderStore creates an order store and loads the existing orders from the file, if one is configured.
+func newOrderStore(file string) (*orderStore, error) {
+	store := &orderStore{
+		file:   file,
+		nextID: 1,
+		orders: map[string]common.Order{},
+	}
+	if file == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read orders file: %w", err)
+	}
+
+	var orders []common.Order
+	if err := json.Unmarshal(data, &orders); err != nil {
+		return nil, fmt.Errorf("unable to parse orders file: %w", err)
+	}
+	for _, order := range orders {
+		store.orders[order.ID] = order
+		if id, err := strconv.Atoi(order.ID); err == nil && id >= store.nextID {
+			store.nextID = id + 1
+		}
+	}
+	return store, nil
+}
+
+// commit writes the changed orders to the file and only keeps them in memory when that worked, so a failed
+// change is never visible to later requests. The caller must hold the lock.
+func (s *orderStore) commit(orders map[string]common.Order) error {
+	if err := s.save(orders); err != nil {
+		return err
+	}
+	s.orders = orders
+	return nil
+}
+
+// save writes the orders to the file.
+func (s *orderStore) save(orders map[string]common.Order) error {
+	if s.file == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(sortOrders(orders), "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal orders: %w", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a half written orders file behind.
+	tmp := s.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("unable to write orders file: %w", err)
+	}
+	return os.Rename(tmp, s.file)
+}
+
+// sortOrders returns the orders sorted by ID.
+func sortOrders(byID map[string]common.Order) []common.Order {
+	orders := make([]common.Order, 0, len(byID))
+	for _, order := range byID {
+		orders = append(orders, order)
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		a, _ := strconv.Atoi(orders[i].ID)
+		b, _ := strconv.Atoi(orders[j].ID)
+		return a < b
+	})
+	return orders
+}
+
+func (s *orderStore) list() []common.Order {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortOrders(s.orders)
+}
+
+func (s *orderStore) get(id string) (common.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[id]
+	if !ok {
+		return common.Order{}, errOrderNotFound
+	}
+	return order, nil
+}
+
+func (s *orderStore) create(owner string, request common.OrderRequest) (common.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	order := common.Order{
+		ID:        strconv.Itoa(s.nextID),
+		Owner:     owner,
+		Item:      request.Item,
+		Quantity:  request.Quantity,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	orders := maps.Clone(s.orders)
+	orders[order.ID] = order
+	if err := s.commit(orders); err != nil {
+		return common.Order{}, err
+	}
+	s.nextID++
+	return order, nil
+}
+
+func (s *orderStore) update(id string, request common.OrderRequest) (common.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[id]
+	if !ok {
+		return common.Order{}, errOrderNotFound
+	}
+	order.Item = request.Item
+	order.Quantity = request.Quantity
+	order.UpdatedAt = time.Now()
+	orders := maps.Clone(s.orders)
+	orders[id] = order
+	if err := s.commit(orders); err != nil {
+		return common.Order{}, err
+	}
+	return order, nil
+}
+
+func (s *orderStore) delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.orders[id]; !ok {
+		return errOrderNotFound
+	}
+	orders := maps.Clone(s.orders)
+	delete(orders, id)
+	return s.commit(orders)
+}
+
+// callerID returns the SPIFFE ID of the caller of an mTLS request.
+func callerID(r *http.Request) (spiffeid.ID, error) {
+	if r.TLS == nil {
+		return spiffeid.ID{}, errors.New("request was not made over mTLS")
+	}
+	return spiffetls.PeerIDFromConnectionState(*r.TLS)
+}
+
+// canAccess decides whether a caller may read, update or delete an order.
+//
+// SPIFFE CONCEPT: Object-Level Authorization
+// The mTLS handshake only tells us that the caller is one of the workloads that may talk to the backend.
+// It can't express "you may only touch the orders you created". That decision needs the SPIFFE ID of the
+// caller inside the application, where it is compared with the SPIFFE ID stored on the order itself.
+func (b *BackendService) canAccess(caller spiffeid.ID, order common.Order) bool {
+	return order.Owner == caller.String() || b.isOrderAdmin(caller)
+}
+
+func (b *BackendService) isOrderAdmin(caller spiffeid.ID) bool {
+	return slices.Contains(b.orderAdmins, caller)
+}
+
+// function that handles `GET /orders`. Callers only see their own orders, admins see all of them.
+func (b *BackendService) listOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	caller, err := callerID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	orders := []common.Order{}
+	for _, order := range b.orders.list() {
+		if b.canAccess(caller, order) {
+			orders = append(orders, order)
+		}
+	}
+	writeJSON(w, http.StatusOK, orders)
+}
+
+// function that handles `POST /orders`. The SPIFFE ID of the caller becomes the owner of the order.
+func (b *BackendService) createOrderHandler(w http.ResponseWriter, r *http.Request) {
+	caller, err := callerID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	request, err := decodeOrderRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	order, err := b.orders.create(caller.String(), request)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create order: %v", err), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Order created", "order", order.ID, logging.PeerIDKey, caller.String())
+	writeJSON(w, http.StatusCreated, order)
+}
+
+// function that handles `GET /orders/{id}`.
+func (b *BackendService) getOrderHandler(w http.ResponseWriter, r *http.Request) {
+	order, _, ok := b.authorizeOrder(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, order)
+}
+
+// function that handles `PUT /orders/{id}`.
+func (b *BackendService) updateOrderHandler(w http.ResponseWriter, r *http.Request) {
+	order, caller, ok := b.authorizeOrder(w, r)
+	if !ok {
+		return
+	}
+
+	request, err := decodeOrderRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	order, err = b.orders.update(order.ID, request)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to update order: %v", err), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Order updated", "order", order.ID, logging.PeerIDKey, caller.String())
+	writeJSON(w, http.StatusOK, order)
+}
+
+// function that handles `DELETE /orders/{id}`.
+func (b *BackendService) deleteOrderHandler(w http.ResponseWriter, r *http.Request) {
+	order, caller, ok := b.authorizeOrder(w, r)
+	if !ok {
+		return
+	}
+
+	if err := b.orders.delete(order.ID); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to delete order: %v", err), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Order deleted", "order", order.ID, logging.PeerIDKey, caller.String())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorizeOrder looks up the order of the request and checks the caller may access it.
+// It writes the error response itself and returns false when the request can't continue.
+func (b *BackendService) authorizeOrder(w http.ResponseWriter, r *http.Request) (common.Order, spiffeid.ID, bool) {
+	caller, err := callerID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return common.Order{}, spiffeid.ID{}, false
+	}
+
+	order, err := b.orders.get(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return common.Order{}, spiffeid.ID{}, false
+	}
+
+	if !b.canAccess(caller, order) {
+		slog.Warn("Denied access to an order", logging.MethodKey, r.Method, "path", r.URL.Path, logging.PeerIDKey, caller.String(), "owner", order.Owner)
+		tracing.Deny(r.Context(), fmt.Sprintf("order %s is owned by %s", order.ID, order.Owner))
+		http.Error(w, fmt.Sprintf("%s is not allowed to access order %s", caller, order.ID), http.StatusForbidden)
+		return common.Order{}, spiffeid.ID{}, false
+	}
+	return order, caller, true
+}
+
+func decodeOrderRequest(r *http.Request) (common.OrderRequest, error) {
+	var request common.OrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return common.OrderRequest{}, fmt.Errorf("invalid order: %w", err)
+	}
+	if request.Item == "" || request.Quantity <= 0 {
+		return common.OrderRequest{}, errors.New("an order needs an item and a positive quantity")
+	}
+	return request, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Error writing response", logging.Err(err))
+	}
+}
@@ -0,0 +1,176 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backend
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	customerID = "spiffe://example.org/customer"
+	otherID    = "spiffe://example.org/other"
+	adminID    = "spiffe://example.org/admin"
+)
+
+func newOrdersMux(t *testing.T, file string) *http.ServeMux {
+	orders, err := newOrderStore(file)
+	require.NoError(t, err)
+	svc := &BackendService{
+		orders:      orders,
+		orderAdmins: []spiffeid.ID{spiffeid.RequireFromString(adminID)},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /orders", svc.listOrdersHandler)
+	mux.HandleFunc("POST /orders", svc.createOrderHandler)
+	mux.HandleFunc("GET /orders/{id}", svc.getOrderHandler)
+	mux.HandleFunc("PUT /orders/{id}", svc.updateOrderHandler)
+	mux.HandleFunc("DELETE /orders/{id}", svc.deleteOrderHandler)
+	return mux
+}
+
+// doAs sends a request to the orders API as if it came in over mTLS from the given SPIFFE ID.
+func doAs(t *testing.T, mux *http.ServeMux, id, method, path, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	require.NoError(t, err)
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{URIs: []*url.URL{spiffeid.RequireFromString(id).URL()}}},
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestOrdersOwnerCanManageOrder(t *testing.T) {
+	mux := newOrdersMux(t, "")
+
+	rr := doAs(t, mux, customerID, "POST", "/orders", `{"item":"coffee","quantity":2}`)
+	require.Equal(t, http.StatusCreated, rr.Code)
+
+	var order common.Order
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &order))
+	assert.Equal(t, customerID, order.Owner)
+
+	rr = doAs(t, mux, customerID, "PUT", "/orders/"+order.ID, `{"item":"coffee","quantity":3}`)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &order))
+	assert.Equal(t, 3, order.Quantity)
+
+	rr = doAs(t, mux, customerID, "DELETE", "/orders/"+order.ID, "")
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+
+	rr = doAs(t, mux, customerID, "GET", "/orders/"+order.ID, "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestOrdersOtherIdentityIsDenied(t *testing.T) {
+	mux := newOrdersMux(t, "")
+
+	rr := doAs(t, mux, customerID, "POST", "/orders", `{"item":"coffee","quantity":2}`)
+	require.Equal(t, http.StatusCreated, rr.Code)
+
+	assert.Equal(t, http.StatusForbidden, doAs(t, mux, otherID, "GET", "/orders/1", "").Code)
+	assert.Equal(t, http.StatusForbidden, doAs(t, mux, otherID, "PUT", "/orders/1", `{"item":"tea","quantity":1}`).Code)
+	assert.Equal(t, http.StatusForbidden, doAs(t, mux, otherID, "DELETE", "/orders/1", "").Code)
+
+	var orders []common.Order
+	rr = doAs(t, mux, otherID, "GET", "/orders", "")
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &orders))
+	assert.Empty(t, orders, "other identities should not see orders they don't own")
+}
+
+func TestOrdersAdminCanAccessAllOrders(t *testing.T) {
+	mux := newOrdersMux(t, "")
+
+	doAs(t, mux, customerID, "POST", "/orders", `{"item":"coffee","quantity":2}`)
+	doAs(t, mux, otherID, "POST", "/orders", `{"item":"tea","quantity":1}`)
+
+	var orders []common.Order
+	rr := doAs(t, mux, adminID, "GET", "/orders", "")
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &orders))
+	assert.Len(t, orders, 2)
+
+	assert.Equal(t, http.StatusOK, doAs(t, mux, adminID, "GET", "/orders/1", "").Code)
+	assert.Equal(t, http.StatusNoContent, doAs(t, mux, adminID, "DELETE", "/orders/2", "").Code)
+}
+
+func TestOrdersRejectsInvalidOrder(t *testing.T) {
+	mux := newOrdersMux(t, "")
+
+	assert.Equal(t, http.StatusBadRequest, doAs(t, mux, customerID, "POST", "/orders", `{"item":"","quantity":2}`).Code)
+	assert.Equal(t, http.StatusBadRequest, doAs(t, mux, customerID, "POST", "/orders", `not json`).Code)
+}
+
+func TestOrdersArePersistedToFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "orders.json")
+
+	mux := newOrdersMux(t, file)
+	doAs(t, mux, customerID, "POST", "/orders", `{"item":"coffee","quantity":2}`)
+
+	// A new store reads the orders back and continues numbering after the highest ID.
+	mux = newOrdersMux(t, file)
+	assert.Equal(t, http.StatusOK, doAs(t, mux, customerID, "GET", "/orders/1", "").Code)
+
+	var order common.Order
+	rr := doAs(t, mux, customerID, "POST", "/orders", `{"item":"tea","quantity":1}`)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &order))
+	assert.Equal(t, "2", order.ID)
+}
+
+func TestOrdersAreUnchangedWhenSavingFails(t *testing.T) {
+	store, err := newOrderStore(filepath.Join(t.TempDir(), "orders.json"))
+	require.NoError(t, err)
+	order, err := store.create(customerID, common.OrderRequest{Item: "coffee", Quantity: 2})
+	require.NoError(t, err)
+
+	// The directory of the file is gone, so every save fails.
+	store.file = filepath.Join(t.TempDir(), "missing", "orders.json")
+
+	_, err = store.create(customerID, common.OrderRequest{Item: "tea", Quantity: 1})
+	assert.Error(t, err)
+	_, err = store.update(order.ID, common.OrderRequest{Item: "espresso", Quantity: 3})
+	assert.Error(t, err)
+	assert.Error(t, store.delete(order.ID))
+
+	assert.Equal(t, []common.Order{order}, store.list())
+	assert.Equal(t, 2, store.nextID)
+}
+
+func TestOrdersAdminOnlyReachesTheOrders(t *testing.T) {
+	svc := &BackendService{
+		clientID:    spiffeid.RequireFromString(customerID),
+		orderAdmins: []spiffeid.ID{spiffeid.RequireFromString(adminID)},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", svc.onlyClient(svc.rootHandler))
+
+	assert.Equal(t, http.StatusOK, doAs(t, mux, customerID, "GET", "/", "").Code)
+	assert.Equal(t, http.StatusForbidden, doAs(t, mux, adminID, "GET", "/", "").Code)
+}
@@ -0,0 +1,142 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backend
+
+import (
+	"crypto/x509"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls"
+)
+
+// How often the backend reminds the peer of the identity the session is bound to.
+var sessionTickInterval = 5 * time.Second
+
+var upgrader = websocket.Upgrader{}
+
+// A WebSocket session bound to the SPIFFE ID of the peer that opened it.
+type webSocketSession struct {
+	conn     *websocket.Conn
+	peerID   spiffeid.ID
+	peerCert *x509.Certificate
+}
+
+// function that handles calls to `/ws`. It upgrades the mTLS connection to a WebSocket session.
+//
+// SPIFFE CONCEPT: Long-Lived Connections
+// The identity of the peer is checked once, during the TLS handshake. A WebSocket upgrade keeps using that same
+// connection, so the session stays bound to the SPIFFE ID and the certificate presented at that moment. When SPIRE
+// rotates the SVID of the peer, the new certificate is only used for new connections. The backend therefore
+// enforces the lifetime of the certificate that was presented and closes the session when it expires.
+func (b *BackendService) webSocketHandler(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		http.Error(w, "WebSocket sessions require a SPIFFE mTLS connection", http.StatusForbidden)
+		return
+	}
+
+	peerID, err := spiffetls.PeerIDFromConnectionState(*r.TLS)
+	if err != nil {
+		http.Error(w, "Unable to determine the SPIFFE ID of the peer", http.StatusForbidden)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Warn("Unable to upgrade to a WebSocket session", logging.Err(err))
+		return
+	}
+	defer conn.Close()
+
+	session := &webSocketSession{
+		conn:     conn,
+		peerID:   peerID,
+		peerCert: r.TLS.PeerCertificates[0],
+	}
+
+	slog.Info("WebSocket session opened", logging.PeerIDKey, peerID.String())
+	session.run()
+	slog.Info("WebSocket session closed", logging.PeerIDKey, peerID.String())
+}
+
+// run echoes the messages of the peer and sends a tick at a regular interval until the session is closed
+// or the certificate of the peer expires. All writes happen here, a WebSocket connection supports one writer.
+func (s *webSocketSession) run() {
+	incoming := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(incoming)
+		for {
+			_, data, err := s.conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			select {
+			case incoming <- string(data):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if err := s.send(common.SessionWelcome, "Session bound to "+s.peerID.String()); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(sessionTickInterval)
+	defer ticker.Stop()
+	expiry := time.NewTimer(time.Until(s.peerCert.NotAfter))
+	defer expiry.Stop()
+
+	for {
+		select {
+		case text, ok := <-incoming:
+			if !ok {
+				return
+			}
+			if err := s.send(common.SessionEcho, text); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := s.send(common.SessionTick, ""); err != nil {
+				return
+			}
+		case <-expiry.C:
+			_ = s.send(common.SessionExpired, "The certificate presented during the handshake has expired, reconnect to present the rotated SVID")
+			message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "peer SVID expired")
+			_ = s.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+			return
+		}
+	}
+}
+
+func (s *webSocketSession) send(messageType, text string) error {
+	return s.conn.WriteJSON(common.SessionMessage{
+		Type:         messageType,
+		Time:         time.Now(),
+		PeerID:       s.peerID.String(),
+		PeerSerial:   s.peerCert.SerialNumber.String(),
+		PeerNotAfter: s.peerCert.NotAfter,
+		Text:         text,
+	})
+}
@@ -0,0 +1,89 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backend
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mattiasgees/spiffe-demo/internal/spiffetest"
+	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebSocketHandlerRequiresMTLS(t *testing.T) {
+	svc := BackendService{}
+
+	req, err := http.NewRequest("GET", common.WebSocketPath, nil)
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(svc.webSocketHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestWebSocketSessionBoundToPeerUntilExpiry(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	ca := spiffetest.NewCA(t, td)
+	bundle := x509bundle.FromX509Authorities(td, []*x509.Certificate{ca.Cert})
+
+	serverSVID := ca.Issue(t, "spiffe://example.org/backend")
+	clientSVID := ca.IssueUntil(t, "spiffe://example.org/customer", time.Now().Add(2*time.Second))
+
+	svc := BackendService{}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(svc.webSocketHandler))
+	// StartTLS would add its own certificate, so wrap the listener with the SPIFFE TLS config instead.
+	server.Listener = tls.NewListener(server.Listener, tlsconfig.MTLSServerConfig(serverSVID, bundle, tlsconfig.AuthorizeMemberOf(td)))
+	server.Start()
+	defer server.Close()
+
+	dialer := websocket.Dialer{
+		TLSClientConfig: tlsconfig.MTLSClientConfig(clientSVID, bundle, tlsconfig.AuthorizeMemberOf(td)),
+	}
+	conn, _, err := dialer.Dial(strings.Replace(server.URL, "http://", "wss://", 1), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var message common.SessionMessage
+	require.NoError(t, conn.ReadJSON(&message))
+	assert.Equal(t, common.SessionWelcome, message.Type)
+	assert.Equal(t, "spiffe://example.org/customer", message.PeerID)
+	assert.Equal(t, clientSVID.Certificates[0].SerialNumber.String(), message.PeerSerial)
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("hello")))
+	require.NoError(t, conn.ReadJSON(&message))
+	assert.Equal(t, common.SessionEcho, message.Type)
+	assert.Equal(t, "hello", message.Text)
+
+	// The session ends when the certificate presented during the handshake expires.
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for message.Type != common.SessionExpired {
+		require.NoError(t, conn.ReadJSON(&message))
+	}
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "expected policy violation close, got %v", err)
+}
@@ -0,0 +1,47 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package common
+
+// CallChainPath is the path every service exposes to take part in a multi-hop call chain.
+const CallChainPath = "/chain"
+
+// CallChainHopsHeader counts the hops a call chain request already went through. Every service that calls its
+// downstream services passes it on, one higher.
+const CallChainHopsHeader = "X-Call-Chain-Hops"
+
+// MaxCallChainHops is how deep a call chain may go. A service at this depth doesn't call its downstream services,
+// so a cycle in the downstream config ends instead of recursing until every hop times out.
+const MaxCallChainHops = 8
+
+// Hop is a single service in a call chain. Every service that receives a call chain
+// request adds itself as a hop and nests the hops of the services it called in turn.
+//
+// SPIFFE CONCEPT: Identity Propagation
+// Each hop authenticates with its own SVID. The SPIFFE ID of the original caller is never
+// forwarded, instead every service only knows who called it directly (CallerID). Looking at
+// the full chain shows that the identity changes at every hop.
+type Hop struct {
+	// Service is the name of the service that handled the call.
+	Service string `json:"service"`
+	// SPIFFEID is the identity this service presented to its caller.
+	SPIFFEID string `json:"spiffeId,omitempty"`
+	// CallerID is the identity this service authenticated for its caller.
+	CallerID string `json:"callerId,omitempty"`
+	// Error is set when this service could not reach the next hop.
+	Error string `json:"error,omitempty"`
+	// Downstream holds the hops of all services this service called.
+	Downstream []Hop `json:"downstream,omitempty"`
+}
@@ -0,0 +1,32 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package common
+
+import "time"
+
+// Path on which the backend exposes the most recent failed TLS handshakes.
+const HandshakeFailuresPath = "/handshake-failures"
+
+// HandshakeFailure is a TLS handshake that was rejected by the backend.
+type HandshakeFailure struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Reason     string    `json:"reason"`
+	// PresentedID is the SPIFFE ID in the certificate of the peer. It is not verified, the whole point
+	// is that the handshake failed, but it tells us who claimed to be calling.
+	PresentedID string `json:"presentedId,omitempty"`
+	Error       string `json:"error"`
+}
@@ -0,0 +1,49 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package common
+
+import (
+	"sync"
+
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+var (
+	localSourceMu sync.Mutex
+	localSource   x509svid.Source
+)
+
+// RegisterLocalSVID sets the source of the SVID of the service, so its SPIFFE ID is recorded on every request
+// log line and server span. The ID is read for every request, so it always reflects the current SVID.
+func RegisterLocalSVID(source x509svid.Source) {
+	localSourceMu.Lock()
+	defer localSourceMu.Unlock()
+	localSource = source
+}
+
+// LocalID returns the SPIFFE ID of the SVID of the service, or an empty string when it has none.
+func LocalID() string {
+	localSourceMu.Lock()
+	defer localSourceMu.Unlock()
+	if localSource == nil {
+		return ""
+	}
+	svid, err := localSource.GetX509SVID()
+	if err != nil {
+		return ""
+	}
+	return svid.ID.String()
+}
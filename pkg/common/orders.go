@@ -0,0 +1,37 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package common
+
+import "time"
+
+// Path under which the backend exposes the orders API.
+const OrdersPath = "/orders"
+
+// Order is a record of the orders API. Every order belongs to the SPIFFE ID that created it.
+type Order struct {
+	ID        string    `json:"id"`
+	Owner     string    `json:"owner"`
+	Item      string    `json:"item"`
+	Quantity  int       `json:"quantity"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// OrderRequest is the body to create or update an order.
+type OrderRequest struct {
+	Item     string `json:"item"`
+	Quantity int    `json:"quantity"`
+}
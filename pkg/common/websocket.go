@@ -0,0 +1,40 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package common
+
+import "time"
+
+// Path on which the backend accepts WebSocket sessions.
+const WebSocketPath = "/ws"
+
+// Types of messages the backend sends over a WebSocket session.
+const (
+	SessionWelcome = "welcome"
+	SessionEcho    = "echo"
+	SessionTick    = "tick"
+	SessionExpired = "expired"
+)
+
+// SessionMessage is a message the backend sends over a WebSocket session.
+type SessionMessage struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// PeerID, PeerSerial and PeerNotAfter describe the certificate the peer presented during the TLS handshake.
+	PeerID       string    `json:"peerId"`
+	PeerSerial   string    `json:"peerSerial"`
+	PeerNotAfter time.Time `json:"peerNotAfter"`
+	Text         string    `json:"text,omitempty"`
+}
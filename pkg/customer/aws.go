@@ -21,45 +21,139 @@ import (
 	"fmt"
 	"html/template"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/mattiasgees/spiffe-demo/pkg/metrics"
 )
 
+// How the customer authenticates to AWS with its SPIFFE identity.
+const (
+	// AWSAuthJWT exchanges a JWT-SVID with STS AssumeRoleWithWebIdentity.
+	AWSAuthJWT = "jwt"
+	// AWSAuthX509 creates an IAM Roles Anywhere session with the X509-SVID.
+	AWSAuthX509 = "x509"
+)
+
+// AWSAuths are the valid ways to authenticate to AWS.
+var AWSAuths = []string{AWSAuthJWT, AWSAuthX509}
+
+// An S3 bucket target.
+type s3Target struct {
+	name     string
+	bucket   string
+	filepath string
+	region   string
+	// endpoint replaces the endpoint of S3, e.g. with an S3-compatible stand-in.
+	endpoint string
+	// pathStyle puts the bucket in the path instead of the host name, which most stand-ins need.
+	pathStyle bool
+	timeout   time.Duration
+	// credentials exchanges an SVID for credentials of the role. Without a role the AWS SDK finds the
+	// credentials itself with its default chain.
+	credentials aws.CredentialsProvider
+
+	// The S3 client, created on first use and shared by all demos of the target.
+	mu sync.Mutex
+	s3 *s3.Client
+}
+
+// newS3Target creates the target. The X509-SVID is only used to authenticate with IAM Roles Anywhere.
+func newS3Target(target Target, svid svidFunc) *s3Target {
+	t := &s3Target{
+		name:     target.Name,
+		bucket:   target.Address,
+		filepath: target.option("filepath", "testfile"),
+		region:   target.option("region", "eu-west-2"),
+		endpoint: target.option("endpoint", ""),
+		timeout:  target.timeout(),
+	}
+	// The option is validated with the config.
+	t.pathStyle, _ = strconv.ParseBool(target.option("path-style", "false"))
+	roleARN := target.option("role-arn", "")
+	if roleARN == "" {
+		return t
+	}
+	switch target.option("auth", AWSAuthJWT) {
+	case AWSAuthX509:
+		t.credentials = newRolesAnywhereCredentials(t.region, target.option("trust-anchor-arn", ""), target.option("profile-arn", ""), roleARN, target.option("rolesanywhere-endpoint", ""), svid)
+	default:
+		t.credentials = newJWTSVIDCredentials(t.region, roleARN, target.option("audience", DefaultAWSAudience), target.option("sts-endpoint", ""), fetchJWTSVID)
+	}
+	return t
+}
+
+// awsConfig loads the AWS configuration with the region and the credentials of the target.
+func (t *s3Target) awsConfig(ctx context.Context) (aws.Config, error) {
+	opts := []func(*config.LoadOptions) error{config.WithRegion(t.region)}
+	if t.credentials != nil {
+		opts = append(opts, config.WithCredentialsProvider(t.credentials))
+	}
+	return config.LoadDefaultConfig(ctx, opts...)
+}
+
+// client returns the S3 client of the target. It is created with the AWS configuration of the target on first
+// use and reused after that, so every click doesn't load the AWS config again and the credentials stay cached
+// until they are about to expire. When creating it fails, the next call tries again.
+func (t *s3Target) client(ctx context.Context) (*s3.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.s3 != nil {
+		return t.s3, nil
+	}
+
+	cfg, err := t.awsConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	t.s3 = s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if t.endpoint != "" {
+			o.BaseEndpoint = aws.String(t.endpoint)
+		}
+		o.UsePathStyle = t.pathStyle
+	})
+	return t.s3, nil
+}
+
 // Retrieves a file from S3 and shows that file to the customer
-func (c *CustomerService) awsRetrievalHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Handling a request in the AWS Retrieval Handler from %s", r.RemoteAddr)
+func (t *s3Target) retrievalHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling a request in the AWS retrieval handler", "target", t.name, logging.RemoteKey, r.RemoteAddr)
 
-	ctx := context.Background()
+	ctx, cancel := demoContext(r, t.timeout)
+	defer cancel()
 
-	// Load AWS configuration with the specified region.
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(c.awsRegion))
+	// Create an S3 client with the AWS configuration of the target.
+	client, err := t.client(ctx)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to load AWS config: %v", err), http.StatusInternalServerError)
+		demoError(ctx, w, "Failed to load AWS config", err)
 		return
 	}
 
-	// Create a new S3 client.
-	client := s3.NewFromConfig(cfg)
-
 	// Retrieve a file from S3
+	start := time.Now()
 	resp, err := client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(c.s3Bucket),
-		Key:    aws.String(c.s3Filepath),
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(t.filepath),
 	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get object: %v", err), http.StatusInternalServerError)
+		metrics.ObserveOutbound(t.name, start, err)
+		demoError(ctx, w, "Failed to get object", err)
 		return
 	}
 	defer resp.Body.Close()
 
 	// Read the content of the retrieved file from S3
 	content, err := io.ReadAll(resp.Body)
+	metrics.ObserveOutbound(t.name, start, err)
 	if err != nil {
-		http.Error(w, "Failed to read object content", http.StatusInternalServerError)
+		demoError(ctx, w, "Failed to read object content", err)
 		return
 	}
 
@@ -82,34 +176,51 @@ func (c *CustomerService) awsRetrievalHandler(w http.ResponseWriter, r *http.Req
 }
 
 // Writes a file to S3 and shows the success to the customer
-func (c *CustomerService) awsPutHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Handling a request in the AWS Put Handler from %s", r.RemoteAddr)
+func (t *s3Target) putHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling a request in the AWS put handler", "target", t.name, logging.RemoteKey, r.RemoteAddr)
 
-	ctx := context.Background()
+	ctx, cancel := demoContext(r, t.timeout)
+	defer cancel()
 
-	// Load AWS configuration with the specified region.
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(c.awsRegion))
+	// Create an S3 client with the AWS configuration of the target.
+	client, err := t.client(ctx)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to load AWS config: %v", err), http.StatusInternalServerError)
+		demoError(ctx, w, "Failed to load AWS config", err)
 		return
 	}
-
-	// Create a new S3 client.
-	client := s3.NewFromConfig(cfg)
 	reader := bytes.NewReader([]byte("This is a test to write to an S3 bucket"))
 
 	// Write a file to S3
+	start := time.Now()
 	result, err := client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(c.s3Bucket),
-		Key:    aws.String(c.s3Filepath),
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(t.filepath),
 		Body:   reader,
 	})
+	metrics.ObserveOutbound(t.name+"_put", start, err)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Unable to upload %q to %q, %v", c.s3Filepath, c.s3Bucket, err), http.StatusInternalServerError)
+		demoError(ctx, w, fmt.Sprintf("Unable to upload %q to %q", t.filepath, t.bucket), err)
 		return
 	}
 
 	// Tell the customer we have uploaded a file to S3 and add some information to where on S3 we have uploaded it.
-	fmt.Fprintf(w, "Successfully uploaded %q to %q\n", c.s3Filepath, c.s3Bucket)
+	fmt.Fprintf(w, "Successfully uploaded %q to %q\n", t.filepath, t.bucket)
 	fmt.Fprintf(w, "The uploaded content is: %v", result)
 }
+
+// probe checks the file can be read from S3, without downloading it.
+func (t *s3Target) probe(ctx context.Context) error {
+	client, err := t.client(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	_, err = client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(t.filepath),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get object: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// DefaultAWSAudience is the audience of the JWT-SVID the customer exchanges with STS. The OIDC provider of the
+// AWS account has to list it as a client ID.
+const DefaultAWSAudience = "demo"
+
+// The session name shows up in CloudTrail for every call the customer makes with the role.
+const awsRoleSessionName = "spiffe-demo-customer"
+
+// How long before they expire the credentials are refreshed, so a call never starts with credentials that
+// expire halfway.
+const awsCredentialsExpiryWindow = 5 * time.Minute
+
+// How long fetching a JWT-SVID may take. The AWS SDK asks for the token without a context.
+const jwtSVIDFetchTimeout = 10 * time.Second
+
+// jwtSVIDToken hands out a fresh JWT-SVID for the audience every time STS needs a token.
+type jwtSVIDToken struct {
+	audience string
+	fetch    func(ctx context.Context, audience string) (string, error)
+}
+
+func (t jwtSVIDToken) GetIdentityToken() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), jwtSVIDFetchTimeout)
+	defer cancel()
+	token, err := t.fetch(ctx, t.audience)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch a JWT-SVID for audience %q: %w", t.audience, err)
+	}
+	return []byte(token), nil
+}
+
+// fetchJWTSVID fetches a JWT-SVID from the Workload API.
+func fetchJWTSVID(ctx context.Context, audience string) (string, error) {
+	svid, err := workloadapi.FetchJWTSVID(ctx, jwtsvid.Params{Audience: audience})
+	if err != nil {
+		return "", err
+	}
+	return svid.Marshal(), nil
+}
+
+// newJWTSVIDCredentials returns AWS credentials for the role, which the customer gets by exchanging a JWT-SVID
+// with STS. The credentials are cached and refreshed before they expire. The endpoint of STS is only set to
+// test against a stand-in.
+//
+// SPIFFE CONCEPT: JWT-SVIDs as Web Identity Tokens
+// SPIRE publishes the keys that sign JWT-SVIDs through its OIDC discovery provider, so AWS can trust it like any
+// other OIDC identity provider. AssumeRoleWithWebIdentity takes the JWT-SVID, checks its signature, audience
+// and subject against the trust policy of the role and returns short-lived credentials. No AWS keys are stored
+// anywhere, and no helper binary or config file is needed next to the customer.
+func newJWTSVIDCredentials(region, roleARN, audience, stsEndpoint string, fetch func(ctx context.Context, audience string) (string, error)) aws.CredentialsProvider {
+	client := sts.New(sts.Options{
+		Region: region,
+		// AssumeRoleWithWebIdentity isn't signed, the JWT-SVID is the credential.
+		Credentials: aws.AnonymousCredentials{},
+	}, func(o *sts.Options) {
+		if stsEndpoint != "" {
+			o.BaseEndpoint = aws.String(stsEndpoint)
+		}
+	})
+	provider := stscreds.NewWebIdentityRoleProvider(client, roleARN, jwtSVIDToken{audience: audience, fetch: fetch}, func(o *stscreds.WebIdentityRoleOptions) {
+		o.RoleSessionName = awsRoleSessionName
+	})
+	return aws.NewCredentialsCache(provider, func(o *aws.CredentialsCacheOptions) {
+		o.ExpiryWindow = awsCredentialsExpiryWindow
+	})
+}
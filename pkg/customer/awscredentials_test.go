@@ -0,0 +1,157 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRoleARN = "arn:aws:iam::123456789012:role/spiffe-demo"
+
+// fakeSTS is a stand-in for STS that hands out credentials for every web identity token.
+type fakeSTS struct {
+	// validity of the credentials it hands out.
+	validity time.Duration
+
+	mu    sync.Mutex
+	forms []url.Values
+}
+
+func (s *fakeSTS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.forms = append(s.forms, r.PostForm)
+	calls := len(s.forms)
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>ASIA%d</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>session</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+    <SubjectFromWebIdentityToken>spiffe://example.org/customer</SubjectFromWebIdentityToken>
+    <AssumedRoleUser>
+      <Arn>arn:aws:sts::123456789012:assumed-role/spiffe-demo/%s</Arn>
+      <AssumedRoleId>AROA:%s</AssumedRoleId>
+    </AssumedRoleUser>
+  </AssumeRoleWithWebIdentityResult>
+  <ResponseMetadata><RequestId>request-%d</RequestId></ResponseMetadata>
+</AssumeRoleWithWebIdentityResponse>`, calls, time.Now().Add(s.validity).UTC().Format(time.RFC3339), r.PostForm.Get("RoleSessionName"), r.PostForm.Get("RoleSessionName"), calls)
+}
+
+func (s *fakeSTS) form(i int, key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.forms[i].Get(key)
+}
+
+func (s *fakeSTS) calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.forms)
+}
+
+func fakeJWTSVID(ctx context.Context, audience string) (string, error) {
+	return "jwt-svid-for-" + audience, nil
+}
+
+func TestJWTSVIDCredentials(t *testing.T) {
+	sts := &fakeSTS{validity: time.Hour}
+	server := httptest.NewServer(sts)
+	t.Cleanup(server.Close)
+
+	provider := newJWTSVIDCredentials("eu-west-2", testRoleARN, "demo", server.URL, fakeJWTSVID)
+	credentials, err := provider.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ASIA1", credentials.AccessKeyID)
+	assert.True(t, credentials.CanExpire)
+
+	assert.Equal(t, "AssumeRoleWithWebIdentity", sts.form(0, "Action"))
+	assert.Equal(t, testRoleARN, sts.form(0, "RoleArn"))
+	assert.Equal(t, awsRoleSessionName, sts.form(0, "RoleSessionName"))
+	assert.Equal(t, "jwt-svid-for-demo", sts.form(0, "WebIdentityToken"))
+
+	// The credentials are cached until they are about to expire.
+	credentials, err = provider.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ASIA1", credentials.AccessKeyID)
+	assert.Equal(t, 1, sts.calls())
+}
+
+func TestJWTSVIDCredentialsRefreshBeforeExpiry(t *testing.T) {
+	// Credentials that expire within the expiry window are refreshed on every use.
+	sts := &fakeSTS{validity: awsCredentialsExpiryWindow / 2}
+	server := httptest.NewServer(sts)
+	t.Cleanup(server.Close)
+
+	provider := newJWTSVIDCredentials("eu-west-2", testRoleARN, "demo", server.URL, fakeJWTSVID)
+	for i := 1; i <= 2; i++ {
+		credentials, err := provider.Retrieve(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("ASIA%d", i), credentials.AccessKeyID)
+	}
+	assert.Equal(t, 2, sts.calls())
+}
+
+func TestJWTSVIDCredentialsWithoutSVID(t *testing.T) {
+	sts := &fakeSTS{validity: time.Hour}
+	server := httptest.NewServer(sts)
+	t.Cleanup(server.Close)
+
+	noSVID := func(ctx context.Context, audience string) (string, error) {
+		return "", errors.New("no identity issued")
+	}
+	_, err := newJWTSVIDCredentials("eu-west-2", testRoleARN, "demo", server.URL, noSVID).Retrieve(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `unable to fetch a JWT-SVID for audience "demo"`)
+	assert.Zero(t, sts.calls())
+}
+
+func TestS3TargetCredentials(t *testing.T) {
+	// Without a role the AWS SDK finds the credentials itself.
+	assert.Nil(t, newS3Target(Target{Name: "aws", Type: TargetS3, Address: "bucket"}, nil).credentials)
+	withRole := newS3Target(Target{Name: "aws", Type: TargetS3, Address: "bucket", Options: map[string]string{"role-arn": testRoleARN}}, nil)
+	assert.NotNil(t, withRole.credentials)
+
+	sts := &fakeSTS{validity: time.Hour}
+	server := httptest.NewServer(sts)
+	t.Cleanup(server.Close)
+
+	target := &s3Target{region: "eu-west-2", credentials: newJWTSVIDCredentials("eu-west-2", testRoleARN, "demo", server.URL, fakeJWTSVID)}
+	cfg, err := target.awsConfig(context.Background())
+	require.NoError(t, err)
+	credentials, err := cfg.Credentials.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ASIA1", credentials.AccessKeyID)
+}
@@ -0,0 +1,89 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/mattiasgees/spiffe-demo/pkg/metrics"
+)
+
+const callChainTemplate = `
+{{ define "hop" }}
+<li>
+	<strong>{{ .Service }}</strong>
+	<div>SPIFFE ID: {{ if .SPIFFEID }}{{ .SPIFFEID }}{{ else }}<em>unknown</em>{{ end }}</div>
+	<div>Authenticated caller: {{ if .CallerID }}{{ .CallerID }}{{ else }}<em>unknown</em>{{ end }}</div>
+	{{ if .Error }}<div style="color: red;">Error: {{ .Error }}</div>{{ end }}
+	{{ if .Downstream }}<ul>{{ range .Downstream }}{{ template "hop" . }}{{ end }}</ul>{{ end }}
+</li>
+{{ end }}
+<p>Call chain:</p>
+<ul>{{ template "hop" . }}</ul>
+`
+
+var callChainTmpl = template.Must(template.New("callchain").Parse(callChainTemplate))
+
+// Starts a multi-hop call chain at the SPIFFE native backend and shows every hop with the SPIFFE IDs that were seen.
+func (c *CustomerService) callChainHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling a request in the call chain handler", logging.RemoteKey, r.RemoteAddr)
+	w.Header().Set("Content-Type", "text/html")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*common.DefaultTimeout)
+	defer cancel()
+
+	source, err := c.pool.x509Source(ctx)
+	if err != nil {
+		demoError(ctx, w, "Unable to get an X509Source", err)
+		return
+	}
+
+	// The customer is the first hop of the chain.
+	hop := common.Hop{Service: "customer"}
+	if svid, err := source.GetX509SVID(); err == nil {
+		hop.SPIFFEID = svid.ID.String()
+	}
+
+	start := time.Now()
+	backendHop, err := fetchCallChain(ctx, c.pool, c.spiffeAuthz, c.backendService)
+	metrics.ObserveOutbound("chain", start, err)
+	if err != nil {
+		hop.Error = err.Error()
+	} else {
+		hop.Downstream = []common.Hop{backendHop}
+	}
+
+	if err := callChainTmpl.Execute(w, hop); err != nil {
+		http.Error(w, fmt.Sprintf("Error executing template: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// fetchCallChain calls the call chain endpoint of a SPIFFE enabled server and returns the hops it reported.
+func fetchCallChain(ctx context.Context, pool *clientPool, spiffeAuthZ, address string) (common.Hop, error) {
+	var hop common.Hop
+	if err := mTLSJSON(ctx, pool, backendBreaker, spiffeAuthZ, http.MethodGet, address, common.CallChainPath, nil, &hop); err != nil {
+		return common.Hop{}, err
+	}
+	return hop, nil
+}
@@ -0,0 +1,230 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/mattiasgees/spiffe-demo/pkg/tracing"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/logger"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// How long a pooled connection may stay idle before it is closed.
+const idleConnTimeout = 90 * time.Second
+
+// rotatingSource is what the pool needs from the Workload API. The X509Source implements it.
+type rotatingSource interface {
+	x509svid.Source
+	x509bundle.Source
+	Updated() <-chan struct{}
+}
+
+// clientPool shares a single X509Source and an HTTP client per server SPIFFE ID between all outbound calls of
+// the customer, so calls reuse connections instead of doing a full TLS handshake every time.
+//
+// SPIFFE CONCEPT: Long-Lived Sources and Rotation
+// A workload only needs one X509Source for its whole lifetime. It keeps a stream open to the Workload API and
+// always hands out the latest SVID, so every new TLS handshake uses the rotated SVID without rebuilding any
+// TLS configuration. Connections that are already open keep the certificate of their handshake, which is why
+// the pool closes the idle connections after every rotation.
+type clientPool struct {
+	// Closed once the source is available.
+	ready       chan struct{}
+	source      rotatingSource
+	workloadAPI *workloadAPILog
+	resilience  Resilience
+
+	mu       sync.Mutex
+	clients  map[spiffeid.ID]*http.Client
+	breakers map[string]*circuitBreaker
+}
+
+// newClientPool creates the pool and starts creating the source in the background, as the Workload API might
+// not be available yet. The source lives until the context is done.
+func newClientPool(ctx context.Context, resilience Resilience, newSource func(context.Context, logger.Logger) (rotatingSource, error)) *clientPool {
+	p := &clientPool{
+		ready:       make(chan struct{}),
+		workloadAPI: &workloadAPILog{},
+		resilience:  resilience,
+		clients:     map[spiffeid.ID]*http.Client{},
+		breakers:    map[string]*circuitBreaker{},
+	}
+	go func() {
+		// Creating the source only fails when the context is done, it keeps retrying the Workload API until then.
+		source, err := newSource(ctx, p.workloadAPI)
+		if err != nil {
+			slog.Error("Unable to create X509Source", logging.Err(err))
+			return
+		}
+		p.source = source
+		close(p.ready)
+		p.watch(ctx)
+	}()
+	return p
+}
+
+// newWorkloadAPIPool creates a pool with an X509Source of the Workload API.
+func newWorkloadAPIPool(ctx context.Context, resilience Resilience) *clientPool {
+	return newClientPool(ctx, resilience, func(ctx context.Context, log logger.Logger) (rotatingSource, error) {
+		return workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(workloadapi.WithLogger(log)))
+	})
+}
+
+// x509Source waits for the source until the context is done. The error then includes the last error of the
+// Workload API, if there was one, as it explains why there is no SVID.
+func (p *clientPool) x509Source(ctx context.Context) (rotatingSource, error) {
+	select {
+	case <-p.ready:
+		return p.source, nil
+	case <-ctx.Done():
+		if err := p.workloadAPI.err(); err != nil {
+			return nil, fmt.Errorf("%w: %w", errWorkloadAPI, err)
+		}
+		return nil, fmt.Errorf("%w: %v", errWorkloadAPI, ctx.Err())
+	}
+}
+
+// x509SVID waits for the source like x509Source and returns its current SVID.
+func (p *clientPool) x509SVID(ctx context.Context) (*x509svid.SVID, error) {
+	source, err := p.x509Source(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return source.GetX509SVID()
+}
+
+// workloadAPILog passes the log lines of the Workload API client on to slog. It remembers the last error, the
+// client keeps retrying after an error, so it is never returned.
+type workloadAPILog struct {
+	mu      sync.Mutex
+	lastErr error
+}
+
+func (l *workloadAPILog) Debugf(format string, args ...any) {
+	slog.Debug(fmt.Sprintf(format, args...))
+}
+
+func (l *workloadAPILog) Infof(format string, args ...any) {
+	slog.Info(fmt.Sprintf(format, args...))
+}
+
+func (l *workloadAPILog) Warnf(format string, args ...any) {
+	slog.Warn(fmt.Sprintf(format, args...))
+}
+
+func (l *workloadAPILog) Errorf(format string, args ...any) {
+	slog.Warn(fmt.Sprintf(format, args...))
+	for _, arg := range args {
+		if err, ok := arg.(error); ok {
+			l.mu.Lock()
+			l.lastErr = err
+			l.mu.Unlock()
+		}
+	}
+}
+
+func (l *workloadAPILog) err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastErr
+}
+
+// client returns the HTTP client for servers with the given SPIFFE ID, creating it on first use.
+func (p *clientPool) client(ctx context.Context, serverID spiffeid.ID) (*http.Client, error) {
+	source, err := p.x509Source(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if client, ok := p.clients[serverID]; ok {
+		return client, nil
+	}
+
+	client := &http.Client{
+		// Passes the trace context of the demo on to the server.
+		Transport: tracing.Transport(&http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsconfig.MTLSClientConfig(source, source, markUnauthorized(tlsconfig.AuthorizeID(serverID))),
+			// A custom TLS config disables HTTP/2 unless it is asked for.
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: 10,
+			IdleConnTimeout:     idleConnTimeout,
+		}),
+	}
+	p.clients[serverID] = client
+	return client, nil
+}
+
+// markUnauthorized marks the errors of an authorizer, so they can be told apart from other handshake failures.
+func markUnauthorized(next tlsconfig.Authorizer) tlsconfig.Authorizer {
+	return func(id spiffeid.ID, verifiedChains [][]*x509.Certificate) error {
+		if err := next(id, verifiedChains); err != nil {
+			return &unauthorizedPeerError{ID: id, err: err}
+		}
+		return nil
+	}
+}
+
+// unauthorizedPeerError is the error of an authorizer that didn't accept the peer. It is errPeerUnauthorized.
+type unauthorizedPeerError struct {
+	// ID is the SPIFFE ID the peer presented.
+	ID  spiffeid.ID
+	err error
+}
+
+func (e *unauthorizedPeerError) Error() string {
+	return fmt.Sprintf("%v: %v", errPeerUnauthorized, e.err)
+}
+
+func (e *unauthorizedPeerError) Unwrap() []error {
+	return []error{errPeerUnauthorized, e.err}
+}
+
+// watch closes the idle connections of all clients when the SVID or the bundle changes, so the next call
+// does a handshake with the new SVID. Calls that are in flight finish on their connection.
+func (p *clientPool) watch(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.source.Updated():
+			p.closeIdleConnections()
+		}
+	}
+}
+
+func (p *clientPool) closeIdleConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, client := range p.clients {
+		client.CloseIdleConnections()
+	}
+	slog.Info("SVID or bundle updated, closed the idle connections", "clients", len(p.clients))
+}
@@ -0,0 +1,121 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/internal/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/logger"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rotatingTestSource hands out an SVID that can be rotated, like the X509Source does.
+type rotatingTestSource struct {
+	*x509bundle.Bundle
+
+	mu      sync.Mutex
+	svid    *x509svid.SVID
+	updated chan struct{}
+}
+
+func (s *rotatingTestSource) GetX509SVID() (*x509svid.SVID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.svid, nil
+}
+
+func (s *rotatingTestSource) Updated() <-chan struct{} {
+	return s.updated
+}
+
+func (s *rotatingTestSource) rotate(svid *x509svid.SVID) {
+	s.mu.Lock()
+	s.svid = svid
+	s.mu.Unlock()
+	// The channel isn't buffered, so the second send only completes once the pool handled the first one.
+	s.updated <- struct{}{}
+	s.updated <- struct{}{}
+}
+
+// reusedConnection does a GET and reports whether it went over a connection that was already open.
+func reusedConnection(t *testing.T, client *http.Client, url string) bool {
+	var reused bool
+	trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused }}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, url, nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	return reused
+}
+
+func TestClientPoolReusesConnectionsUntilRotation(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	ca := spiffetest.NewCA(t, td)
+	bundle := x509bundle.FromX509Authorities(td, []*x509.Certificate{ca.Cert})
+	backend := startMTLSServer(t, ca, bundle, "spiffe://example.org/backend")
+
+	source := &rotatingTestSource{Bundle: bundle, svid: ca.Issue(t, "spiffe://example.org/customer"), updated: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool := newClientPool(ctx, Resilience{}, func(context.Context, logger.Logger) (rotatingSource, error) { return source, nil })
+
+	backendID := spiffeid.RequireFromString("spiffe://example.org/backend")
+	client, err := pool.client(ctx, backendID)
+	require.NoError(t, err)
+	again, err := pool.client(ctx, backendID)
+	require.NoError(t, err)
+	assert.Same(t, client, again, "the client is created once per server")
+
+	other, err := pool.client(ctx, spiffeid.RequireFromString("spiffe://example.org/other"))
+	require.NoError(t, err)
+	assert.NotSame(t, client, other)
+
+	assert.False(t, reusedConnection(t, client, backend.URL))
+	assert.True(t, reusedConnection(t, client, backend.URL), "the second call reuses the connection")
+
+	source.rotate(ca.Issue(t, "spiffe://example.org/customer"))
+	assert.False(t, reusedConnection(t, client, backend.URL), "a rotation closes the idle connections")
+	assert.True(t, reusedConnection(t, client, backend.URL))
+}
+
+func TestClientPoolWaitsForSource(t *testing.T) {
+	pool := newClientPool(context.Background(), Resilience{}, func(ctx context.Context, _ logger.Logger) (rotatingSource, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := pool.client(ctx, spiffeid.RequireFromString("spiffe://example.org/backend"))
+	assert.ErrorIs(t, err, errWorkloadAPI)
+	assert.Equal(t, errorClassWorkloadAPI, classifyError(err))
+}
@@ -0,0 +1,425 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+// The console shows at most this much of a response body.
+const maxConsoleBody = 1 << 20
+
+var consoleMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions}
+
+// consoleRequest is what the user filled in on the console page.
+type consoleRequest struct {
+	// Target is the name of an mTLS HTTP target, the request goes to its address.
+	Target string `json:"target"`
+	Method string `json:"method"`
+	// Path is relative to the address of the target and can have a query.
+	Path string `json:"path"`
+	// Headers has a header per line, like "Accept: application/json".
+	Headers string `json:"headers"`
+	Body    string `json:"body"`
+	// ExpectedID is the SPIFFE ID the server has to present. It can also be a trust domain like spiffe://example.org
+	// or a pattern like spiffe://example.org/ns/*/sa/backend. When empty the SPIFFE ID of the target is used.
+	ExpectedID string `json:"expectedId"`
+}
+
+// consoleResponse is the full outcome of the request, including the TLS details of the connection.
+type consoleResponse struct {
+	URL string `json:"url"`
+	// Authorized is the SPIFFE ID, trust domain or pattern the server had to match.
+	Authorized string              `json:"authorized"`
+	PeerID     string              `json:"peerId,omitempty"`
+	LatencyMS  float64             `json:"latencyMs"`
+	Status     string              `json:"status,omitempty"`
+	Proto      string              `json:"proto,omitempty"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	Body       string              `json:"body,omitempty"`
+	Truncated  bool                `json:"truncated,omitempty"`
+	TLS        *consoleTLS         `json:"tls,omitempty"`
+	ErrorClass string              `json:"errorClass,omitempty"`
+	Error      string              `json:"error,omitempty"`
+	Diagnosis  *diagnosis          `json:"diagnosis,omitempty"`
+}
+
+type consoleTLS struct {
+	Version            string               `json:"version"`
+	CipherSuite        string               `json:"cipherSuite"`
+	NegotiatedProtocol string               `json:"negotiatedProtocol,omitempty"`
+	DidResume          bool                 `json:"didResume"`
+	PeerCertificates   []consoleCertificate `json:"peerCertificates"`
+}
+
+type consoleCertificate struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	Serial    string    `json:"serial"`
+	URIs      []string  `json:"uris,omitempty"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+}
+
+var consoleTmpl = template.Must(template.New("console").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<title>SPIFFE request console</title>
+	<style>
+		body { font-family: Arial, sans-serif; max-width: 1000px; margin: auto; padding: 20px; }
+		label { display: block; margin-top: 10px; font-weight: bold; }
+		input, select, textarea { width: 100%; box-sizing: border-box; font-family: monospace; }
+		button { margin-top: 10px; padding: 8px 16px; }
+		pre { background-color: #fff; border: 1px solid #ddd; padding: 10px; white-space: pre-wrap; word-break: break-all; }
+	</style>
+</head>
+<body>
+	<h1>SPIFFE request console</h1>
+	<p>Sends a request over SPIFFE mTLS with the SVID of this customer and shows the full response, the SPIFFE ID the server presented and the details of the TLS connection.</p>
+	{{ if .Targets }}
+	<label for="target">Target</label>
+	<select id="target">
+		{{- range .Targets }}
+		<option value="{{ .Name }}" data-id="{{ .SPIFFEID }}">{{ .Name }} ({{ .Address }})</option>
+		{{- end }}
+	</select>
+	<label for="method">Method</label>
+	<select id="method">
+		{{- range .Methods }}
+		<option>{{ . }}</option>
+		{{- end }}
+	</select>
+	<label for="path">Path</label>
+	<input id="path" type="text" value="/">
+	<label for="expectedId">Expected SPIFFE ID, trust domain or pattern like spiffe://example.org/ns/*/sa/backend</label>
+	<input id="expectedId" type="text">
+	<label for="headers">Headers, one per line</label>
+	<textarea id="headers" rows="4" placeholder="Accept: application/json"></textarea>
+	<label for="body">Body</label>
+	<textarea id="body" rows="6"></textarea>
+	<button onclick="send()">Send</button>
+	<pre id="response"></pre>
+	{{ else }}
+	<p>There are no mTLS HTTP targets configured.</p>
+	{{ end }}
+	<script>
+		const target = document.getElementById('target');
+		function updateExpectedId() {
+			document.getElementById('expectedId').value = target.selectedOptions[0].dataset.id;
+		}
+		if (target) {
+			target.onchange = updateExpectedId;
+			updateExpectedId();
+		}
+		function send() {
+			const request = {
+				target: target.value,
+				method: document.getElementById('method').value,
+				path: document.getElementById('path').value,
+				headers: document.getElementById('headers').value,
+				body: document.getElementById('body').value,
+				expectedId: document.getElementById('expectedId').value,
+			};
+			const output = document.getElementById('response');
+			output.textContent = 'Sending...';
+			fetch('/console/send', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(request) })
+				.then(response => response.text())
+				.then(text => {
+					try {
+						output.textContent = JSON.stringify(JSON.parse(text), null, 2);
+					} catch (e) {
+						output.textContent = text;
+					}
+				})
+				.catch(error => { output.textContent = 'Error: ' + error; });
+		}
+	</script>
+</body>
+</html>
+`))
+
+// consoleTargets returns the targets the console can send requests to.
+func (c *CustomerService) consoleTargets() []Target {
+	var targets []Target
+	for _, target := range c.targets {
+		if target.Type == TargetMTLSHTTP {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// Serves the page of the request console.
+func (c *CustomerService) consolePageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	data := struct {
+		Targets []Target
+		Methods []string
+	}{Targets: c.consoleTargets(), Methods: consoleMethods}
+	if err := consoleTmpl.Execute(w, data); err != nil {
+		slog.Error("Error executing template", logging.Err(err))
+	}
+}
+
+// Sends the request of the console over SPIFFE mTLS and returns everything about the response as JSON.
+// Invalid input is a 400. When the call itself fails the response is still JSON, with a 502, or a 504 on a timeout.
+//
+// The call goes out with the SVID of the customer, so only the console page itself may send it. A request from
+// another site is a 403 and a body that isn't JSON, which a plain HTML form could send, is a 415.
+func (c *CustomerService) consoleSendHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling a request in the console handler", logging.RemoteKey, r.RemoteAddr)
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := crossOrigin.Check(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, "The request has to be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var request consoleRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxConsoleBody)).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	target, outbound, authorizer, err := c.prepareConsoleRequest(request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := demoContext(r, target.timeout())
+	defer cancel()
+	outbound = outbound.WithContext(ctx)
+
+	var response consoleResponse
+	source, err := c.pool.x509Source(ctx)
+	if err != nil {
+		response = consoleResponse{URL: outbound.URL.String()}
+		response.setError(err)
+	} else {
+		response = sendConsoleRequest(outbound, source, authorizer)
+	}
+	response.Authorized = request.ExpectedID
+	if response.Authorized == "" {
+		response.Authorized = target.SPIFFEID
+	}
+	if response.Diagnosis != nil {
+		response.Diagnosis.expect(response.Authorized)
+	}
+
+	status := http.StatusOK
+	switch {
+	case response.Error == "":
+	case errors.Is(ctx.Err(), context.DeadlineExceeded) || response.ErrorClass == errorClassTimeout:
+		status = http.StatusGatewayTimeout
+	default:
+		status = http.StatusBadGateway
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		slog.Error("Error writing response", logging.Err(err))
+	}
+}
+
+// prepareConsoleRequest validates the input of the console and builds the request and the authorizer for the server.
+// Requests can only go to the configured targets, so the console can't be used to reach arbitrary hosts.
+func (c *CustomerService) prepareConsoleRequest(request consoleRequest) (Target, *http.Request, tlsconfig.Authorizer, error) {
+	index := slices.IndexFunc(c.consoleTargets(), func(t Target) bool { return t.Name == request.Target })
+	if index < 0 {
+		return Target{}, nil, nil, fmt.Errorf("unknown mTLS HTTP target %q", request.Target)
+	}
+	target := c.consoleTargets()[index]
+
+	method := strings.ToUpper(request.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	if !slices.Contains(consoleMethods, method) {
+		return Target{}, nil, nil, fmt.Errorf("unsupported method %q", request.Method)
+	}
+
+	base, err := url.Parse(target.Address)
+	if err != nil {
+		return Target{}, nil, nil, fmt.Errorf("invalid address of target %q: %w", target.Name, err)
+	}
+	ref, err := url.Parse(request.Path)
+	if err != nil || ref.Scheme != "" || ref.Host != "" {
+		return Target{}, nil, nil, fmt.Errorf("invalid path %q, it has to be relative to the target", request.Path)
+	}
+
+	var body io.Reader
+	if request.Body != "" {
+		body = strings.NewReader(request.Body)
+	}
+	outbound, err := http.NewRequest(method, base.ResolveReference(ref).String(), body)
+	if err != nil {
+		return Target{}, nil, nil, fmt.Errorf("unable to create request: %w", err)
+	}
+	for _, line := range strings.Split(request.Headers, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return Target{}, nil, nil, fmt.Errorf("invalid header %q, use \"Name: value\"", line)
+		}
+		outbound.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	expected := request.ExpectedID
+	if expected == "" {
+		expected = target.SPIFFEID
+	}
+	authorizer, err := idMatcher(expected)
+	if err != nil {
+		return Target{}, nil, nil, err
+	}
+	return target, outbound, authorizer, nil
+}
+
+// idMatcher builds an authorizer from a SPIFFE ID, a trust domain or a pattern with * and ? wildcards.
+// A wildcard doesn't match a /, so spiffe://example.org/ns/*/sa/backend matches the backend of every namespace.
+func idMatcher(expected string) (tlsconfig.Authorizer, error) {
+	if strings.ContainsAny(expected, "*?[") {
+		if _, err := path.Match(expected, ""); err != nil {
+			return nil, fmt.Errorf("invalid SPIFFE ID pattern %q: %w", expected, err)
+		}
+		return func(id spiffeid.ID, _ [][]*x509.Certificate) error {
+			if matched, _ := path.Match(expected, id.String()); matched {
+				return nil
+			}
+			return fmt.Errorf("unexpected ID %q, it doesn't match %q", id, expected)
+		}, nil
+	}
+
+	id, err := spiffeid.FromString(expected)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expected SPIFFE ID %q: %w", expected, err)
+	}
+	if id.Path() == "" {
+		return tlsconfig.AuthorizeMemberOf(id.TrustDomain()), nil
+	}
+	return tlsconfig.AuthorizeID(id), nil
+}
+
+// sendConsoleRequest sends the request with the SVID of the source and collects the response.
+//
+// SPIFFE CONCEPT: curl with SPIFFE
+// A plain curl can't take part in SPIFFE mTLS: it would need the SVID written to disk and it checks host names
+// instead of SPIFFE IDs. The console does the same as the demos, but lets you choose the request and the identity
+// the server has to prove, which helps to find out why a call between two workloads fails.
+func sendConsoleRequest(outbound *http.Request, source probeSource, authorizer tlsconfig.Authorizer) consoleResponse {
+	response := consoleResponse{URL: outbound.URL.String()}
+	peer := &peerRecorder{}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   tlsconfig.MTLSClientConfig(source, source, peer.authorizer(authorizer)),
+			DisableKeepAlives: true,
+		},
+		// Show redirects instead of following them to a server that may have another identity.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	start := time.Now()
+	resp, err := client.Do(outbound)
+	response.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	response.PeerID = peer.get()
+	if err != nil {
+		response.setError(err)
+		return response
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxConsoleBody+1))
+	response.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		response.setError(fmt.Errorf("unable to read body: %w", err))
+	}
+	if len(body) > maxConsoleBody {
+		body = body[:maxConsoleBody]
+		response.Truncated = true
+	}
+
+	response.Status = resp.Status
+	response.Proto = resp.Proto
+	response.Headers = resp.Header
+	response.Body = string(body)
+	if resp.TLS != nil {
+		if id, err := spiffetls.PeerIDFromConnectionState(*resp.TLS); err == nil {
+			response.PeerID = id.String()
+		}
+		response.TLS = describeTLS(resp.TLS)
+	}
+	return response
+}
+
+func (r *consoleResponse) setError(err error) {
+	r.ErrorClass = classifyError(err)
+	r.Error = err.Error()
+	r.Diagnosis = diagnose(err)
+}
+
+func describeTLS(state *tls.ConnectionState) *consoleTLS {
+	details := &consoleTLS{
+		Version:            tls.VersionName(state.Version),
+		CipherSuite:        tls.CipherSuiteName(state.CipherSuite),
+		NegotiatedProtocol: state.NegotiatedProtocol,
+		DidResume:          state.DidResume,
+	}
+	for _, cert := range state.PeerCertificates {
+		details.PeerCertificates = append(details.PeerCertificates, consoleCertificate{
+			Subject:   cert.Subject.String(),
+			Issuer:    cert.Issuer.String(),
+			Serial:    cert.SerialNumber.String(),
+			URIs:      extractURIs(cert),
+			NotBefore: cert.NotBefore,
+			NotAfter:  cert.NotAfter,
+		})
+	}
+	return details
+}
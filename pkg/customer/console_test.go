@@ -0,0 +1,144 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattiasgees/spiffe-demo/internal/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIDMatcher(t *testing.T) {
+	tests := []struct {
+		expected string
+		id       string
+		allowed  bool
+	}{
+		{"spiffe://example.org/backend", "spiffe://example.org/backend", true},
+		{"spiffe://example.org/backend", "spiffe://example.org/rogue", false},
+		{"spiffe://example.org", "spiffe://example.org/anything/at/all", true},
+		{"spiffe://example.org", "spiffe://evil.org/backend", false},
+		{"spiffe://example.org/ns/*/sa/backend", "spiffe://example.org/ns/demo/sa/backend", true},
+		{"spiffe://example.org/ns/*/sa/backend", "spiffe://example.org/ns/a/b/sa/backend", false},
+		{"spiffe://example.org/backend-?", "spiffe://example.org/backend-1", true},
+	}
+	for _, test := range tests {
+		authorizer, err := idMatcher(test.expected)
+		require.NoError(t, err, test.expected)
+		err = authorizer(spiffeid.RequireFromString(test.id), nil)
+		assert.Equal(t, test.allowed, err == nil, "%s for %s", test.expected, test.id)
+	}
+
+	for _, invalid := range []string{"", "https://example.org/backend", "spiffe://example.org/[a"} {
+		_, err := idMatcher(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestPrepareConsoleRequest(t *testing.T) {
+	c := &CustomerService{targets: []Target{
+		{Name: "backend", Type: TargetMTLSHTTP, Address: "https://backend:8443/api/", SPIFFEID: "spiffe://example.org/backend"},
+		{Name: "bucket", Type: TargetS3, Address: "bucket"},
+	}}
+
+	_, outbound, _, err := c.prepareConsoleRequest(consoleRequest{
+		Target:  "backend",
+		Method:  "post",
+		Path:    "orders?owner=me",
+		Headers: "Accept: application/json\n\nX-Debug:  1 ",
+		Body:    `{"item": "book"}`,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, http.MethodPost, outbound.Method)
+	assert.Equal(t, "https://backend:8443/api/orders?owner=me", outbound.URL.String())
+	assert.Equal(t, "application/json", outbound.Header.Get("Accept"))
+	assert.Equal(t, "1", outbound.Header.Get("X-Debug"))
+
+	invalid := map[string]consoleRequest{
+		"unknown target":        {Target: "other", Path: "/"},
+		"not an mTLS target":    {Target: "bucket", Path: "/"},
+		"absolute URL":          {Target: "backend", Path: "https://evil.org/"},
+		"unsupported method":    {Target: "backend", Method: "CONNECT", Path: "/"},
+		"invalid header":        {Target: "backend", Path: "/", Headers: "no colon"},
+		"invalid expected ID":   {Target: "backend", Path: "/", ExpectedID: "backend"},
+		"protocol relative URL": {Target: "backend", Path: "//evil.org/"},
+	}
+	for name, request := range invalid {
+		_, _, _, err := c.prepareConsoleRequest(request)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestConsoleSendHandlerOnlyAcceptsTheConsolePage(t *testing.T) {
+	c := &CustomerService{}
+	send := func(contentType string, headers map[string]string) int {
+		r := httptest.NewRequest(http.MethodPost, "http://customer/console/send", strings.NewReader(`{"target":"other","path":"/"}`))
+		r.Header.Set("Content-Type", contentType)
+		for key, value := range headers {
+			r.Header.Set(key, value)
+		}
+		rr := httptest.NewRecorder()
+		c.consoleSendHandler(rr, r)
+		return rr.Code
+	}
+
+	// A form of another site can send the request without a preflight.
+	assert.Equal(t, http.StatusForbidden, send("text/plain", map[string]string{"Sec-Fetch-Site": "cross-site"}))
+	assert.Equal(t, http.StatusForbidden, send("application/json", map[string]string{"Origin": "https://evil.org"}))
+	assert.Equal(t, http.StatusUnsupportedMediaType, send("text/plain", map[string]string{"Sec-Fetch-Site": "same-origin"}))
+
+	// The console page gets to the validation of the request.
+	assert.Equal(t, http.StatusBadRequest, send("application/json", map[string]string{"Sec-Fetch-Site": "same-origin"}))
+	assert.Equal(t, http.StatusBadRequest, send("application/json; charset=utf-8", map[string]string{"Origin": "http://customer"}))
+}
+
+func TestSendConsoleRequest(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	ca := spiffetest.NewCA(t, td)
+	bundle := x509bundle.FromX509Authorities(td, []*x509.Certificate{ca.Cert})
+	backend := startMTLSServer(t, ca, bundle, "spiffe://example.org/ns/demo/sa/backend")
+	customer := testSource{SVID: ca.Issue(t, "spiffe://example.org/customer"), Bundle: bundle}
+
+	outbound, err := http.NewRequest(http.MethodGet, backend.URL+"/", nil)
+	require.NoError(t, err)
+	authorizer, err := idMatcher("spiffe://example.org/ns/*/sa/backend")
+	require.NoError(t, err)
+
+	response := sendConsoleRequest(outbound, customer, authorizer)
+	require.Empty(t, response.Error)
+	assert.Equal(t, "200 OK", response.Status)
+	assert.Equal(t, "hello", response.Body)
+	assert.Equal(t, "spiffe://example.org/ns/demo/sa/backend", response.PeerID)
+	require.NotNil(t, response.TLS)
+	assert.Equal(t, "TLS 1.3", response.TLS.Version)
+	require.NotEmpty(t, response.TLS.PeerCertificates)
+	assert.Equal(t, []string{"spiffe://example.org/ns/demo/sa/backend"}, response.TLS.PeerCertificates[0].URIs)
+
+	authorizer, err = idMatcher("spiffe://example.org/ns/*/sa/other")
+	require.NoError(t, err)
+	response = sendConsoleRequest(outbound.Clone(outbound.Context()), customer, authorizer)
+	assert.Equal(t, errorClassNotAuthorized, response.ErrorClass)
+	assert.Equal(t, "spiffe://example.org/ns/demo/sa/backend", response.PeerID)
+	assert.Contains(t, response.Error, "doesn't match")
+}
@@ -16,58 +16,97 @@ limitations under the License.
 package customer
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"net/http"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/mattiasgees/spiffe-demo/pkg/instrument"
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/mattiasgees/spiffe-demo/pkg/metrics"
 )
 
+// Name of the service used in the metrics.
+const serviceName = "customer"
+
+// crossOrigin rejects requests that come from another site, based on the Sec-Fetch-Site or Origin header browsers
+// send. The routes that change something with the SVID of the customer check it, so no other page the user visits
+// can make the customer do so.
+var crossOrigin = http.NewCrossOriginProtection()
+
 type CustomerService struct {
-	spiffeAuthz            string
-	serverAddress          string
-	backendService         string
-	s3Bucket               string
-	s3Filepath             string
-	awsRegion              string
-	spiffeAuthzHTTPBackend string
-	HTTPBackendService     string
-	postgreSQLHost         string
-	postgreSQLUser         string
+	spiffeAuthz    string
+	serverAddress  string
+	metricsAddress string
+	backendService string
+	targets        []Target
+	resilience     Resilience
+	// The X509Source and the HTTP clients all outbound calls share.
+	pool *clientPool
+	// The clients of the targets, shared by their demos, the matrix and the page.
+	clients *targetClients
 }
 
 // Main function that creates the customer server and starts it. This is called from the CLI.
-func StartServer(spiffeAuthz, serverAddress, backendService, s3Bucket, s3Filepath, awsRegion, spiffeAuthzHTTPBackend, HTTPBackendService, postgreSQLHost, postgreSQLUser string) {
+// The SPIFFE ID and address of the backend are used for the demos that need the backend specifically,
+// like the call chain and the orders API. Everything else the customer connects to is a target of the config.
+// The resilience settings apply to the calls to the mTLS targets and the backend.
+func StartServer(spiffeAuthz, serverAddress, metricsAddress, backendService string, config *Config, resilience Resilience) {
+	if err := resilience.Validate(); err != nil {
+		logging.Fatal("Invalid resilience settings", err)
+	}
+
 	customerService := CustomerService{
-		spiffeAuthz:            spiffeAuthz,
-		serverAddress:          serverAddress,
-		backendService:         backendService,
-		s3Bucket:               s3Bucket,
-		s3Filepath:             s3Filepath,
-		awsRegion:              awsRegion,
-		spiffeAuthzHTTPBackend: spiffeAuthzHTTPBackend,
-		HTTPBackendService:     HTTPBackendService,
-		postgreSQLHost:         postgreSQLHost,
-		postgreSQLUser:         postgreSQLUser,
+		spiffeAuthz:    spiffeAuthz,
+		serverAddress:  serverAddress,
+		metricsAddress: metricsAddress,
+		backendService: backendService,
+		targets:        config.Targets,
+		resilience:     resilience,
 	}
+	customerService.pool = newWorkloadAPIPool(context.Background(), resilience)
+	customerService.clients = newTargetClients(config.Targets, customerService.pool, customerService.pool.x509SVID)
 
 	if err := customerService.run(); err != nil {
-		log.Fatal(err)
+		logging.Fatal("Customer server stopped", err)
 	}
 }
 
 // This gets called from the main function and actually starts that customer HTTP server.
 func (c *CustomerService) run() error {
 	// Set up all of the resource handlers.
-	http.HandleFunc("/", c.webpageHandler)
-	http.HandleFunc("/mtls", c.mtlsHandler)
-	http.HandleFunc("/spifferetriever", c.spiffeRetriever)
-	http.HandleFunc("/aws", c.awsRetrievalHandler)
-	http.HandleFunc("/aws/put", c.awsPutHandler)
-	http.HandleFunc("/gcp/put", GCPPutHandler)
-	http.HandleFunc("/gcp", GCPReadHandler)
-	http.HandleFunc("/httpbackend", c.httpBackendHandler)
-	http.HandleFunc("/postgresql", c.postgreSQLRetrievalHandler)
-	http.HandleFunc("/postgresql/put", c.postgreSQLPutHandler)
-
-	log.Printf("Starting server at %s", c.serverAddress)
+	handle("/", c.webpageHandler)
+	handle("/spifferetriever", c.spiffeRetriever)
+	handle("/chain", c.callChainHandler)
+	handle("/handshakefailures", c.handshakeFailuresHandler)
+	handle("/ws", c.webSocketPageHandler)
+	handle("/ws/stream", c.webSocketStreamHandler)
+	handle("/orders", c.listOrdersHandler)
+	handle("/orders/create", c.createOrderHandler)
+	handle("/orders/update", c.updateOrderHandler)
+	handle("/orders/delete", c.deleteOrderHandler)
+	handle("/matrix", c.matrixPageHandler)
+	handle("/matrix/api", c.matrixAPIHandler)
+	handle("/console", c.consolePageHandler)
+	handle("/console/send", c.consoleSendHandler)
+	handle("/breakers", c.breakersHandler)
+
+	// Every target of the config gets a route for each of its demos.
+	for _, target := range c.targets {
+		for _, demo := range target.demos(c.pool, c.clients) {
+			handle(demo.Path, demo.handler)
+		}
+		slog.Info("Registered target", "type", target.Type, "target", target.Name)
+	}
+
+	if c.metricsAddress != "" {
+		metrics.Serve(c.metricsAddress)
+	} else {
+		http.Handle(metrics.Path, metrics.Handler())
+	}
+	go c.registerSVIDExpiry()
+
+	slog.Info("Starting server", "address", c.serverAddress)
 
 	// Serve the HTTP server.
 	if err := http.ListenAndServe(c.serverAddress, nil); err != nil {
@@ -76,3 +115,20 @@ func (c *CustomerService) run() error {
 
 	return nil
 }
+
+// handle registers a handler for a route. The requests are counted, logged and traced by route.
+func handle(route string, handler http.HandlerFunc) {
+	http.HandleFunc(route, instrument.Handler(serviceName, route, handler))
+}
+
+// registerSVIDExpiry exposes the expiry of the SVID of the customer as a metric and records its SPIFFE ID on
+// the spans, once the source of the pool is available.
+func (c *CustomerService) registerSVIDExpiry() {
+	source, err := c.pool.x509Source(context.Background())
+	if err != nil {
+		slog.Error("Unable to get the X509Source for the SVID expiry metric", logging.Err(err))
+		return
+	}
+	metrics.RegisterSVIDExpiry(serviceName, source)
+	common.RegisterLocalSVID(source)
+}
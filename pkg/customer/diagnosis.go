@@ -0,0 +1,206 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Categories of a failed call, as they are explained to the people watching the demo.
+const (
+	diagnosisWorkloadAPIUnreachable = "workload-api-unreachable"
+	diagnosisNoSVID                 = "no-svid"
+	diagnosisServerIDMismatch       = "server-id-mismatch"
+	diagnosisUnknownTrustDomain     = "unknown-trust-domain"
+	diagnosisExpiredCertificate     = "expired-certificate"
+	diagnosisRejectedByPeer         = "rejected-by-peer"
+	diagnosisTimeout                = "timeout"
+	diagnosisConnectionRefused      = "connection-refused"
+	diagnosisDNS                    = "dns"
+	diagnosisBreakerOpen            = "breaker-open"
+	diagnosisTLS                    = "tls"
+	diagnosisOther                  = "other"
+)
+
+// diagnosis explains a failed call in plain words and what to do about it.
+type diagnosis struct {
+	Category    string `json:"category"`
+	Title       string `json:"title"`
+	Explanation string `json:"explanation"`
+	Hint        string `json:"hint"`
+	// Expected and Actual are the SPIFFE IDs of a server that isn't who the customer expected.
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+var diagnoses = map[string]diagnosis{
+	diagnosisWorkloadAPIUnreachable: {
+		Title:       "The Workload API is unreachable",
+		Explanation: "The customer gets its SVID from the SPIFFE Workload API, the socket of the SPIRE Agent on the node. It couldn't reach it, so it has no identity to present.",
+		Hint:        "Check that the SPIRE Agent runs on the node, that its socket is mounted in the pod and that SPIFFE_ENDPOINT_SOCKET points to it.",
+	},
+	diagnosisNoSVID: {
+		Title:       "No SVID was issued to the customer",
+		Explanation: "The Workload API is reachable, but the SPIRE Agent has no registration entry that matches this workload, so it doesn't issue an SVID.",
+		Hint:        "Create a registration entry for the customer with selectors that match its pod, e.g. its namespace and service account, and list the entries with spire-server entry show.",
+	},
+	diagnosisServerIDMismatch: {
+		Title:       "The server has an unexpected SPIFFE ID",
+		Explanation: "The server presented a valid SVID, but not with the SPIFFE ID the customer expects. The customer only talks to the exact identity it expects, so it stopped the call before sending anything.",
+		Hint:        "Compare the expected and the actual SPIFFE ID. Either the address points to the wrong service or the SPIFFE ID configured for the target is wrong.",
+	},
+	diagnosisUnknownTrustDomain: {
+		Title:       "The server is in an unknown trust domain",
+		Explanation: "The server presented an SVID of a trust domain the customer has no trust bundle for, so its certificate can't be verified.",
+		Hint:        "Federate the trust domains, so the Workload API also hands out the bundle of the other trust domain, or point the customer to a server in its own trust domain.",
+	},
+	diagnosisExpiredCertificate: {
+		Title:       "A certificate has expired",
+		Explanation: "One of both sides presented a certificate that is no longer valid. SVIDs are short-lived and rotated automatically, so an expired SVID usually means the rotation stopped.",
+		Hint:        "Check that the SPIRE Agent runs and can reach the SPIRE Server, and that the clocks of the nodes are in sync.",
+	},
+	diagnosisRejectedByPeer: {
+		Title:       "The server rejected the SVID of the customer",
+		Explanation: "The customer presented its SVID, but the server didn't accept its SPIFFE ID and ended the handshake. This is what the rogue customer runs into: a valid identity isn't enough, it has to be an identity the server authorizes.",
+		Hint:        "Check the SPIFFE IDs the server authorizes, e.g. the --authorized-spiffe flag of the backend or the RBAC rules of Envoy, against the SPIFFE ID of the customer.",
+	},
+	diagnosisTimeout: {
+		Title:       "The call timed out",
+		Explanation: "The server didn't respond before the deadline of the demo.",
+		Hint:        "Check that the server is healthy and reachable, or raise the timeout option of the target.",
+	},
+	diagnosisConnectionRefused: {
+		Title:       "The connection was refused",
+		Explanation: "Nothing accepted the connection at the address of the server. SPIFFE didn't get involved yet.",
+		Hint:        "Check that the server runs, that the address and port are right and that the Kubernetes service has endpoints.",
+	},
+	diagnosisDNS: {
+		Title:       "The name of the server doesn't resolve",
+		Explanation: "The host name in the address couldn't be resolved, so the customer couldn't connect. SPIFFE didn't get involved yet.",
+		Hint:        "Check the host name in the address, e.g. the name and namespace of the Kubernetes service.",
+	},
+	diagnosisBreakerOpen: {
+		Title:       "The circuit breaker is open",
+		Explanation: "The recent calls to this target failed, so the customer stopped calling it for a while instead of waiting for more failures.",
+		Hint:        "Fix the cause of the earlier failures. The breaker lets a trial call through after the cooldown.",
+	},
+	diagnosisTLS: {
+		Title:       "The TLS handshake failed",
+		Explanation: "The mTLS handshake with the server failed before any SPIFFE ID could be checked.",
+		Hint:        "Check that the server speaks SPIFFE mTLS on this address, e.g. that the address uses https and the port of the mTLS listener.",
+	},
+	diagnosisOther: {
+		Title:       "The call failed",
+		Explanation: "The call failed for a reason that isn't specific to SPIFFE.",
+		Hint:        "Check the error and the logs of the customer and the server.",
+	},
+}
+
+// diagnose explains the error of a call. It builds on classifyError, but tells apart the failures that look
+// the same in a raw Go error and need a different fix.
+func diagnose(err error) *diagnosis {
+	var unauthorized *unauthorizedPeerError
+	var certificateInvalid x509.CertificateInvalidError
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+
+	category := diagnosisOther
+	switch {
+	case errors.Is(err, errBreakerOpen):
+		category = diagnosisBreakerOpen
+	// The Workload API returns PermissionDenied while there is no registration entry for the workload.
+	case errors.Is(err, errWorkloadAPI) && status.Code(err) == codes.PermissionDenied:
+		category = diagnosisNoSVID
+	case errors.Is(err, errWorkloadAPI):
+		category = diagnosisWorkloadAPIUnreachable
+	case errors.As(err, &unauthorized):
+		category = diagnosisServerIDMismatch
+	case strings.Contains(err.Error(), "could not get X509 bundle"):
+		category = diagnosisUnknownTrustDomain
+	case errors.As(err, &certificateInvalid) && certificateInvalid.Reason == x509.Expired,
+		errors.As(err, &opErr) && opErr.Op == "remote error" && strings.Contains(opErr.Err.Error(), "expired certificate"):
+		category = diagnosisExpiredCertificate
+	case errors.Is(err, context.DeadlineExceeded):
+		category = diagnosisTimeout
+	case errors.As(err, &dnsErr):
+		category = diagnosisDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		category = diagnosisConnectionRefused
+	case classifyError(err) == errorClassRejected:
+		category = diagnosisRejectedByPeer
+	case classifyError(err) == errorClassTLS:
+		category = diagnosisTLS
+	}
+
+	d := diagnoses[category]
+	d.Category = category
+	if unauthorized != nil {
+		d.Actual = unauthorized.ID.String()
+	}
+	return &d
+}
+
+// expect sets the SPIFFE ID the customer expected, when the server presented another one.
+func (d *diagnosis) expect(expected string) *diagnosis {
+	if d.Actual != "" {
+		d.Expected = expected
+	}
+	return d
+}
+
+var diagnosisTmpl = template.Must(template.New("diagnosis").Parse(`
+<div class="diagnosis">
+	<p><strong>{{ .Diagnosis.Title }}</strong></p>
+	<p>{{ .Diagnosis.Explanation }}</p>
+	{{- if .Diagnosis.Actual }}
+	<p>Expected SPIFFE ID: <code>{{ .Diagnosis.Expected }}</code><br>Actual SPIFFE ID: <code>{{ .Diagnosis.Actual }}</code></p>
+	{{- end }}
+	<p><em>Hint:</em> {{ .Diagnosis.Hint }}</p>
+	<details><summary>Error</summary><code>{{ .Message }}: {{ .Error }}</code></details>
+</div>`))
+
+// diagnosedError reports the failure of a demo like demoError, but with a diagnosis in plain words instead of
+// the raw error, which is still there for who wants to see it.
+func diagnosedError(ctx context.Context, w http.ResponseWriter, message string, err error, expected string) {
+	status := errorStatus(ctx, err)
+	if status == 0 {
+		slog.Info(message+", the request was canceled", logging.Err(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	data := struct {
+		Diagnosis *diagnosis
+		Message   string
+		Error     string
+	}{diagnose(err).expect(expected), message, err.Error()}
+	if err := diagnosisTmpl.Execute(w, data); err != nil {
+		slog.Error("Error executing template", logging.Err(err))
+	}
+}
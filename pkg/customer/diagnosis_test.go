@@ -0,0 +1,101 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/logger"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDiagnose(t *testing.T) {
+	tests := map[string]error{
+		diagnosisWorkloadAPIUnreachable: fmt.Errorf("%w: %w", errWorkloadAPI, status.Error(codes.Unavailable, "connection error")),
+		diagnosisNoSVID:                 fmt.Errorf("%w: %w", errWorkloadAPI, status.Error(codes.PermissionDenied, "no identity issued")),
+		diagnosisServerIDMismatch:       &unauthorizedPeerError{ID: spiffeid.RequireFromString("spiffe://example.org/backend"), err: errors.New("unexpected ID")},
+		diagnosisUnknownTrustDomain:     errors.New(`x509svid: could not get X509 bundle: x509bundle: no X.509 bundle found for trust domain: "other.org"`),
+		diagnosisExpiredCertificate:     &url.Error{Op: "Get", URL: "https://backend", Err: fmt.Errorf("x509svid: could not verify leaf certificate: %w", x509.CertificateInvalidError{Reason: x509.Expired})},
+		diagnosisRejectedByPeer:         &net.OpError{Op: "remote error", Err: errors.New("tls: bad certificate")},
+		diagnosisTimeout:                fmt.Errorf("dial: %w", context.DeadlineExceeded),
+		diagnosisConnectionRefused:      &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+		diagnosisDNS:                    &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "backend"}},
+		diagnosisBreakerOpen:            fmt.Errorf("backend: %w", errBreakerOpen),
+		diagnosisOther:                  errors.New("something else"),
+	}
+	for category, err := range tests {
+		d := diagnose(err)
+		assert.Equal(t, category, d.Category, err.Error())
+		assert.NotEmpty(t, d.Title, category)
+		assert.NotEmpty(t, d.Hint, category)
+	}
+
+	// The server told the customer its SVID expired.
+	expired := &net.OpError{Op: "remote error", Err: errors.New("tls: expired certificate")}
+	assert.Equal(t, diagnosisExpiredCertificate, diagnose(expired).Category)
+
+	// Only a mismatch shows the expected SPIFFE ID.
+	assert.Empty(t, diagnose(tests[diagnosisDNS]).expect("spiffe://example.org/backend").Expected)
+}
+
+func TestClientPoolReportsWorkloadAPIError(t *testing.T) {
+	pool := newClientPool(context.Background(), Resilience{}, func(ctx context.Context, log logger.Logger) (rotatingSource, error) {
+		// SPIRE denies the call while there is no registration entry for the workload.
+		log.Errorf("Failed to watch the Workload API: %v", status.Error(codes.PermissionDenied, "no identity issued"))
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	require.Eventually(t, func() bool { return pool.workloadAPI.err() != nil }, time.Second, time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := pool.client(ctx, spiffeid.RequireFromString("spiffe://example.org/backend"))
+	assert.Equal(t, errorClassWorkloadAPI, classifyError(err))
+	assert.Equal(t, diagnosisNoSVID, diagnose(err).Category)
+}
+
+func TestDiagnosedError(t *testing.T) {
+	rr := httptest.NewRecorder()
+	err := &unauthorizedPeerError{ID: spiffeid.RequireFromString("spiffe://example.org/backend"), err: errors.New(`unexpected ID "<script>"`)}
+	diagnosedError(context.Background(), rr, "Error connecting", err, "spiffe://example.org/other")
+
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	body := rr.Body.String()
+	assert.Contains(t, body, "The server has an unexpected SPIFFE ID")
+	assert.Contains(t, body, "<code>spiffe://example.org/other</code>")
+	assert.Contains(t, body, "<code>spiffe://example.org/backend</code>")
+	assert.NotContains(t, body, "<script>", "the raw error is escaped")
+
+	rr = httptest.NewRecorder()
+	diagnosedError(context.Background(), rr, "Error connecting", fmt.Errorf("backend: %w", errBreakerOpen), "spiffe://example.org/backend")
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "Expected SPIFFE ID")
+}
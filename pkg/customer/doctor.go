@@ -0,0 +1,524 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Statuses of a check of the doctor.
+const (
+	CheckOK   = "ok"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+	CheckSkip = "skip"
+)
+
+// Formats the doctor can print its report in.
+const (
+	DoctorFormatTable = "table"
+	DoctorFormatJSON  = "json"
+)
+
+// DoctorFormats are the valid formats of the report.
+var DoctorFormats = []string{DoctorFormatTable, DoctorFormatJSON}
+
+// DoctorConfig is what the doctor checks.
+type DoctorConfig struct {
+	// Socket is the address of the Workload API. When empty, SPIFFE_ENDPOINT_SOCKET is used like the customer does.
+	Socket string
+	// TrustDomains need a bundle, on top of the trust domain of the SVID and of the SPIFFE IDs of the targets.
+	TrustDomains []string
+	// ExpiryWarning is how long an SVID has to be valid for at least, before it is reported.
+	ExpiryWarning time.Duration
+	// Timeout of every check that connects to something.
+	Timeout time.Duration
+	Targets []Target
+}
+
+// Check is the outcome of a single check.
+type Check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+// DoctorReport is the outcome of all checks, in the order they ran.
+type DoctorReport struct {
+	SPIFFEID string    `json:"spiffeId,omitempty"`
+	Time     time.Time `json:"time"`
+	Checks   []Check   `json:"checks"`
+}
+
+// Healthy is true when no check failed. Warnings and skipped checks don't count.
+func (r DoctorReport) Healthy() bool {
+	for _, check := range r.Checks {
+		if check.Status == CheckFail {
+			return false
+		}
+	}
+	return true
+}
+
+// Write prints the report as a table or as JSON. The table lists the hints of the checks that need attention
+// below it, as they are too long for a column.
+func (r DoctorReport) Write(w io.Writer, format string) error {
+	switch format {
+	case DoctorFormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(r)
+	case DoctorFormatTable:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "CHECK\tSTATUS\tDETAIL\n")
+		for _, check := range r.Checks {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", check.Name, check.Status, check.Detail)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		for _, check := range r.Checks {
+			if check.Hint != "" && (check.Status == CheckFail || check.Status == CheckWarn) {
+				fmt.Fprintf(w, "\n%s: %s", check.Name, check.Hint)
+			}
+		}
+		if !r.Healthy() {
+			fmt.Fprintln(w)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// doctorSource hands out the SVID and the bundles of a single fetch from the Workload API. The doctor checks
+// a snapshot, it doesn't need rotation.
+type doctorSource struct {
+	svid *x509svid.SVID
+	*x509bundle.Set
+}
+
+func (s doctorSource) GetX509SVID() (*x509svid.SVID, error) {
+	return s.svid, nil
+}
+
+// probeSource returns the source for the probes, which is nil when there is no SVID.
+func (s *doctorSource) probeSource() probeSource {
+	if s == nil {
+		return nil
+	}
+	return s
+}
+
+// doctor runs the checks. The parts that talk to the environment can be replaced.
+type doctor struct {
+	config DoctorConfig
+	now    func() time.Time
+	// dial checks the socket of the Workload API accepts connections.
+	dial func(ctx context.Context, address string) error
+	// fetch returns the SVIDs and bundles of the Workload API.
+	fetch      func(ctx context.Context, address string) (*workloadapi.X509Context, error)
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+	// awsCredentials retrieves the AWS credentials of the target and returns where they came from.
+	awsCredentials func(ctx context.Context, target *s3Target) (string, error)
+}
+
+// Doctor checks the environment of the customer: the Workload API, the SVIDs and bundles it returns, and
+// whether every target can be reached with them.
+//
+// SPIFFE CONCEPT: Checking the Chain of Trust
+// Every SPIFFE connection depends on the same chain: the workload reaches the Workload API, SPIRE has a
+// registration entry for it and issues an SVID, the SVID is valid, and there is a bundle for the trust domain
+// of every peer. The doctor walks that chain in order, so the first failure is the one to fix.
+func Doctor(ctx context.Context, config DoctorConfig) DoctorReport {
+	return newDoctor(config).run(ctx)
+}
+
+func newDoctor(config DoctorConfig) *doctor {
+	return &doctor{
+		config:         config,
+		now:            time.Now,
+		dial:           dialWorkloadAPI,
+		fetch:          fetchX509Context,
+		lookupHost:     net.DefaultResolver.LookupHost,
+		awsCredentials: retrieveAWSCredentials,
+	}
+}
+
+func (d *doctor) run(ctx context.Context) DoctorReport {
+	report := DoctorReport{Time: d.now()}
+	add := func(check Check) bool {
+		report.Checks = append(report.Checks, check)
+		return check.Status != CheckFail
+	}
+
+	var source *doctorSource
+	x509Context, check := d.checkWorkloadAPI(ctx)
+	if add(check) {
+		check = d.checkSVIDsReturned(x509Context)
+		if add(check) {
+			source = &doctorSource{svid: x509Context.DefaultSVID(), Set: x509Context.Bundles}
+			report.SPIFFEID = source.svid.ID.String()
+			for _, svid := range x509Context.SVIDs {
+				add(d.checkSVIDValidity(svid))
+			}
+		}
+	}
+
+	for _, td := range d.trustDomains(source) {
+		add(d.checkBundle(source, td))
+	}
+
+	clients := newTargetClients(d.config.Targets, nil, sourceSVID(source.probeSource()))
+
+	for _, target := range d.config.Targets {
+		// The targets of the individual flags of the customer exist even when their flag isn't set.
+		if target.Address == "" {
+			add(Check{Name: target.Type + " " + target.Name, Status: CheckSkip, Detail: "no address configured"})
+			continue
+		}
+		switch target.Type {
+		case TargetS3:
+			add(d.checkAWS(ctx, target, clients.s3[target.Name]))
+		case TargetGCS:
+			add(d.checkGCP(ctx, target, clients.gcs[target.Name]))
+		}
+
+		resolved := true
+		if host := targetHost(target); host != "" {
+			resolved = add(d.checkDNS(ctx, target, host))
+		}
+		add(d.checkTarget(ctx, target, source, clients, resolved))
+	}
+	return report
+}
+
+// checkWorkloadAPI checks the socket accepts connections and then fetches the SVIDs.
+func (d *doctor) checkWorkloadAPI(ctx context.Context) (*workloadapi.X509Context, Check) {
+	check := Check{Name: "workload-api"}
+	address := d.config.Socket
+	if address == "" {
+		address, _ = workloadapi.GetDefaultAddress()
+	}
+	if address == "" {
+		check.Status = CheckFail
+		check.Detail = "no address, SPIFFE_ENDPOINT_SOCKET isn't set"
+		check.Hint = "Set SPIFFE_ENDPOINT_SOCKET or --socket to the socket of the SPIRE Agent, e.g. unix:///run/spire/sockets/agent.sock."
+		return nil, check
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.config.Timeout)
+	defer cancel()
+	if err := d.dial(ctx, address); err != nil {
+		check.Status = CheckFail
+		check.Detail = fmt.Sprintf("unable to connect to %s: %v", address, err)
+		check.Hint = diagnoses[diagnosisWorkloadAPIUnreachable].Hint
+		return nil, check
+	}
+
+	x509Context, err := d.fetch(ctx, address)
+	if err != nil {
+		check.Status = CheckFail
+		check.Detail = fmt.Sprintf("%s accepts connections, but fetching the SVIDs failed: %v", address, err)
+		if status.Code(err) == codes.PermissionDenied {
+			check.Detail = fmt.Sprintf("%s issued no SVID to this workload: %v", address, err)
+			check.Hint = diagnoses[diagnosisNoSVID].Hint
+		} else {
+			check.Hint = diagnoses[diagnosisWorkloadAPIUnreachable].Hint
+		}
+		return nil, check
+	}
+	check.Status = CheckOK
+	check.Detail = fmt.Sprintf("reachable at %s", address)
+	return x509Context, check
+}
+
+func (d *doctor) checkSVIDsReturned(x509Context *workloadapi.X509Context) Check {
+	check := Check{Name: "x509-svids"}
+	if len(x509Context.SVIDs) == 0 {
+		check.Status = CheckFail
+		check.Detail = "the Workload API returned no X509-SVID"
+		check.Hint = diagnoses[diagnosisNoSVID].Hint
+		return check
+	}
+	ids := make([]string, 0, len(x509Context.SVIDs))
+	for _, svid := range x509Context.SVIDs {
+		ids = append(ids, svid.ID.String())
+	}
+	check.Status = CheckOK
+	check.Detail = fmt.Sprintf("%d returned: %s", len(ids), strings.Join(ids, ", "))
+	return check
+}
+
+// checkSVIDValidity checks the SVID is valid now and for long enough. SPIRE rotates SVIDs at half of their
+// lifetime, so one that is about to expire means the rotation stopped.
+func (d *doctor) checkSVIDValidity(svid *x509svid.SVID) Check {
+	check := Check{Name: "svid " + svid.ID.String()}
+	cert := svid.Certificates[0]
+	now := d.now()
+	left := cert.NotAfter.Sub(now).Round(time.Second)
+
+	switch {
+	case now.Before(cert.NotBefore):
+		check.Status = CheckFail
+		check.Detail = fmt.Sprintf("not valid before %s", cert.NotBefore.Format(time.RFC3339))
+		check.Hint = "The clock of this node is behind the one of the SPIRE Server. Check that the nodes sync their time."
+	case left <= 0:
+		check.Status = CheckFail
+		check.Detail = fmt.Sprintf("expired at %s", cert.NotAfter.Format(time.RFC3339))
+		check.Hint = diagnoses[diagnosisExpiredCertificate].Hint
+	case left < d.config.ExpiryWarning:
+		check.Status = CheckWarn
+		check.Detail = fmt.Sprintf("expires in %s at %s", left, cert.NotAfter.Format(time.RFC3339))
+		check.Hint = diagnoses[diagnosisExpiredCertificate].Hint
+	default:
+		check.Status = CheckOK
+		check.Detail = fmt.Sprintf("expires in %s at %s", left, cert.NotAfter.Format(time.RFC3339))
+	}
+	return check
+}
+
+// trustDomains returns the trust domains that need a bundle: the configured ones, the one of the SVID and the
+// ones of the SPIFFE IDs of the targets.
+func (d *doctor) trustDomains(source *doctorSource) []string {
+	var tds []string
+	add := func(td string) {
+		if td != "" && !slices.Contains(tds, td) {
+			tds = append(tds, td)
+		}
+	}
+	for _, td := range d.config.TrustDomains {
+		add(td)
+	}
+	if source != nil {
+		add(source.svid.ID.TrustDomain().Name())
+	}
+	for _, target := range d.config.Targets {
+		if id, err := spiffeid.FromString(target.SPIFFEID); err == nil {
+			add(id.TrustDomain().Name())
+		}
+	}
+	return tds
+}
+
+func (d *doctor) checkBundle(source *doctorSource, name string) Check {
+	check := Check{Name: "bundle " + name}
+	td, err := spiffeid.TrustDomainFromString(name)
+	if err != nil {
+		check.Status = CheckFail
+		check.Detail = fmt.Sprintf("invalid trust domain: %v", err)
+		return check
+	}
+	if source == nil {
+		check.Status = CheckSkip
+		check.Detail = "the Workload API returned no bundles"
+		return check
+	}
+	bundle, ok := source.Get(td)
+	if !ok || len(bundle.X509Authorities()) == 0 {
+		check.Status = CheckFail
+		check.Detail = "the Workload API returned no bundle for this trust domain"
+		check.Hint = diagnoses[diagnosisUnknownTrustDomain].Hint
+		return check
+	}
+	check.Status = CheckOK
+	check.Detail = fmt.Sprintf("%d X.509 authorities", len(bundle.X509Authorities()))
+	return check
+}
+
+// targetHost returns the host name of a target that has one. The address of a bucket is its name.
+func targetHost(target Target) string {
+	switch target.Type {
+	case TargetMTLSHTTP:
+		if u, err := url.Parse(target.Address); err == nil {
+			return u.Hostname()
+		}
+	case TargetPostgres:
+		return target.Address
+	}
+	return ""
+}
+
+func (d *doctor) checkDNS(ctx context.Context, target Target, host string) Check {
+	check := Check{Name: "dns " + target.Name}
+	if net.ParseIP(host) != nil {
+		check.Status = CheckOK
+		check.Detail = fmt.Sprintf("%s is an IP address", host)
+		return check
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.config.Timeout)
+	defer cancel()
+	addresses, err := d.lookupHost(ctx, host)
+	if err != nil {
+		check.Status = CheckFail
+		check.Detail = err.Error()
+		check.Hint = diagnoses[diagnosisDNS].Hint
+		return check
+	}
+	check.Status = CheckOK
+	check.Detail = fmt.Sprintf("%s resolves to %s", host, strings.Join(addresses, ", "))
+	return check
+}
+
+// checkTarget connects to the target like the connectivity matrix does. For mTLS targets that includes the
+// handshake and the check of the SPIFFE ID of the server.
+func (d *doctor) checkTarget(ctx context.Context, target Target, source *doctorSource, clients *targetClients, resolved bool) Check {
+	check := Check{Name: target.Type + " " + target.Name}
+	needsSVID := target.Type == TargetMTLSHTTP || target.Type == TargetPostgres
+	switch {
+	case !resolved:
+		check.Status = CheckSkip
+		check.Detail = "the host name doesn't resolve"
+		return check
+	case needsSVID && source == nil:
+		check.Status = CheckSkip
+		check.Detail = "there is no SVID to connect with"
+		return check
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.config.Timeout)
+	defer cancel()
+	result := target.probe(ctx, source.probeSource(), clients)
+	if !result.OK {
+		check.Status = CheckFail
+		check.Detail = fmt.Sprintf("%s: %s", result.Diagnosis.Title, result.Error)
+		check.Hint = result.Diagnosis.Hint
+		if result.Diagnosis.Actual != "" {
+			check.Hint = fmt.Sprintf("Expected %s, got %s. %s", result.Diagnosis.Expected, result.Diagnosis.Actual, check.Hint)
+		}
+		return check
+	}
+	check.Status = CheckOK
+	check.Detail = fmt.Sprintf("connected to %s in %.1f ms", target.Address, result.LatencyMS)
+	if result.PeerID != "" {
+		check.Detail += ", server is " + result.PeerID
+	}
+	return check
+}
+
+// checkAWS checks the target gets AWS credentials. With a role the customer exchanges a JWT-SVID with STS itself,
+// otherwise it reports where the AWS SDK finds the credentials.
+//
+// SPIFFE CONCEPT: Exchanging an SVID for Cloud Credentials
+// The customer has no AWS keys. It exchanges its SVID for short-lived credentials, a JWT-SVID with STS or an
+// X509-SVID with IAM Roles Anywhere. When that exchange isn't configured the AWS SDK falls back to other
+// credentials, or has none at all.
+func (d *doctor) checkAWS(ctx context.Context, target Target, s3Target *s3Target) Check {
+	check := Check{Name: "aws-credentials " + target.Name}
+
+	ctx, cancel := context.WithTimeout(ctx, d.config.Timeout)
+	defer cancel()
+	if s3Target.credentials != nil {
+		roleARN, audience := target.option("role-arn", ""), target.option("audience", DefaultAWSAudience)
+		with := fmt.Sprintf("a JWT-SVID for %q", audience)
+		hint := fmt.Sprintf("Check that the OIDC provider of the AWS account points to the OIDC discovery provider of SPIRE and lists %q as a client ID, and that the trust policy of the role allows the SPIFFE ID of the customer.", audience)
+		if target.option("auth", AWSAuthJWT) == AWSAuthX509 {
+			with = "the X509-SVID through IAM Roles Anywhere"
+			hint = "Check that the trust anchor of IAM Roles Anywhere holds the bundle of the trust domain, that the profile allows the role, and that the trust policy of the role allows rolesanywhere.amazonaws.com for the SPIFFE ID of the customer."
+		}
+		if _, err := d.awsCredentials(ctx, s3Target); err != nil {
+			check.Status = CheckFail
+			check.Detail = fmt.Sprintf("unable to assume %s with %s: %v", roleARN, with, err)
+			check.Hint = hint
+			return check
+		}
+		check.Status = CheckOK
+		check.Detail = fmt.Sprintf("assumed %s with %s", roleARN, with)
+		return check
+	}
+
+	// Without a role the AWS SDK falls back to its default chain, which has nothing to do with the SVID.
+	hint := "Set the role the customer assumes with its SVID with --aws-role-arn or the role-arn option of the target."
+	credentialSource, err := d.awsCredentials(ctx, s3Target)
+	if err != nil {
+		check.Status = CheckFail
+		check.Detail = fmt.Sprintf("no role is set and the AWS SDK found no credentials: %v", err)
+		check.Hint = hint
+		return check
+	}
+	check.Status = CheckWarn
+	check.Detail = fmt.Sprintf("no role is set, the credentials come from %s instead of the SVID", credentialSource)
+	check.Hint = hint
+	return check
+}
+
+func retrieveAWSCredentials(ctx context.Context, target *s3Target) (string, error) {
+	cfg, err := target.awsConfig(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	credentials, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return "", err
+	}
+	return credentials.Source, nil
+}
+
+// checkGCP checks the spiffe-gcp-proxy of the target hands out an access token.
+func (d *doctor) checkGCP(ctx context.Context, target Target, gcsTarget *gcsTarget) Check {
+	check := Check{Name: "gcp-credentials " + target.Name}
+	proxyURL := gcsTarget.proxyURL
+
+	ctx, cancel := context.WithTimeout(ctx, d.config.Timeout)
+	defer cancel()
+	if _, err := getGCPAccessTokenFromProxy(ctx, proxyURL); err != nil {
+		check.Status = CheckFail
+		check.Detail = err.Error()
+		check.Hint = "The spiffe-gcp-proxy exchanges the JWT-SVID of the customer for a GCP access token. Check it runs next to the customer at the proxy option of the target and that the workload identity pool trusts the trust domain."
+		return check
+	}
+	check.Status = CheckOK
+	check.Detail = fmt.Sprintf("%s issued an access token", proxyURL)
+	return check
+}
+
+// dialWorkloadAPI opens and closes a connection to the socket of the Workload API.
+func dialWorkloadAPI(ctx context.Context, address string) error {
+	u, err := url.Parse(address)
+	if err != nil {
+		return fmt.Errorf("invalid address: %w", err)
+	}
+	network, target := u.Scheme, u.Host
+	if network == "unix" {
+		target = u.Path
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, target)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func fetchX509Context(ctx context.Context, address string) (*workloadapi.X509Context, error) {
+	return workloadapi.FetchX509Context(ctx, workloadapi.WithAddr(address))
+}
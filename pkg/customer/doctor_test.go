@@ -0,0 +1,202 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/internal/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testDoctor returns a doctor that gets the SVID from a fake Workload API. It resolves no host names, the test
+// servers listen on an IP address.
+func testDoctor(svid *x509svid.SVID, bundle *x509bundle.Bundle, config DoctorConfig) *doctor {
+	d := newDoctor(config)
+	d.dial = func(ctx context.Context, address string) error { return nil }
+	d.fetch = func(ctx context.Context, address string) (*workloadapi.X509Context, error) {
+		return &workloadapi.X509Context{SVIDs: []*x509svid.SVID{svid}, Bundles: x509bundle.NewSet(bundle)}, nil
+	}
+	d.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return nil, errors.New("no such host")
+	}
+	return d
+}
+
+// statuses returns the status of every check by name.
+func statuses(report DoctorReport) map[string]string {
+	statuses := map[string]string{}
+	for _, check := range report.Checks {
+		statuses[check.Name] = check.Status
+	}
+	return statuses
+}
+
+func TestDoctor(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	ca := spiffetest.NewCA(t, td)
+	bundle := x509bundle.FromX509Authorities(td, []*x509.Certificate{ca.Cert})
+	backend := startMTLSServer(t, ca, bundle, "spiffe://example.org/backend")
+
+	config := DoctorConfig{
+		Socket:        "unix:///run/spire/sockets/agent.sock",
+		TrustDomains:  []string{"example.org", "partner.org"},
+		ExpiryWarning: 10 * time.Minute,
+		Timeout:       5 * time.Second,
+		Targets: []Target{
+			{Name: "backend", Type: TargetMTLSHTTP, Address: backend.URL, SPIFFEID: "spiffe://example.org/backend"},
+			{Name: "impostor", Type: TargetMTLSHTTP, Address: backend.URL, SPIFFEID: "spiffe://example.org/other"},
+			{Name: "gone", Type: TargetMTLSHTTP, Address: "https://gone.demo.svc:8443", SPIFFEID: "spiffe://example.org/gone"},
+			{Name: "unset", Type: TargetS3},
+		},
+	}
+	report := testDoctor(ca.Issue(t, "spiffe://example.org/customer"), bundle, config).run(context.Background())
+
+	assert.Equal(t, "spiffe://example.org/customer", report.SPIFFEID)
+	assert.Equal(t, map[string]string{
+		"workload-api":                       CheckOK,
+		"x509-svids":                         CheckOK,
+		"svid spiffe://example.org/customer": CheckOK,
+		"bundle example.org":                 CheckOK,
+		"bundle partner.org":                 CheckFail,
+		"dns backend":                        CheckOK,
+		"mtls-http backend":                  CheckOK,
+		"dns impostor":                       CheckOK,
+		"mtls-http impostor":                 CheckFail,
+		"dns gone":                           CheckFail,
+		"mtls-http gone":                     CheckSkip,
+		"s3 unset":                           CheckSkip,
+	}, statuses(report))
+	assert.False(t, report.Healthy())
+
+	for _, check := range report.Checks {
+		switch check.Name {
+		case "mtls-http backend":
+			assert.Contains(t, check.Detail, "server is spiffe://example.org/backend")
+		case "mtls-http impostor":
+			assert.Contains(t, check.Hint, "Expected spiffe://example.org/other, got spiffe://example.org/backend")
+		case "bundle partner.org":
+			assert.Equal(t, diagnoses[diagnosisUnknownTrustDomain].Hint, check.Hint)
+		}
+	}
+}
+
+func TestDoctorWithoutWorkloadAPI(t *testing.T) {
+	config := DoctorConfig{
+		Socket:  "unix:///run/spire/sockets/agent.sock",
+		Timeout: time.Second,
+		Targets: []Target{{Name: "backend", Type: TargetMTLSHTTP, Address: "https://10.0.0.1:8443", SPIFFEID: "spiffe://example.org/backend"}},
+	}
+
+	d := newDoctor(config)
+	d.dial = func(ctx context.Context, address string) error { return errors.New("no such file or directory") }
+	report := d.run(context.Background())
+	assert.Equal(t, map[string]string{
+		"workload-api":       CheckFail,
+		"bundle example.org": CheckSkip,
+		"dns backend":        CheckOK,
+		"mtls-http backend":  CheckSkip,
+	}, statuses(report))
+	assert.Equal(t, diagnoses[diagnosisWorkloadAPIUnreachable].Hint, report.Checks[0].Hint)
+
+	// The socket is there, but SPIRE has no registration entry for the workload.
+	d.dial = func(ctx context.Context, address string) error { return nil }
+	d.fetch = func(ctx context.Context, address string) (*workloadapi.X509Context, error) {
+		return nil, status.Error(codes.PermissionDenied, "no identity issued")
+	}
+	report = d.run(context.Background())
+	assert.Equal(t, CheckFail, report.Checks[0].Status)
+	assert.Equal(t, diagnoses[diagnosisNoSVID].Hint, report.Checks[0].Hint)
+}
+
+func TestDoctorSVIDExpiry(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	ca := spiffetest.NewCA(t, td)
+	svid := ca.Issue(t, "spiffe://example.org/customer")
+	expiry := svid.Certificates[0].NotAfter
+	d := newDoctor(DoctorConfig{ExpiryWarning: 10 * time.Minute})
+
+	tests := map[string]time.Time{
+		CheckOK:   expiry.Add(-time.Hour),
+		CheckWarn: expiry.Add(-time.Minute),
+		CheckFail: expiry.Add(time.Minute),
+	}
+	for want, now := range tests {
+		d.now = func() time.Time { return now }
+		assert.Equal(t, want, d.checkSVIDValidity(svid).Status, now)
+	}
+
+	d.now = func() time.Time { return svid.Certificates[0].NotBefore.Add(-time.Minute) }
+	check := d.checkSVIDValidity(svid)
+	assert.Equal(t, CheckFail, check.Status)
+	assert.Contains(t, check.Detail, "not valid before")
+}
+
+func TestDoctorChecksAWSCredentials(t *testing.T) {
+	d := newDoctor(DoctorConfig{Timeout: time.Second})
+	target := Target{Name: "aws", Type: TargetS3, Address: "bucket"}
+
+	// Without a role the credentials of the AWS SDK work, but miss the point of the demo.
+	d.awsCredentials = func(ctx context.Context, target *s3Target) (string, error) { return "EnvConfigCredentials", nil }
+	check := d.checkAWS(context.Background(), target, newS3Target(target, nil))
+	assert.Equal(t, CheckWarn, check.Status)
+	assert.Contains(t, check.Detail, "EnvConfigCredentials")
+
+	d.awsCredentials = func(ctx context.Context, target *s3Target) (string, error) { return "", errors.New("no credentials") }
+	assert.Equal(t, CheckFail, d.checkAWS(context.Background(), target, newS3Target(target, nil)).Status)
+
+	// With a role the customer exchanges a JWT-SVID itself.
+	target.Options = map[string]string{"role-arn": "arn:aws:iam::123456789012:role/spiffe-demo"}
+	d.awsCredentials = func(ctx context.Context, target *s3Target) (string, error) { return "", errors.New("AccessDenied") }
+	check = d.checkAWS(context.Background(), target, newS3Target(target, nil))
+	assert.Equal(t, CheckFail, check.Status)
+	assert.Contains(t, check.Hint, `lists "demo" as a client ID`)
+	d.awsCredentials = func(ctx context.Context, target *s3Target) (string, error) { return "AssumeRoleWithWebIdentity", nil }
+	assert.Equal(t, CheckOK, d.checkAWS(context.Background(), target, newS3Target(target, nil)).Status)
+}
+
+func TestDoctorReportWrite(t *testing.T) {
+	report := DoctorReport{Checks: []Check{
+		{Name: "workload-api", Status: CheckOK, Detail: "reachable"},
+		{Name: "bundle partner.org", Status: CheckFail, Detail: "no bundle", Hint: "Federate the trust domains."},
+	}}
+
+	var table bytes.Buffer
+	require.NoError(t, report.Write(&table, DoctorFormatTable))
+	assert.Contains(t, table.String(), "workload-api        ok      reachable")
+	assert.Contains(t, table.String(), "bundle partner.org: Federate the trust domains.")
+
+	var out bytes.Buffer
+	require.NoError(t, report.Write(&out, DoctorFormatJSON))
+	var decoded DoctorReport
+	require.NoError(t, json.Unmarshal(out.Bytes(), &decoded))
+	assert.Equal(t, report.Checks, decoded.Checks)
+
+	assert.Error(t, report.Write(&out, "yaml"))
+}
@@ -21,81 +21,109 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/mattiasgees/spiffe-demo/pkg/metrics"
 	"golang.org/x/oauth2"
 	"google.golang.org/api/option"
 )
 
-var (
-	gcpBucketName = os.Getenv("BUCKET_NAME")
-)
-
 type AccessTokenResponse struct {
 	AccessToken string `json:"access_token"`
 	ExpiresIn   int    `json:"expires_in"`
 	TokenType   string `json:"token_type"`
 }
 
-// GCPPutHandler writes data to a GCS bucket.
-func GCPPutHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+// A Google Cloud Storage bucket target.
+type gcsTarget struct {
+	name   string
+	bucket string
+	object string
+	// URL of the spiffe-gcp-proxy.
+	proxyURL string
+	timeout  time.Duration
+}
 
-	client, err := createGCPStorageClient(ctx)
+func newGCSTarget(target Target) *gcsTarget {
+	return &gcsTarget{
+		name:     target.Name,
+		bucket:   target.Address,
+		object:   target.option("object", "Hello"),
+		proxyURL: target.option("proxy", "http://localhost:8080"),
+		timeout:  target.timeout(),
+	}
+}
+
+// putHandler writes data to a GCS bucket.
+func (t *gcsTarget) putHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := demoContext(r, t.timeout)
+	defer cancel()
+
+	start := time.Now()
+	client, err := createGCPStorageClient(ctx, t.proxyURL)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create storage client: %v", err), http.StatusInternalServerError)
+		metrics.ObserveOutbound(t.name+"_put", start, err)
+		demoError(ctx, w, "Failed to create storage client", err)
 		return
 	}
 	defer client.Close()
 
-	obj := client.Bucket(gcpBucketName).Object("Hello")
+	obj := client.Bucket(t.bucket).Object(t.object)
 	wc := obj.NewWriter(ctx)
 	if _, err := wc.Write([]byte("world")); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to write to bucket: %v", err), http.StatusInternalServerError)
+		metrics.ObserveOutbound(t.name+"_put", start, err)
+		demoError(ctx, w, "Failed to write to bucket", err)
 		return
 	}
-	if err := wc.Close(); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to close writer: %v", err), http.StatusInternalServerError)
+	err = wc.Close()
+	metrics.ObserveOutbound(t.name+"_put", start, err)
+	if err != nil {
+		demoError(ctx, w, "Failed to close writer", err)
 		return
 	}
 
-	fmt.Fprint(w, "Successfully wrote 'world' to 'Hello' in the GCP bucket.")
+	fmt.Fprintf(w, "Successfully wrote 'world' to %q in the GCP bucket %q.", t.object, t.bucket)
 }
 
-// GCPReadHandler reads data from a GCS bucket.
-func GCPReadHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+// retrievalHandler reads data from a GCS bucket.
+func (t *gcsTarget) retrievalHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := demoContext(r, t.timeout)
+	defer cancel()
 
-	client, err := createGCPStorageClient(ctx)
+	start := time.Now()
+	client, err := createGCPStorageClient(ctx, t.proxyURL)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create storage client: %v", err), http.StatusInternalServerError)
+		metrics.ObserveOutbound(t.name, start, err)
+		demoError(ctx, w, "Failed to create storage client", err)
 		return
 	}
 	defer client.Close()
 
-	obj := client.Bucket(gcpBucketName).Object("Hello")
+	obj := client.Bucket(t.bucket).Object(t.object)
 	rc, err := obj.NewReader(ctx)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to read from bucket: %v", err), http.StatusInternalServerError)
+		metrics.ObserveOutbound(t.name, start, err)
+		demoError(ctx, w, "Failed to read from bucket", err)
 		return
 	}
 	defer rc.Close()
 
 	data, err := io.ReadAll(rc)
+	metrics.ObserveOutbound(t.name, start, err)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to read data: %v", err), http.StatusInternalServerError)
+		demoError(ctx, w, "Failed to read data", err)
 		return
 	}
 
-	fmt.Fprintf(w, "Content of 'Hello': %s", data)
+	fmt.Fprintf(w, "Content of %q: %s", t.object, data)
 }
 
-func createGCPStorageClient(ctx context.Context) (*storage.Client, error) {
+func createGCPStorageClient(ctx context.Context, proxyURL string) (*storage.Client, error) {
 	// Call the spiffe-gcp-proxy to get the access token
-	accessToken, err := getGCPAccessTokenFromProxy(ctx)
+	accessToken, err := getGCPAccessTokenFromProxy(ctx, proxyURL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get access token from proxy: %v", err)
+		return nil, fmt.Errorf("failed to get access token from proxy: %w", err)
 	}
 
 	// Use the access token to create the storage client
@@ -105,31 +133,25 @@ func createGCPStorageClient(ctx context.Context) (*storage.Client, error) {
 
 	client, err := storage.NewClient(ctx, option.WithTokenSource(tokenSource))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create storage client: %v", err)
+		return nil, fmt.Errorf("failed to create storage client: %w", err)
 	}
 
 	return client, nil
 }
 
-func getGCPAccessTokenFromProxy(ctx context.Context) (string, error) {
-	// Get the proxy URL from an environment variable (default to localhost:8080)
-	GCPproxyURL := os.Getenv("SPIFFE_GCP_PROXY_URL")
-	if GCPproxyURL == "" {
-		GCPproxyURL = "http://localhost:8080"
-	}
-
+func getGCPAccessTokenFromProxy(ctx context.Context, proxyURL string) (string, error) {
 	// Construct the full URL for the token request
-	tokenURL := fmt.Sprintf("%s/computeMetadata/v1/instance/service-accounts/default/token", GCPproxyURL)
+	tokenURL := fmt.Sprintf("%s/computeMetadata/v1/instance/service-accounts/default/token", proxyURL)
 
 	// Request token from spiffe-gcp-proxy
 	req, err := http.NewRequestWithContext(ctx, "GET", tokenURL, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %v", err)
+		return "", fmt.Errorf("failed to create request: %w", err)
 	}
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to get response from proxy: %v", err)
+		return "", fmt.Errorf("failed to get response from proxy: %w", err)
 	}
 	defer resp.Body.Close()
 
@@ -141,8 +163,22 @@ func getGCPAccessTokenFromProxy(ctx context.Context) (string, error) {
 	var tokenResp AccessTokenResponse
 	err = json.NewDecoder(resp.Body).Decode(&tokenResp)
 	if err != nil {
-		return "", fmt.Errorf("failed to decode proxy response: %v", err)
+		return "", fmt.Errorf("failed to decode proxy response: %w", err)
 	}
 
 	return tokenResp.AccessToken, nil
 }
+
+// probe checks the object can be read from the GCS bucket, without downloading it.
+func (t *gcsTarget) probe(ctx context.Context) error {
+	client, err := createGCPStorageClient(ctx, t.proxyURL)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if _, err := client.Bucket(t.bucket).Object(t.object).Attrs(ctx); err != nil {
+		return fmt.Errorf("failed to read from bucket: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+)
+
+var handshakeFailuresTmpl = template.Must(template.New("handshakefailures").Parse(`
+{{ if . }}
+<table>
+	<tr><th>Time</th><th>Remote address</th><th>Reason</th><th>Presented SPIFFE ID</th><th>Error</th></tr>
+	{{ range . }}
+	<tr>
+		<td>{{ .Time.Format "02/01/06 15:04:05" }}</td>
+		<td>{{ .RemoteAddr }}</td>
+		<td>{{ .Reason }}</td>
+		<td>{{ if .PresentedID }}{{ .PresentedID }}{{ else }}<em>none</em>{{ end }}</td>
+		<td>{{ .Error }}</td>
+	</tr>
+	{{ end }}
+</table>
+{{ else }}
+<p>The backend has not rejected any TLS handshakes.</p>
+{{ end }}
+`))
+
+// Shows the TLS handshakes the SPIFFE native backend recently rejected, e.g. the ones from the rogue customer.
+func (c *CustomerService) handshakeFailuresHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling a request in the handshake failures handler", logging.RemoteKey, r.RemoteAddr)
+	w.Header().Set("Content-Type", "text/html")
+
+	ctx, cancel := context.WithTimeout(r.Context(), common.DefaultTimeout)
+	defer cancel()
+
+	var failures []common.HandshakeFailure
+	if err := mTLSJSON(ctx, c.pool, backendBreaker, c.spiffeAuthz, http.MethodGet, c.backendService, common.HandshakeFailuresPath, nil, &failures); err != nil {
+		demoError(ctx, w, "Unable to retrieve the handshake failures", err)
+		return
+	}
+
+	if err := handshakeFailuresTmpl.Execute(w, failures); err != nil {
+		http.Error(w, fmt.Sprintf("Error executing template: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
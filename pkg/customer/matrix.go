@@ -0,0 +1,373 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/mattiasgees/spiffe-demo/pkg/metrics"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// Timeout of a single probe, unless the request asks for another one.
+const (
+	defaultProbeTimeout = 5 * time.Second
+	maxProbeTimeout     = 30 * time.Second
+)
+
+// Classes of errors a probe can fail with.
+const (
+	errorClassTimeout       = "timeout"
+	errorClassWorkloadAPI   = "workload-api"
+	errorClassDNS           = "dns"
+	errorClassConnection    = "connection-refused"
+	errorClassNotAuthorized = "peer-not-authorized"
+	errorClassRejected      = "rejected-by-peer"
+	errorClassTLS           = "tls"
+	errorClassHTTPStatus    = "http-status"
+	errorClassOther         = "other"
+)
+
+var (
+	errWorkloadAPI      = errors.New("the Workload API didn't return an X509-SVID")
+	errPeerUnauthorized = errors.New("the peer is not authorized")
+	errHTTPStatus       = errors.New("unexpected HTTP status")
+)
+
+// probeSource is what the probes need from the Workload API. The X509Source implements it.
+type probeSource interface {
+	x509svid.Source
+	x509bundle.Source
+}
+
+// probeResult is the outcome of connecting to a single target.
+type probeResult struct {
+	Target     string     `json:"target"`
+	Type       string     `json:"type"`
+	Address    string     `json:"address"`
+	OK         bool       `json:"ok"`
+	LatencyMS  float64    `json:"latencyMs"`
+	PeerID     string     `json:"peerId,omitempty"`
+	ErrorClass string     `json:"errorClass,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Diagnosis  *diagnosis `json:"diagnosis,omitempty"`
+}
+
+// matrixResult is the outcome of probing all targets, as returned by the JSON API.
+type matrixResult struct {
+	// SPIFFEID is the identity the customer presented, which makes it easy to compare the customer and the rogue customer.
+	SPIFFEID string        `json:"spiffeId,omitempty"`
+	Time     time.Time     `json:"time"`
+	Results  []probeResult `json:"results"`
+}
+
+const matrixPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<title>SPIFFE connectivity matrix</title>
+	<style>
+		body { font-family: Arial, sans-serif; max-width: 1100px; margin: auto; padding: 20px; }
+		table { border-collapse: collapse; width: 100%; }
+		th, td { border: 1px solid #ddd; padding: 6px; text-align: left; font-size: 0.9em; }
+		.pass { background-color: #dff0d8; }
+		.fail { background-color: #f2dede; }
+		.error { font-family: monospace; word-break: break-all; }
+	</style>
+</head>
+<body>
+	<h1>SPIFFE connectivity matrix</h1>
+	<p>Every target is probed at the same time with the identity of this customer: <strong id="identity">...</strong></p>
+	<button onclick="run()">Run again</button>
+	<span id="status"></span>
+	<table>
+		<thead><tr><th>Target</th><th>Type</th><th>Address</th><th>Result</th><th>Latency</th><th>Peer SPIFFE ID</th><th>Error class</th><th>Diagnosis</th><th>Error</th></tr></thead>
+		<tbody id="results"></tbody>
+	</table>
+	<script>
+		function cell(row, text, className) {
+			const td = document.createElement('td');
+			td.textContent = text;
+			if (className) { td.className = className; }
+			row.appendChild(td);
+		}
+		function run() {
+			document.getElementById('status').textContent = 'Running...';
+			fetch('/matrix/api')
+				.then(response => response.json())
+				.then(matrix => {
+					document.getElementById('identity').textContent = matrix.spiffeId || 'unknown, the Workload API did not return an SVID';
+					const body = document.getElementById('results');
+					body.innerHTML = '';
+					for (const r of matrix.results) {
+						const row = document.createElement('tr');
+						row.className = r.ok ? 'pass' : 'fail';
+						cell(row, r.target);
+						cell(row, r.type);
+						cell(row, r.address);
+						cell(row, r.ok ? 'pass' : 'fail');
+						cell(row, r.latencyMs.toFixed(1) + ' ms');
+						cell(row, r.peerId || '');
+						cell(row, r.errorClass || '');
+						cell(row, r.diagnosis ? r.diagnosis.title + '. ' + r.diagnosis.hint : '');
+						cell(row, r.error || '', 'error');
+						body.appendChild(row);
+					}
+					document.getElementById('status').textContent = 'Last run ' + new Date(matrix.time).toLocaleTimeString();
+				})
+				.catch(error => {
+					document.getElementById('status').textContent = 'Error: ' + error;
+				});
+		}
+		run();
+	</script>
+</body>
+</html>
+`
+
+// Serves the page that shows the connectivity matrix.
+func (c *CustomerService) matrixPageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	if _, err := fmt.Fprint(w, matrixPage); err != nil {
+		slog.Error("Error writing response", logging.Err(err))
+	}
+}
+
+// Probes all targets concurrently and returns the results as JSON. The timeout of every probe can be set
+// with the timeout query parameter, e.g. ?timeout=2s.
+//
+// SPIFFE CONCEPT: Zero Trust at a Glance
+// The same probes succeed for the customer and fail for the rogue customer, although both have a valid SVID
+// from the same trust domain. The only difference is the SPIFFE ID, which the targets don't authorize.
+func (c *CustomerService) matrixAPIHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling a request in the matrix handler", logging.RemoteKey, r.RemoteAddr)
+
+	timeout := defaultProbeTimeout
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 || parsed > maxProbeTimeout {
+			http.Error(w, fmt.Sprintf("Invalid timeout %q, it has to be a duration up to %s", value, maxProbeTimeout), http.StatusBadRequest)
+			return
+		}
+		timeout = parsed
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	// All probes share the source of the customer. When the Workload API hasn't returned an SVID yet, the probes
+	// that need one report that, the cloud targets get their credentials elsewhere and still run.
+	var source probeSource
+	x509Source, err := c.pool.x509Source(ctx)
+	if err != nil {
+		slog.Warn("No X509Source for the matrix", logging.Err(err))
+	} else {
+		source = x509Source
+	}
+
+	result := runMatrix(ctx, c.targets, c.clients, source, timeout)
+	if source != nil {
+		if svid, err := source.GetX509SVID(); err == nil {
+			result.SPIFFEID = svid.ID.String()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		slog.Error("Error writing response", logging.Err(err))
+	}
+}
+
+// runMatrix probes all targets at the same time, each with its own timeout. The results are in the order of the targets.
+func runMatrix(ctx context.Context, targets []Target, clients *targetClients, source probeSource, timeout time.Duration) matrixResult {
+	result := matrixResult{Time: time.Now(), Results: make([]probeResult, len(targets))}
+
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			result.Results[i] = target.probe(probeCtx, source, clients)
+		}()
+	}
+	wg.Wait()
+	return result
+}
+
+// probe connects to the target the same way its demos do, with the same client, but only checks the connection works.
+func (t Target) probe(ctx context.Context, source probeSource, clients *targetClients) probeResult {
+	result := probeResult{Target: t.Name, Type: t.Type, Address: t.Address}
+	peer := &peerRecorder{}
+
+	start := time.Now()
+	var err error
+	switch t.Type {
+	case TargetMTLSHTTP:
+		err = probeMTLS(ctx, source, t, peer)
+	case TargetPostgres:
+		err = probePostgres(ctx, source, clients.postgres[t.Name], peer)
+	case TargetS3:
+		err = clients.s3[t.Name].probe(ctx)
+	case TargetGCS:
+		err = clients.gcs[t.Name].probe(ctx)
+	default:
+		err = fmt.Errorf("unknown target type %q", t.Type)
+	}
+	result.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	metrics.ObserveOutbound(t.Name+"_probe", start, err)
+
+	result.PeerID = peer.get()
+	result.OK = err == nil
+	if err != nil {
+		result.ErrorClass = classifyError(err)
+		result.Error = err.Error()
+		result.Diagnosis = diagnose(err).expect(t.SPIFFEID)
+	}
+	return result
+}
+
+// sourceSVID returns the SVID of the source of the probes, which is nil without a Workload API.
+func sourceSVID(source probeSource) svidFunc {
+	return func(ctx context.Context) (*x509svid.SVID, error) {
+		if source == nil {
+			return nil, errWorkloadAPI
+		}
+		return source.GetX509SVID()
+	}
+}
+
+func probeMTLS(ctx context.Context, source probeSource, target Target, peer *peerRecorder) error {
+	if source == nil {
+		return errWorkloadAPI
+	}
+	serverID, err := spiffeid.FromString(target.SPIFFEID)
+	if err != nil {
+		return fmt.Errorf("invalid SPIFFE ID configuration: %w", err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsconfig.MTLSClientConfig(source, source, peer.authorizer(tlsconfig.AuthorizeID(serverID))),
+			// Every probe measures a fresh connection, including the handshake.
+			DisableKeepAlives: true,
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.Address, nil)
+	if err != nil {
+		return fmt.Errorf("unable to create request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error connecting to %q: %w", target.Address, err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w %d from %q", errHTTPStatus, resp.StatusCode, target.Address)
+	}
+	return nil
+}
+
+func probePostgres(ctx context.Context, source probeSource, target *postgresTarget, peer *peerRecorder) error {
+	if source == nil {
+		return errWorkloadAPI
+	}
+	authorizer, err := target.authorizer()
+	if err != nil {
+		return err
+	}
+	db, err := target.connect(ctx, source, source, peer.authorizer(authorizer))
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// peerRecorder remembers the SPIFFE ID the peer presented during the handshake, also when it isn't authorized.
+type peerRecorder struct {
+	mu sync.Mutex
+	id spiffeid.ID
+}
+
+func (p *peerRecorder) authorizer(next tlsconfig.Authorizer) tlsconfig.Authorizer {
+	next = markUnauthorized(next)
+	return func(id spiffeid.ID, verifiedChains [][]*x509.Certificate) error {
+		p.mu.Lock()
+		p.id = id
+		p.mu.Unlock()
+		return next(id, verifiedChains)
+	}
+}
+
+func (p *peerRecorder) get() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.id.IsZero() {
+		return ""
+	}
+	return p.id.String()
+}
+
+// classifyError sorts the error of a probe into a class, so failures can be compared at a glance.
+func classifyError(err error) string {
+	var dnsErr *net.DNSError
+	var unknownAuthority x509.UnknownAuthorityError
+	var certificateInvalid x509.CertificateInvalidError
+	var recordHeader tls.RecordHeaderError
+	var opErr *net.OpError
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return errorClassTimeout
+	case errors.Is(err, errWorkloadAPI):
+		return errorClassWorkloadAPI
+	case errors.Is(err, errPeerUnauthorized):
+		return errorClassNotAuthorized
+	case errors.Is(err, errHTTPStatus):
+		return errorClassHTTPStatus
+	case errors.As(err, &dnsErr):
+		return errorClassDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errorClassConnection
+	// The peer sends a TLS alert when it doesn't accept our SVID, e.g. the backend for the rogue customer.
+	case errors.As(err, &opErr) && opErr.Op == "remote error":
+		return errorClassRejected
+	case errors.As(err, &unknownAuthority), errors.As(err, &certificateInvalid), errors.As(err, &recordHeader),
+		strings.Contains(err.Error(), "x509svid:"), strings.Contains(err.Error(), "tls:"):
+		return errorClassTLS
+	}
+	return errorClassOther
+}
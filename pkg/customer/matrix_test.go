@@ -0,0 +1,134 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/internal/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSource hands out a fixed SVID and bundle, like the X509Source does.
+type testSource struct {
+	*x509svid.SVID
+	*x509bundle.Bundle
+}
+
+func (s testSource) GetX509SVID() (*x509svid.SVID, error) {
+	return s.SVID, nil
+}
+
+// startMTLSServer starts a backend that only accepts the customer.
+func startMTLSServer(t *testing.T, ca *spiffetest.CA, bundle *x509bundle.Bundle, id string) *httptest.Server {
+	return startMTLSHandler(t, ca, bundle, id, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+}
+
+// startMTLSHandler starts a backend with the handler that only accepts the customer.
+func startMTLSHandler(t *testing.T, ca *spiffetest.CA, bundle *x509bundle.Bundle, id string, handler http.Handler) *httptest.Server {
+	server := httptest.NewUnstartedServer(handler)
+	// StartTLS would add its own certificate, which the server prefers without SNI.
+	config := tlsconfig.MTLSServerConfig(ca.Issue(t, id), bundle, tlsconfig.AuthorizeID(spiffeid.RequireFromString("spiffe://example.org/customer")))
+	server.Listener = tls.NewListener(server.Listener, config)
+	server.Start()
+	server.URL = strings.Replace(server.URL, "http://", "https://", 1)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRunMatrix(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	ca := spiffetest.NewCA(t, td)
+	bundle := x509bundle.FromX509Authorities(td, []*x509.Certificate{ca.Cert})
+	backend := startMTLSServer(t, ca, bundle, "spiffe://example.org/backend")
+
+	// A port nothing listens on.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddress := "https://" + listener.Addr().String()
+	listener.Close()
+
+	targets := []Target{
+		{Name: "backend", Type: TargetMTLSHTTP, Address: backend.URL, SPIFFEID: "spiffe://example.org/backend"},
+		{Name: "impostor", Type: TargetMTLSHTTP, Address: backend.URL, SPIFFEID: "spiffe://example.org/other"},
+		{Name: "down", Type: TargetMTLSHTTP, Address: closedAddress, SPIFFEID: "spiffe://example.org/backend"},
+	}
+
+	customer := testSource{SVID: ca.Issue(t, "spiffe://example.org/customer"), Bundle: bundle}
+	result := runMatrix(context.Background(), targets, newTargetClients(targets, nil, nil), customer, 5*time.Second)
+	require.Len(t, result.Results, 3)
+
+	ok := result.Results[0]
+	assert.True(t, ok.OK, ok.Error)
+	assert.Equal(t, "spiffe://example.org/backend", ok.PeerID)
+
+	impostor := result.Results[1]
+	assert.False(t, impostor.OK)
+	assert.Equal(t, errorClassNotAuthorized, impostor.ErrorClass)
+	assert.Equal(t, "spiffe://example.org/backend", impostor.PeerID, "the presented ID is shown even when it isn't authorized")
+	require.NotNil(t, impostor.Diagnosis)
+	assert.Equal(t, diagnosisServerIDMismatch, impostor.Diagnosis.Category)
+	assert.Equal(t, "spiffe://example.org/other", impostor.Diagnosis.Expected)
+	assert.Equal(t, "spiffe://example.org/backend", impostor.Diagnosis.Actual)
+
+	down := result.Results[2]
+	assert.False(t, down.OK)
+	assert.Equal(t, errorClassConnection, down.ErrorClass)
+
+	// The rogue customer has a valid SVID, but the backend doesn't authorize it.
+	rogue := testSource{SVID: ca.Issue(t, "spiffe://example.org/rogue"), Bundle: bundle}
+	result = runMatrix(context.Background(), targets[:1], newTargetClients(targets, nil, nil), rogue, 5*time.Second)
+	assert.False(t, result.Results[0].OK)
+	assert.Equal(t, errorClassRejected, result.Results[0].ErrorClass, result.Results[0].Error)
+	assert.Equal(t, diagnosisRejectedByPeer, result.Results[0].Diagnosis.Category)
+}
+
+func TestRunMatrixWithoutWorkloadAPI(t *testing.T) {
+	targets := []Target{
+		{Name: "backend", Type: TargetMTLSHTTP, Address: "https://backend", SPIFFEID: "spiffe://example.org/backend"},
+		{Name: "db", Type: TargetPostgres, Address: "postgres", Options: map[string]string{"user": "customer"}},
+	}
+
+	result := runMatrix(context.Background(), targets, newTargetClients(targets, nil, nil), nil, time.Second)
+	for _, r := range result.Results {
+		assert.False(t, r.OK)
+		assert.Equal(t, errorClassWorkloadAPI, r.ErrorClass, r.Target)
+	}
+}
+
+func TestMatrixAPIRejectsInvalidTimeout(t *testing.T) {
+	c := &CustomerService{}
+	for _, timeout := range []string{"soon", "-1s", "1h"} {
+		rr := httptest.NewRecorder()
+		c.matrixAPIHandler(rr, httptest.NewRequest("GET", "/matrix/api?timeout="+timeout, nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, timeout)
+	}
+}
@@ -16,23 +16,32 @@ limitations under the License.
 package customer
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/mattiasgees/spiffe-demo/pkg/metrics"
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"github.com/spiffe/go-spiffe/v2/spiffetls"
-	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
-	"github.com/spiffe/go-spiffe/v2/workloadapi"
 )
 
-// Handles requests for connecting to the SPIFFE native backend
-func (c *CustomerService) mtlsHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Handling a request in the rootHandler from %s", r.RemoteAddr)
-	mTLSCall(w, c.spiffeAuthz, c.backendService)
+// Handles requests for connecting to an mTLS HTTP target. This is either a SPIFFE native server, like the backend,
+// or an HTTP server that is fronted by Envoy, which gives it the necessary SPIFFE capabilities to make this possible.
+func mTLSTargetHandler(pool *clientPool, target Target) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slog.Debug("Handling a request for an mTLS target", "target", target.Name, logging.RemoteKey, r.RemoteAddr)
+		ctx, cancel := demoContext(r, target.timeout())
+		defer cancel()
+		mTLSCall(ctx, w, pool, target.Name, target.SPIFFEID, target.Address)
+	}
 }
 
 // General mTLS call to SPIFFE enabled servers. This can be either a SPIFFE native application or a webserver/apiserver that is fronted by a SPIFFE proxy like Envoy.
@@ -42,27 +51,11 @@ func (c *CustomerService) mtlsHandler(w http.ResponseWriter, r *http.Request) {
 // to establish mutually authenticated TLS connections. The go-spiffe library handles
 // all certificate management automatically - no need to deal with certificate files,
 // rotation, or manual TLS configuration.
-func mTLSCall(w http.ResponseWriter, spiffeAuthZ string, backendAddress string) {
+//
+// The context covers the whole call, from waiting for the SVID of the Workload API to reading the response.
+// The client comes from the pool, so repeated calls reuse the connection to the server.
+func mTLSCall(ctx context.Context, w http.ResponseWriter, pool *clientPool, demo string, spiffeAuthZ string, backendAddress string) {
 	w.Header().Set("Content-Type", "text/html")
-	ctx := context.Background()
-	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
-	defer cancel()
-
-	// SPIFFE CONCEPT: X509Source and the Workload API
-	// The X509Source automatically connects to the SPIFFE Workload API (typically provided
-	// by SPIRE Agent) via a Unix domain socket. It fetches the workload's X.509-SVID
-	// (SPIFFE Verifiable Identity Document) which contains:
-	//   - The workload's SPIFFE ID in the certificate's URI SAN (e.g., spiffe://example.org/myservice)
-	//   - A private key for proving identity
-	//   - Trust bundles for validating other workloads' certificates
-	// The source automatically handles certificate rotation - when SPIRE rotates the SVID,
-	// the source gets updated transparently.
-	source, err := workloadapi.NewX509Source(ctx)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Unable to create X509Source: %v", err), http.StatusInternalServerError)
-		return
-	}
-	defer source.Close()
 
 	// SPIFFE CONCEPT: SPIFFE ID Authorization
 	// A SPIFFE ID is a URI that uniquely identifies a workload (e.g., spiffe://trust-domain/path).
@@ -75,31 +68,38 @@ func mTLSCall(w http.ResponseWriter, spiffeAuthZ string, backendAddress string)
 		return
 	}
 
-	// SPIFFE CONCEPT: mTLS Client Configuration
-	// MTLSClientConfig creates a TLS configuration for mutual TLS:
-	//   - First 'source' parameter: provides our client certificate (X.509-SVID) to present to the server
-	//   - Second 'source' parameter: provides trust bundles to validate the server's certificate
-	//   - AuthorizeID(serverID): only accept connections to servers with this exact SPIFFE ID
-	// This ensures both sides prove their identity - true mutual authentication.
-	tlsConfig := tlsconfig.MTLSClientConfig(source, source, tlsconfig.AuthorizeID(serverID))
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: tlsConfig,
-		},
-	}
-
-	// Do a GET call to the backend and get the response.
-	resp, err := client.Get(backendAddress)
+	// SPIFFE CONCEPT: X509Source and mTLS Client Configuration
+	// The client of the pool uses the X509Source of the customer, which is connected to the SPIFFE Workload API
+	// (typically provided by SPIRE Agent) via a Unix domain socket. It holds the workload's X.509-SVID
+	// (SPIFFE Verifiable Identity Document) which contains:
+	//   - The workload's SPIFFE ID in the certificate's URI SAN (e.g., spiffe://example.org/myservice)
+	//   - A private key for proving identity
+	//   - Trust bundles for validating other workloads' certificates
+	// Its TLS configuration presents the SVID to the server, validates the certificate of the server with the
+	// trust bundles and only accepts a server with this exact SPIFFE ID (AuthorizeID). This ensures both sides
+	// prove their identity - true mutual authentication.
+	// Do a GET call to the backend and get the response. The pool retries it when the backend is briefly
+	// unavailable, but not when the backend isn't who we expect.
+	start := time.Now()
+	resp, err := pool.do(ctx, demo, serverID, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, backendAddress, nil)
+	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error connecting to %q: %v", backendAddress, err), http.StatusInternalServerError)
+		metrics.ObserveOutbound(demo, start, err)
+		// SPIFFE CONCEPT: Explaining a Failed Handshake
+		// A failed mTLS call only returns a terse Go error like "remote error: tls: bad certificate". The
+		// diagnosis explains which side refused and why, e.g. that the rogue customer has a valid SVID that the
+		// backend doesn't authorize.
+		diagnosedError(ctx, w, fmt.Sprintf("Error connecting to %q", backendAddress), err, spiffeAuthZ)
 		return
 	}
 
 	defer resp.Body.Close()
 	// Read the body from the response.
 	body, err := io.ReadAll(resp.Body)
+	metrics.ObserveOutbound(demo, start, err)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Unable to read body: %v", err), http.StatusInternalServerError)
+		demoError(ctx, w, "Unable to read body", err)
 		return
 	}
 
@@ -117,3 +117,71 @@ func mTLSCall(w http.ResponseWriter, spiffeAuthZ string, backendAddress string)
 	fmt.Fprintf(w, "<p>Got a response from: %s</p>", serverSPIFFEID.String())
 	fmt.Fprintf(w, "<p>Server says: %q</p>", body)
 }
+
+// mTLSJSON does a call over SPIFFE mTLS to a path of a SPIFFE enabled server. The body, if any, is sent as JSON
+// and the JSON response is decoded into v, if it isn't nil. The call goes through the breaker of the target.
+func mTLSJSON(ctx context.Context, pool *clientPool, target, spiffeAuthZ, method, address, path string, body, v any) error {
+	serverID, err := spiffeid.FromString(spiffeAuthZ)
+	if err != nil {
+		return fmt.Errorf("invalid SPIFFE ID configuration: %w", err)
+	}
+
+	requestURL, err := url.JoinPath(address, path)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", address, err)
+	}
+
+	var data []byte
+	if body != nil {
+		data, err = json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("unable to marshal request: %w", err)
+		}
+	}
+
+	resp, err := pool.do(ctx, target, serverID, func(ctx context.Context) (*http.Request, error) {
+		var requestBody io.Reader
+		if data != nil {
+			requestBody = bytes.NewReader(data)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, requestURL, requestBody)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create request: %w", err)
+		}
+		if data != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		return req, nil
+	})
+	if err != nil {
+		return fmt.Errorf("error connecting to %q: %w", address, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(resp.Body)
+		return &upstreamStatusError{Status: resp.StatusCode, err: fmt.Errorf("%s %q returned status %d: %s", method, requestURL, resp.StatusCode, strings.TrimSpace(string(message)))}
+	}
+
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("unable to decode response from %q: %w", requestURL, err)
+	}
+	return nil
+}
+
+// upstreamStatusError is the error of a call to which the server answered with a status that isn't a success.
+type upstreamStatusError struct {
+	Status int
+	err    error
+}
+
+func (e *upstreamStatusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *upstreamStatusError) Unwrap() error {
+	return e.err
+}
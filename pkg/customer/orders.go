@@ -0,0 +1,182 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/mattiasgees/spiffe-demo/pkg/metrics"
+)
+
+var orderItems = []string{"Coffee", "Tea", "Croissant", "Bagel", "Muffin", "Orange juice"}
+
+var ordersTmpl = template.Must(template.New("orders").Parse(`
+{{ if . }}
+<table>
+	<tr><th>ID</th><th>Owner</th><th>Item</th><th>Quantity</th><th>Last updated</th></tr>
+	{{ range . }}
+	<tr>
+		<td>{{ .ID }}</td>
+		<td>{{ .Owner }}</td>
+		<td>{{ .Item }}</td>
+		<td>{{ .Quantity }}</td>
+		<td>{{ .UpdatedAt.Format "02/01/06 15:04:05" }}</td>
+	</tr>
+	{{ end }}
+</table>
+{{ else }}
+<p>No orders visible to this customer.</p>
+{{ end }}
+`))
+
+// Lists the orders of the backend the customer is allowed to see.
+func (c *CustomerService) listOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling a request in the list orders handler", logging.RemoteKey, r.RemoteAddr)
+	w.Header().Set("Content-Type", "text/html")
+
+	var orders []common.Order
+	if err := c.ordersCall(r.Context(), http.MethodGet, common.OrdersPath, nil, &orders); err != nil {
+		demoError(r.Context(), w, "Unable to list the orders", err)
+		return
+	}
+
+	if err := ordersTmpl.Execute(w, orders); err != nil {
+		http.Error(w, fmt.Sprintf("Error executing template: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// allowOrderChange checks that a request that changes an order is a POST of the page of the customer itself,
+// so no other site can create, update or delete orders with the SVID of the customer.
+func allowOrderChange(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := crossOrigin.Check(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// Creates a random order in the backend. The backend stores the SPIFFE ID of the customer as its owner.
+func (c *CustomerService) createOrderHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling a request in the create order handler", logging.RemoteKey, r.RemoteAddr)
+	if !allowOrderChange(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+
+	var order common.Order
+	if err := c.ordersCall(r.Context(), http.MethodPost, common.OrdersPath, randomOrder(), &order); err != nil {
+		demoError(r.Context(), w, "Unable to create the order", err)
+		return
+	}
+
+	fmt.Fprintf(w, "<p>Created order %s: %d x %s</p>", order.ID, order.Quantity, template.HTMLEscapeString(order.Item))
+	fmt.Fprintf(w, "<p>Owner: %s</p>", template.HTMLEscapeString(order.Owner))
+}
+
+// Replaces an order in the backend with a random one. This only works for orders the customer owns.
+func (c *CustomerService) updateOrderHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling a request in the update order handler", logging.RemoteKey, r.RemoteAddr)
+	if !allowOrderChange(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+
+	id := r.FormValue("id")
+	if !validOrderID(id) {
+		http.Error(w, "Provide the ID of the order to update", http.StatusBadRequest)
+		return
+	}
+
+	var order common.Order
+	if err := c.ordersCall(r.Context(), http.MethodPut, common.OrdersPath+"/"+id, randomOrder(), &order); err != nil {
+		demoError(r.Context(), w, "Unable to update the order", err)
+		return
+	}
+
+	fmt.Fprintf(w, "<p>Updated order %s: %d x %s</p>", order.ID, order.Quantity, template.HTMLEscapeString(order.Item))
+}
+
+// Deletes an order in the backend. This only works for orders the customer owns.
+func (c *CustomerService) deleteOrderHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling a request in the delete order handler", logging.RemoteKey, r.RemoteAddr)
+	if !allowOrderChange(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+
+	id := r.FormValue("id")
+	if !validOrderID(id) {
+		http.Error(w, "Provide the ID of the order to delete", http.StatusBadRequest)
+		return
+	}
+
+	if err := c.ordersCall(r.Context(), http.MethodDelete, common.OrdersPath+"/"+id, nil, nil); err != nil {
+		demoError(r.Context(), w, "Unable to delete the order", err)
+		return
+	}
+
+	fmt.Fprintf(w, "<p>Deleted order %s</p>", template.HTMLEscapeString(id))
+}
+
+// ordersCall calls the orders API of the backend over SPIFFE mTLS.
+//
+// SPIFFE CONCEPT: Identity Beyond the Handshake
+// The customer doesn't send any user or owner information. The backend takes the SPIFFE ID from the
+// mTLS connection and uses it to decide which orders this customer may see and change.
+func (c *CustomerService) ordersCall(ctx context.Context, method, path string, body, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, common.DefaultTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := mTLSJSON(ctx, c.pool, backendBreaker, c.spiffeAuthz, method, c.backendService, path, body, v)
+	metrics.ObserveOutbound("orders", start, err)
+	return err
+}
+
+// validOrderID reports whether the ID can be an order of the backend. The ID becomes part of the path of the
+// call to the backend, so anything else could point the call at another endpoint.
+func validOrderID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+func randomOrder() common.OrderRequest {
+	return common.OrderRequest{
+		Item:     orderItems[rand.Intn(len(orderItems))],
+		Quantity: rand.Intn(5) + 1,
+	}
+}
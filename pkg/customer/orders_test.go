@@ -0,0 +1,61 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderHandlersRejectInvalidIDs(t *testing.T) {
+	svc := &CustomerService{}
+	for _, id := range []string{"", "..", "../handshake-failures", "1/2", "1?admin=true", "1%2F2"} {
+		rr := httptest.NewRecorder()
+		svc.updateOrderHandler(rr, httptest.NewRequest("POST", "/orders/update?id="+url.QueryEscape(id), nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, id)
+
+		rr = httptest.NewRecorder()
+		svc.deleteOrderHandler(rr, httptest.NewRequest("POST", "/orders/delete?id="+url.QueryEscape(id), nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, id)
+	}
+	assert.True(t, validOrderID("42"))
+}
+
+func TestOrderHandlersOnlyAcceptPostsOfThePage(t *testing.T) {
+	svc := &CustomerService{}
+	handlers := map[string]http.HandlerFunc{
+		"/orders/create":       svc.createOrderHandler,
+		"/orders/update?id=42": svc.updateOrderHandler,
+		"/orders/delete?id=42": svc.deleteOrderHandler,
+	}
+	for path, handler := range handlers {
+		// An <img src> on another site sends a GET.
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, rr.Code, path)
+
+		// A form on another site sends a POST, the browser says where it comes from.
+		r := httptest.NewRequest("POST", path, nil)
+		r.Header.Set("Sec-Fetch-Site", "cross-site")
+		rr = httptest.NewRecorder()
+		handler(rr, r)
+		assert.Equal(t, http.StatusForbidden, rr.Code, path)
+	}
+}
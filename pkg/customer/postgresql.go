@@ -19,7 +19,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"time"
@@ -27,14 +27,38 @@ import (
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/stdlib"
 	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/mattiasgees/spiffe-demo/pkg/metrics"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
-	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
 )
 
-const (
-	dbName = "testdb"
-	dbPort = "5432"
-)
+// A PostgreSQL database target.
+type postgresTarget struct {
+	name     string
+	host     string
+	port     string
+	user     string
+	database string
+	spiffeID string
+	timeout  time.Duration
+	pool     *clientPool
+}
+
+func newPostgresTarget(target Target, pool *clientPool) *postgresTarget {
+	return &postgresTarget{
+		name:     target.Name,
+		host:     target.Address,
+		port:     target.option("port", "5432"),
+		user:     target.option("user", ""),
+		database: target.option("database", "testdb"),
+		spiffeID: target.SPIFFEID,
+		timeout:  target.timeout(),
+		pool:     pool,
+	}
+}
 
 var firstNames = []string{
 	"James", "Mary", "John", "Patricia", "Robert", "Jennifer", "Michael", "Linda",
@@ -47,22 +71,28 @@ var lastNames = []string{
 }
 
 // Retrieves data from the PostgreSQL test_table.
-func (c *CustomerService) postgreSQLRetrievalHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Handling a request in the PostgreSQL Retrieval handler from %s", r.RemoteAddr)
+func (t *postgresTarget) retrievalHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling a request in the PostgreSQL retrieval handler", "target", t.name, logging.RemoteKey, r.RemoteAddr)
+
+	ctx, cancel := demoContext(r, t.timeout)
+	defer cancel()
 
 	// Setup the PostgreSQL connection.
-	db, err := c.setupPostgreSQLConnection()
+	start := time.Now()
+	db, err := t.setupPostgreSQLConnection(ctx)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		metrics.ObserveOutbound(t.name, start, err)
+		demoError(ctx, w, "Unable to connect to PostgreSQL", err)
 		return
 	}
 	defer db.Close()
 
 	// Execute the PostgreSQL query.
 	queryStmt := `SELECT name, text FROM test_table`
-	rows, err := db.Query(queryStmt)
+	rows, err := db.QueryContext(ctx, queryStmt)
+	metrics.ObserveOutbound(t.name, start, err)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error querying data: %v", err), http.StatusInternalServerError)
+		demoError(ctx, w, "Error querying data", err)
 		return
 	}
 	defer rows.Close()
@@ -85,20 +115,25 @@ func (c *CustomerService) postgreSQLRetrievalHandler(w http.ResponseWriter, r *h
 	// Log errors if we found one when iterating over the rows.
 	err = rows.Err()
 	if err != nil {
-		log.Printf("Error iterating rows: %v", err)
+		slog.Error("Error iterating rows", logging.Err(err))
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
 }
 
 // Writes a randomly generate name to the test_table of PostgreSQL.
-func (c *CustomerService) postgreSQLPutHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Handling a request in the PostgreSQL Put handler from %s", r.RemoteAddr)
+func (t *postgresTarget) putHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling a request in the PostgreSQL put handler", "target", t.name, logging.RemoteKey, r.RemoteAddr)
+
+	ctx, cancel := demoContext(r, t.timeout)
+	defer cancel()
 
 	// Setup the PostgreSQL connection.
-	db, err := c.setupPostgreSQLConnection()
+	start := time.Now()
+	db, err := t.setupPostgreSQLConnection(ctx)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		metrics.ObserveOutbound(t.name+"_put", start, err)
+		demoError(ctx, w, "Unable to connect to PostgreSQL", err)
 		return
 	}
 	defer db.Close()
@@ -118,9 +153,10 @@ func (c *CustomerService) postgreSQLPutHandler(w http.ResponseWriter, r *http.Re
 
 	// Execute the PostgreSQL query.
 	insertStmt := `INSERT INTO test_table (name, text) VALUES ($1, $2)`
-	_, err = db.Exec(insertStmt, fullName, text)
+	_, err = db.ExecContext(ctx, insertStmt, fullName, text)
+	metrics.ObserveOutbound(t.name+"_put", start, err)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error inserting data: %v", err), http.StatusInternalServerError)
+		demoError(ctx, w, "Error inserting data", err)
 		return
 	}
 
@@ -141,33 +177,50 @@ func (c *CustomerService) postgreSQLPutHandler(w http.ResponseWriter, r *http.Re
 //   - Identity is cryptographically verifiable
 //   - Automatic certificate rotation via SPIRE
 //   - Database can authorize based on SPIFFE ID (configured in pg_hba.conf)
-func (c *CustomerService) setupPostgreSQLConnection() (*sql.DB, error) {
-	ctx := context.Background()
-	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
-	defer cancel()
-
+func (t *postgresTarget) setupPostgreSQLConnection(ctx context.Context) (*sql.DB, error) {
 	// SPIFFE CONCEPT: X509Source for Database Connections
-	// We obtain our X.509-SVID from SPIRE, just like for service-to-service mTLS.
+	// We use the same X.509-SVID from SPIRE as for service-to-service mTLS.
 	// The certificate's Common Name (CN) or URI SAN contains our SPIFFE ID,
 	// which PostgreSQL can use for authentication and authorization.
-	source, err := workloadapi.NewX509Source(ctx)
+	source, err := t.pool.x509Source(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create X509Source: %v", err)
+		return nil, err
 	}
-	defer source.Close()
 
-	// SPIFFE CONCEPT: AuthorizeAny() for Database Connections
-	// Here we use AuthorizeAny() instead of AuthorizeID() because PostgreSQL's
-	// certificate might not have a SPIFFE ID (it's not SPIFFE-native).
-	// The database authenticates us via our certificate; we trust the database
-	// based on network policy or the CA that signed its certificate.
-	// In a full SPIFFE deployment, you could use AuthorizeID() if the database
-	// also has a SPIFFE identity.
-	tlsConfig := tlsconfig.MTLSClientConfig(source, source, tlsconfig.AuthorizeAny())
+	authorizer, err := t.authorizer()
+	if err != nil {
+		return nil, err
+	}
+	return t.connect(ctx, source, source, authorizer)
+}
+
+// authorizer returns the policy for the certificate of the database.
+//
+// SPIFFE CONCEPT: AuthorizeAny() for Database Connections
+// Here we use AuthorizeAny() instead of AuthorizeID() because PostgreSQL's
+// certificate might not have a SPIFFE ID (it's not SPIFFE-native).
+// The database authenticates us via our certificate; we trust the database
+// based on network policy or the CA that signed its certificate.
+// When the database does have a SPIFFE identity, the target can be configured
+// with its SPIFFE ID and we use AuthorizeID() instead.
+func (t *postgresTarget) authorizer() (tlsconfig.Authorizer, error) {
+	if t.spiffeID == "" {
+		return tlsconfig.AuthorizeAny(), nil
+	}
+	serverID, err := spiffeid.FromString(t.spiffeID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SPIFFE ID configuration: %v", err)
+	}
+	return tlsconfig.AuthorizeID(serverID), nil
+}
+
+// connect opens a connection to the database with the SVID of the source and checks it works.
+func (t *postgresTarget) connect(ctx context.Context, svidSource x509svid.Source, bundleSource x509bundle.Source, authorizer tlsconfig.Authorizer) (*sql.DB, error) {
+	tlsConfig := tlsconfig.MTLSClientConfig(svidSource, bundleSource, authorizer)
 
 	connStr := fmt.Sprintf(
 		"postgres://%s@%s:%s/%s?sslmode=require",
-		c.postgreSQLUser, c.postgreSQLHost, dbPort, dbName)
+		t.user, t.host, t.port, t.database)
 
 	// Parse the PostgreSQL config settings
 	config, err := pgx.ParseConfig(connStr)
@@ -186,9 +239,10 @@ func (c *CustomerService) setupPostgreSQLConnection() (*sql.DB, error) {
 	db := stdlib.OpenDB(*config)
 
 	// Ping the PostgreSQL database to test the connection
-	err = db.Ping()
+	err = db.PingContext(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("error pinging database: %v", err)
+		db.Close()
+		return nil, fmt.Errorf("error pinging database: %w", err)
 	}
 
 	// Return the DB connection.
@@ -0,0 +1,317 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// Name of the breaker of the demos that call the backend, like the call chain and the orders API.
+const backendBreaker = "backend"
+
+// States of a circuit breaker.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+var errBreakerOpen = errors.New("circuit breaker is open")
+
+// The longest wait before a retry, however many retries are configured.
+const maxRetryBackoff = 30 * time.Second
+
+// Resilience configures how the customer retries outbound calls and when it stops calling a target.
+type Resilience struct {
+	// Retries is how many times an idempotent request is retried after a transient failure.
+	Retries int
+	// Backoff is the wait before the first retry. It doubles for every retry and is jittered.
+	Backoff time.Duration
+	// BreakerThreshold is the number of handshake or authorization failures in a row that opens the breaker
+	// of a target. Zero disables the breakers.
+	BreakerThreshold int
+	// BreakerCooldown is how long a breaker stays open before it lets a single trial call through.
+	BreakerCooldown time.Duration
+}
+
+// Validate checks the settings are usable.
+func (r Resilience) Validate() error {
+	switch {
+	case r.Retries < 0:
+		return fmt.Errorf("retries can't be negative, got %d", r.Retries)
+	case r.Retries > 0 && r.Backoff <= 0:
+		return fmt.Errorf("the retry backoff has to be positive, got %s", r.Backoff)
+	case r.BreakerThreshold < 0:
+		return fmt.Errorf("the breaker threshold can't be negative, got %d", r.BreakerThreshold)
+	case r.BreakerThreshold > 0 && r.BreakerCooldown <= 0:
+		return fmt.Errorf("the breaker cooldown has to be positive, got %s", r.BreakerCooldown)
+	}
+	return nil
+}
+
+// circuitBreaker stops the calls to a target that keeps failing its handshake or authorization, so the
+// customer doesn't keep hammering a peer that won't accept it.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	// Set while the single trial call of a half-open breaker is in flight.
+	trial bool
+}
+
+// breakerStatus is the state of a breaker as shown on the page.
+type breakerStatus struct {
+	Name      string
+	State     string
+	Failures  int
+	OpenUntil time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now, state: breakerClosed}
+}
+
+// allow reports whether a call may go out. Once the cooldown has passed, an open breaker lets a single trial through.
+func (b *circuitBreaker) allow() error {
+	if b.threshold == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen && b.now().Sub(b.openedAt) >= b.cooldown {
+		b.state = breakerHalfOpen
+	}
+	switch {
+	case b.state == breakerOpen:
+		return fmt.Errorf("%w until %s after %d handshake or authorization failures", errBreakerOpen, b.openedAt.Add(b.cooldown).Format(time.TimeOnly), b.failures)
+	case b.state == breakerHalfOpen && b.trial:
+		return fmt.Errorf("%w, a trial call is in flight", errBreakerOpen)
+	case b.state == breakerHalfOpen:
+		b.trial = true
+	}
+	return nil
+}
+
+// success closes the breaker after a call that reached the target and was authorized.
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = breakerClosed
+	b.failures = 0
+	b.trial = false
+}
+
+// failure counts a handshake or authorization failure. A failed trial opens the breaker again.
+func (b *circuitBreaker) failure() {
+	if b.threshold == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = b.now()
+	}
+	b.trial = false
+}
+
+// release ends a call that failed for another reason. A target that is down or slow isn't rejecting the
+// customer, so it doesn't count, but a half-open breaker lets the next call try again.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+func (b *circuitBreaker) status(name string) breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := breakerStatus{Name: name, State: b.state, Failures: b.failures}
+	if b.state == breakerOpen {
+		status.OpenUntil = b.openedAt.Add(b.cooldown)
+	}
+	return status
+}
+
+// breaker returns the breaker of a target, creating it on first use.
+func (p *clientPool) breaker(name string) *circuitBreaker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b, ok := p.breakers[name]; ok {
+		return b
+	}
+	b := newCircuitBreaker(p.resilience.BreakerThreshold, p.resilience.BreakerCooldown)
+	p.breakers[name] = b
+	return b
+}
+
+// breakerStatuses returns the state of the breakers of the given targets, in that order.
+func (p *clientPool) breakerStatuses(names []string) []breakerStatus {
+	statuses := make([]breakerStatus, 0, len(names))
+	for _, name := range names {
+		statuses = append(statuses, p.breaker(name).status(name))
+	}
+	return statuses
+}
+
+// do sends a request to a target with the client of the pool. Idempotent requests are retried with a jittered
+// backoff after transient failures, like the backend restarting or the Workload API not having an SVID yet.
+// newRequest is called for every attempt, so the body can be sent again.
+//
+// SPIFFE CONCEPT: Authorization Failures Are Policy
+// A peer that presents the wrong SPIFFE ID, or rejects ours, won't change its mind on a retry: that is the
+// zero-trust policy doing its job. Those failures are never retried. They count towards the circuit breaker of
+// the target instead, which stops calling the target for a while once they keep happening.
+func (p *clientPool) do(ctx context.Context, target string, serverID spiffeid.ID, newRequest func(context.Context) (*http.Request, error)) (*http.Response, error) {
+	// Waits until the Workload API handed out an SVID, or the context is done.
+	client, err := p.client(ctx, serverID)
+	if err != nil {
+		return nil, err
+	}
+
+	breaker := p.breaker(target)
+	for attempt := 0; ; attempt++ {
+		if err := breaker.allow(); err != nil {
+			return nil, fmt.Errorf("%s: %w", target, err)
+		}
+
+		req, err := newRequest(ctx)
+		if err != nil {
+			breaker.release()
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		switch {
+		// A 403 is an answer of the target about a single request, like an order of another customer. The
+		// handshake accepted our SVID, so it isn't a reason to stop calling the target.
+		case err != nil && breakerFailure(err):
+			breaker.failure()
+		case err == nil:
+			breaker.success()
+		default:
+			breaker.release()
+		}
+
+		if attempt >= p.resilience.Retries || !retryable(req.Method, resp, err) || ctx.Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			// Read the rest of the body, so the connection can be reused for the retry.
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		wait := p.resilience.backoff(attempt)
+		slog.Warn("Call failed, retrying", "target", target, "wait", wait, "failure", describeFailure(resp, err))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// backoff returns the wait before a retry: the backoff doubles for every attempt and a random half of it is
+// added, so customers that failed at the same time don't retry at the same time. The wait stops doubling at
+// maxRetryBackoff.
+func (r Resilience) backoff(attempt int) time.Duration {
+	wait := r.Backoff
+	for i := 0; i < attempt && wait < maxRetryBackoff; i++ {
+		wait *= 2
+	}
+	wait = min(wait, maxRetryBackoff)
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// retryable reports whether a failed attempt is worth another try. Only idempotent requests are retried, and
+// only for failures that can go away by themselves.
+func retryable(method string, resp *http.Response, err error) bool {
+	if !slices.Contains([]string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete}, method) {
+		return false
+	}
+	if err == nil {
+		return slices.Contains([]int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}, resp.StatusCode)
+	}
+	switch classifyError(err) {
+	case errorClassConnection, errorClassDNS, errorClassWorkloadAPI, errorClassOther:
+		return true
+	}
+	return false
+}
+
+// breakerFailure reports whether an error means the handshake or the authorization failed.
+func breakerFailure(err error) bool {
+	switch classifyError(err) {
+	case errorClassNotAuthorized, errorClassRejected, errorClassTLS:
+		return true
+	}
+	return false
+}
+
+func describeFailure(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return resp.Status
+}
+
+var breakersTmpl = template.Must(template.New("breakers").Parse(`
+{{- range . }}
+<span class="breaker breaker-{{ .State }}" title="{{ .Failures }} handshake or authorization failures in a row">
+{{ .Name }}: {{ .State }}{{ if not .OpenUntil.IsZero }} until {{ .OpenUntil.Format "15:04:05" }}{{ end }}
+</span>
+{{- end }}
+`))
+
+// breakerNames returns the names of the breakers the page shows: the mTLS targets and the backend.
+func (c *CustomerService) breakerNames() []string {
+	var names []string
+	for _, target := range c.consoleTargets() {
+		names = append(names, target.Name)
+	}
+	if !slices.Contains(names, backendBreaker) {
+		names = append(names, backendBreaker)
+	}
+	return names
+}
+
+// Shows the state of the circuit breakers, the page refreshes it after every demo.
+func (c *CustomerService) breakersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	if err := breakersTmpl.Execute(w, c.pool.breakerStatuses(c.breakerNames())); err != nil {
+		http.Error(w, fmt.Sprintf("Error executing template: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,162 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/internal/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/logger"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	breaker := newCircuitBreaker(2, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	require.NoError(t, breaker.allow())
+	breaker.failure()
+	// A target that is down doesn't count.
+	require.NoError(t, breaker.allow())
+	breaker.release()
+	require.NoError(t, breaker.allow())
+	breaker.failure()
+	assert.Equal(t, breakerOpen, breaker.status("backend").State)
+	assert.ErrorIs(t, breaker.allow(), errBreakerOpen)
+
+	// After the cooldown a single trial goes through.
+	now = now.Add(time.Minute)
+	require.NoError(t, breaker.allow())
+	assert.ErrorIs(t, breaker.allow(), errBreakerOpen)
+	breaker.failure()
+	assert.Equal(t, breakerOpen, breaker.status("backend").State, "a failed trial opens the breaker again")
+
+	now = now.Add(time.Minute)
+	require.NoError(t, breaker.allow())
+	breaker.success()
+	status := breaker.status("backend")
+	assert.Equal(t, breakerClosed, status.State)
+	assert.Zero(t, status.Failures)
+}
+
+func TestClientPoolDo(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	ca := spiffetest.NewCA(t, td)
+	bundle := x509bundle.FromX509Authorities(td, []*x509.Certificate{ca.Cert})
+
+	// The backend is unavailable for the first call.
+	var calls atomic.Int32
+	backend := startMTLSHandler(t, ca, bundle, "spiffe://example.org/backend", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			http.Error(w, "restarting", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+
+	source := &rotatingTestSource{Bundle: bundle, svid: ca.Issue(t, "spiffe://example.org/customer"), updated: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resilience := Resilience{Retries: 2, Backoff: time.Millisecond, BreakerThreshold: 2, BreakerCooldown: time.Minute}
+	pool := newClientPool(ctx, resilience, func(context.Context, logger.Logger) (rotatingSource, error) { return source, nil })
+
+	request := func(method string) func(context.Context) (*http.Request, error) {
+		return func(ctx context.Context) (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, method, backend.URL, nil)
+		}
+	}
+
+	backendID := spiffeid.RequireFromString("spiffe://example.org/backend")
+	resp, err := pool.do(ctx, "backend", backendID, request(http.MethodGet))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(2), calls.Load(), "the GET is retried")
+
+	calls.Store(0)
+	resp, err = pool.do(ctx, "backend", backendID, request(http.MethodPost))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(1), calls.Load(), "a POST isn't idempotent")
+
+	// The backend doesn't have the expected SPIFFE ID, that is policy and never retried.
+	calls.Store(0)
+	impostorID := spiffeid.RequireFromString("spiffe://example.org/other")
+	_, err = pool.do(ctx, "impostor", impostorID, request(http.MethodGet))
+	assert.Equal(t, errorClassNotAuthorized, classifyError(err))
+	assert.Equal(t, breakerClosed, pool.breaker("impostor").status("impostor").State)
+	_, err = pool.do(ctx, "impostor", impostorID, request(http.MethodGet))
+	assert.Equal(t, errorClassNotAuthorized, classifyError(err))
+	assert.Equal(t, breakerOpen, pool.breaker("impostor").status("impostor").State)
+
+	_, err = pool.do(ctx, "impostor", impostorID, request(http.MethodGet))
+	assert.ErrorIs(t, err, errBreakerOpen)
+	assert.Zero(t, calls.Load())
+
+	// A 403 denies a single request to a customer the handshake accepted, it doesn't open the breaker.
+	forbidden := startMTLSHandler(t, ca, bundle, "spiffe://example.org/backend", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not your order", http.StatusForbidden)
+	}))
+	for range resilience.BreakerThreshold + 1 {
+		resp, err = pool.do(ctx, "orders", backendID, func(ctx context.Context) (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, http.MethodGet, forbidden.URL, nil)
+		})
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+	assert.Equal(t, breakerClosed, pool.breaker("orders").status("orders").State)
+}
+
+func TestRetryable(t *testing.T) {
+	assert.True(t, retryable(http.MethodGet, &http.Response{StatusCode: http.StatusBadGateway}, nil))
+	assert.False(t, retryable(http.MethodGet, &http.Response{StatusCode: http.StatusForbidden}, nil))
+	assert.False(t, retryable(http.MethodPost, &http.Response{StatusCode: http.StatusBadGateway}, nil))
+	assert.False(t, retryable(http.MethodGet, nil, errPeerUnauthorized))
+	assert.True(t, retryable(http.MethodGet, nil, errWorkloadAPI))
+}
+
+func TestBackoffIsCapped(t *testing.T) {
+	r := Resilience{Backoff: 200 * time.Millisecond}
+	wait := r.backoff(1)
+	assert.GreaterOrEqual(t, wait, 200*time.Millisecond)
+	assert.LessOrEqual(t, wait, 400*time.Millisecond)
+
+	// Shifting the backoff this far would overflow.
+	for _, attempt := range []int{40, 64, 1000} {
+		wait := r.backoff(attempt)
+		assert.GreaterOrEqual(t, wait, maxRetryBackoff/2, attempt)
+		assert.LessOrEqual(t, wait, maxRetryBackoff, attempt)
+	}
+}
+
+func TestResilienceValidate(t *testing.T) {
+	assert.NoError(t, Resilience{Retries: 2, Backoff: time.Second, BreakerThreshold: 3, BreakerCooldown: time.Minute}.Validate())
+	assert.NoError(t, Resilience{}.Validate())
+	assert.Error(t, Resilience{Retries: -1}.Validate())
+	assert.Error(t, Resilience{Retries: 1}.Validate())
+	assert.Error(t, Resilience{BreakerThreshold: 1}.Validate())
+}
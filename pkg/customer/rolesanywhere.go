@@ -0,0 +1,250 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// How long the credentials of a Roles Anywhere session are valid for. The cache refreshes them before they
+// expire, so a short session only costs an extra call every hour.
+const rolesAnywhereSessionDuration = time.Hour
+
+// How long the CreateSession call to IAM Roles Anywhere may take.
+const rolesAnywhereTimeout = 10 * time.Second
+
+// The format of X-Amz-Date and the date of the credential scope.
+const (
+	amzDateFormat  = "20060102T150405Z"
+	amzShortFormat = "20060102"
+)
+
+// svidFunc returns the current X509-SVID of the customer.
+type svidFunc func(ctx context.Context) (*x509svid.SVID, error)
+
+// rolesAnywhere gets AWS credentials from IAM Roles Anywhere with the X509-SVID of the customer.
+//
+// SPIFFE CONCEPT: X509-SVIDs as AWS Credentials
+// IAM Roles Anywhere trusts the CA of SPIRE as a trust anchor. The customer signs a CreateSession request with
+// the private key of its X509-SVID and sends the certificate along, which is the whole login: AWS verifies the
+// signature and the certificate against the trust anchor and returns short-lived credentials for the role.
+// The SVID rotates, every new session is signed with the latest one.
+type rolesAnywhere struct {
+	client         *http.Client
+	endpoint       string
+	region         string
+	trustAnchorARN string
+	profileARN     string
+	roleARN        string
+	svid           svidFunc
+	now            func() time.Time
+}
+
+// createSessionRequest is the body of CreateSession.
+type createSessionRequest struct {
+	DurationSeconds int    `json:"durationSeconds"`
+	ProfileARN      string `json:"profileArn"`
+	RoleARN         string `json:"roleArn"`
+	TrustAnchorARN  string `json:"trustAnchorArn"`
+}
+
+// createSessionResponse is the part of the response of CreateSession the customer needs.
+type createSessionResponse struct {
+	CredentialSet []struct {
+		Credentials struct {
+			AccessKeyID     string    `json:"accessKeyId"`
+			SecretAccessKey string    `json:"secretAccessKey"`
+			SessionToken    string    `json:"sessionToken"`
+			Expiration      time.Time `json:"expiration"`
+		} `json:"credentials"`
+	} `json:"credentialSet"`
+}
+
+// newRolesAnywhereCredentials returns AWS credentials for the role from IAM Roles Anywhere. The credentials are
+// cached and refreshed before they expire. The endpoint is only set to test against a stand-in.
+func newRolesAnywhereCredentials(region, trustAnchorARN, profileARN, roleARN, endpoint string, svid svidFunc) aws.CredentialsProvider {
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://rolesanywhere.%s.amazonaws.com", region)
+	}
+	provider := &rolesAnywhere{
+		client:         &http.Client{Timeout: rolesAnywhereTimeout},
+		endpoint:       strings.TrimSuffix(endpoint, "/"),
+		region:         region,
+		trustAnchorARN: trustAnchorARN,
+		profileARN:     profileARN,
+		roleARN:        roleARN,
+		svid:           svid,
+		now:            time.Now,
+	}
+	return aws.NewCredentialsCache(provider, func(o *aws.CredentialsCacheOptions) {
+		o.ExpiryWindow = awsCredentialsExpiryWindow
+	})
+}
+
+// Retrieve creates a session with the current SVID.
+func (r *rolesAnywhere) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	svid, err := r.svid(ctx)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("unable to get an X509-SVID for IAM Roles Anywhere: %w", err)
+	}
+
+	body, err := json.Marshal(createSessionRequest{
+		DurationSeconds: int(rolesAnywhereSessionDuration.Seconds()),
+		ProfileARN:      r.profileARN,
+		RoleARN:         r.roleARN,
+		TrustAnchorARN:  r.trustAnchorARN,
+	})
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.endpoint+"/sessions", bytes.NewReader(body))
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("unable to create request: %w", err)
+	}
+	if err := signX509(req, body, svid, r.region, r.now()); err != nil {
+		return aws.Credentials{}, err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("unable to create a Roles Anywhere session: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("unable to read the Roles Anywhere session: %w", err)
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return aws.Credentials{}, fmt.Errorf("Roles Anywhere returned %d for %s: %s", resp.StatusCode, svid.ID, strings.TrimSpace(string(data)))
+	}
+
+	var session createSessionResponse
+	if err := json.Unmarshal(data, &session); err != nil {
+		return aws.Credentials{}, fmt.Errorf("unable to decode the Roles Anywhere session: %w", err)
+	}
+	if len(session.CredentialSet) == 0 {
+		return aws.Credentials{}, errors.New("the Roles Anywhere session has no credentials")
+	}
+	credentials := session.CredentialSet[0].Credentials
+	return aws.Credentials{
+		AccessKeyID:     credentials.AccessKeyID,
+		SecretAccessKey: credentials.SecretAccessKey,
+		SessionToken:    credentials.SessionToken,
+		Source:          "RolesAnywhere",
+		CanExpire:       true,
+		Expires:         credentials.Expiration,
+	}, nil
+}
+
+// signX509 signs the request with the SigV4-X509 scheme of IAM Roles Anywhere. It is SigV4, except that the
+// string to sign is signed with the private key of the certificate instead of an HMAC of a secret key, and
+// the credential is the serial number of the certificate.
+func signX509(req *http.Request, body []byte, svid *x509svid.SVID, region string, now time.Time) error {
+	algorithm, err := x509SigningAlgorithm(svid.PrivateKey)
+	if err != nil {
+		return err
+	}
+	cert := svid.Certificates[0]
+	now = now.UTC()
+
+	headers := map[string]string{
+		"content-type": "application/json",
+		"host":         req.URL.Host,
+		"x-amz-date":   now.Format(amzDateFormat),
+		"x-amz-x509":   base64.StdEncoding.EncodeToString(cert.Raw),
+	}
+	if len(svid.Certificates) > 1 {
+		chain := make([]string, 0, len(svid.Certificates)-1)
+		for _, intermediate := range svid.Certificates[1:] {
+			chain = append(chain, base64.StdEncoding.EncodeToString(intermediate.Raw))
+		}
+		headers["x-amz-x509-chain"] = strings.Join(chain, ",")
+	}
+	for name, value := range headers {
+		if name != "host" {
+			req.Header.Set(name, value)
+		}
+	}
+
+	canonical, signedHeaders := canonicalRequest(req.Method, req.URL.EscapedPath(), req.URL.RawQuery, headers, body)
+	scope := fmt.Sprintf("%s/%s/rolesanywhere/aws4_request", now.Format(amzShortFormat), region)
+	stringToSign := strings.Join([]string{algorithm, now.Format(amzDateFormat), scope, hexSHA256([]byte(canonical))}, "\n")
+
+	digest := sha256.Sum256([]byte(stringToSign))
+	signature, err := svid.PrivateKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("unable to sign the Roles Anywhere request: %w", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, cert.SerialNumber.String(), scope, signedHeaders, hex.EncodeToString(signature)))
+	return nil
+}
+
+// canonicalRequest returns the canonical request of SigV4 over the headers, and the list of signed headers.
+// The names of the headers are in lower case.
+func canonicalRequest(method, path, query string, headers map[string]string, body []byte) (string, string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(headers[name]))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	if path == "" {
+		path = "/"
+	}
+	return strings.Join([]string{method, path, query, canonicalHeaders.String(), signedHeaders, hexSHA256(body)}, "\n"), signedHeaders
+}
+
+// x509SigningAlgorithm returns the SigV4-X509 algorithm for the type of the key.
+func x509SigningAlgorithm(key crypto.Signer) (string, error) {
+	switch key.Public().(type) {
+	case *ecdsa.PublicKey:
+		return "AWS4-X509-ECDSA-SHA256", nil
+	case *rsa.PublicKey:
+		return "AWS4-X509-RSA-SHA256", nil
+	}
+	return "", fmt.Errorf("IAM Roles Anywhere doesn't support keys of type %T", key.Public())
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
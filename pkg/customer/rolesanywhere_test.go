@@ -0,0 +1,233 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/internal/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testTrustAnchorARN = "arn:aws:rolesanywhere:eu-west-2:123456789012:trust-anchor/spire"
+	testProfileARN     = "arn:aws:rolesanywhere:eu-west-2:123456789012:profile/spiffe-demo"
+)
+
+// fakeRolesAnywhere is a stand-in for IAM Roles Anywhere. Like the real service it verifies the SigV4-X509
+// signature with the certificate of the request and the certificate against its trust anchor.
+type fakeRolesAnywhere struct {
+	t      *testing.T
+	region string
+	anchor *x509bundle.Bundle
+
+	mu       sync.Mutex
+	sessions []string
+}
+
+func (s *fakeRolesAnywhere) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, err := s.verify(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"message":%q}`, err.Error()), http.StatusForbidden)
+		return
+	}
+	s.mu.Lock()
+	s.sessions = append(s.sessions, id)
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"credentialSet":[{"credentials":{"accessKeyId":"ASIA%d","secretAccessKey":"secret","sessionToken":"session","expiration":%q},"roleArn":%q}],"subjectArn":"subject"}`,
+		len(s.sessions), time.Now().Add(time.Hour).UTC().Format(time.RFC3339), testRoleARN)
+}
+
+func (s *fakeRolesAnywhere) verify(r *http.Request) (string, error) {
+	authorization := r.Header.Get("Authorization")
+	algorithm, rest, _ := strings.Cut(authorization, " ")
+	if algorithm != "AWS4-X509-ECDSA-SHA256" {
+		return "", fmt.Errorf("unexpected algorithm %q", algorithm)
+	}
+	fields := map[string]string{}
+	for _, field := range strings.Split(rest, ", ") {
+		key, value, _ := strings.Cut(field, "=")
+		fields[key] = value
+	}
+
+	der, err := base64.StdEncoding.DecodeString(r.Header.Get("X-Amz-X509"))
+	if err != nil {
+		return "", err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return "", err
+	}
+	id, _, err := x509svid.Verify([]*x509.Certificate{cert}, s.anchor)
+	if err != nil {
+		return "", fmt.Errorf("untrusted certificate: %w", err)
+	}
+
+	date := r.Header.Get("X-Amz-Date")
+	scope := fmt.Sprintf("%s/%s/rolesanywhere/aws4_request", date[:8], s.region)
+	if fields["Credential"] != cert.SerialNumber.String()+"/"+scope {
+		return "", fmt.Errorf("unexpected credential %q", fields["Credential"])
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	headers := map[string]string{}
+	for _, name := range strings.Split(fields["SignedHeaders"], ";") {
+		headers[name] = r.Header.Get(name)
+		if name == "host" {
+			headers[name] = r.Host
+		}
+	}
+	canonical, _ := canonicalRequest(r.Method, r.URL.EscapedPath(), r.URL.RawQuery, headers, body)
+	stringToSign := strings.Join([]string{algorithm, date, scope, hexSHA256([]byte(canonical))}, "\n")
+	digest := sha256.Sum256([]byte(stringToSign))
+	signature, err := hex.DecodeString(fields["Signature"])
+	if err != nil {
+		return "", err
+	}
+	if !ecdsa.VerifyASN1(cert.PublicKey.(*ecdsa.PublicKey), digest[:], signature) {
+		return "", fmt.Errorf("signature doesn't match")
+	}
+
+	var session createSessionRequest
+	if err := json.Unmarshal(body, &session); err != nil {
+		return "", err
+	}
+	if session.TrustAnchorARN != testTrustAnchorARN || session.ProfileARN != testProfileARN || session.RoleARN != testRoleARN {
+		return "", fmt.Errorf("unexpected session %+v", session)
+	}
+	return id.String(), nil
+}
+
+func (s *fakeRolesAnywhere) calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+func startFakeRolesAnywhere(t *testing.T, region string, anchor *x509bundle.Bundle) (*fakeRolesAnywhere, string) {
+	fake := &fakeRolesAnywhere{t: t, region: region, anchor: anchor}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server.URL
+}
+
+func staticSVID(svid *x509svid.SVID) svidFunc {
+	return func(ctx context.Context) (*x509svid.SVID, error) {
+		return svid, nil
+	}
+}
+
+func TestRolesAnywhereCredentials(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	ca := spiffetest.NewCA(t, td)
+	anchor := x509bundle.FromX509Authorities(td, []*x509.Certificate{ca.Cert})
+	fake, endpoint := startFakeRolesAnywhere(t, "eu-west-2", anchor)
+
+	svid := ca.Issue(t, "spiffe://example.org/customer")
+	provider := newRolesAnywhereCredentials("eu-west-2", testTrustAnchorARN, testProfileARN, testRoleARN, endpoint, staticSVID(svid))
+	credentials, err := provider.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ASIA1", credentials.AccessKeyID)
+	assert.Equal(t, "session", credentials.SessionToken)
+	assert.True(t, credentials.CanExpire)
+	// The cache moves the expiry forward by the expiry window.
+	assert.WithinDuration(t, time.Now().Add(time.Hour-awsCredentialsExpiryWindow), credentials.Expires, time.Minute)
+	assert.Equal(t, 1, fake.calls())
+
+	// The credentials are cached until they are about to expire.
+	_, err = provider.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, fake.calls())
+}
+
+func TestRolesAnywhereCredentialsRejected(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	ca := spiffetest.NewCA(t, td)
+	anchor := x509bundle.FromX509Authorities(td, []*x509.Certificate{ca.Cert})
+	svid := ca.Issue(t, "spiffe://example.org/customer")
+
+	// A certificate of a CA that isn't the trust anchor.
+	_, endpoint := startFakeRolesAnywhere(t, "eu-west-2", anchor)
+	foreign := spiffetest.NewCA(t, td).Issue(t, "spiffe://example.org/customer")
+	_, err := newRolesAnywhereCredentials("eu-west-2", testTrustAnchorARN, testProfileARN, testRoleARN, endpoint, staticSVID(foreign)).Retrieve(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "untrusted certificate")
+
+	// The signature covers the region of the credential scope.
+	_, endpoint = startFakeRolesAnywhere(t, "us-east-1", anchor)
+	_, err = newRolesAnywhereCredentials("eu-west-2", testTrustAnchorARN, testProfileARN, testRoleARN, endpoint, staticSVID(svid)).Retrieve(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "returned 403")
+
+	noSVID := func(ctx context.Context) (*x509svid.SVID, error) { return nil, errWorkloadAPI }
+	_, err = newRolesAnywhereCredentials("eu-west-2", testTrustAnchorARN, testProfileARN, testRoleARN, endpoint, noSVID).Retrieve(context.Background())
+	assert.ErrorIs(t, err, errWorkloadAPI)
+}
+
+func TestSignX509DetectsTampering(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	ca := spiffetest.NewCA(t, td)
+	fake := &fakeRolesAnywhere{t: t, region: "eu-west-2", anchor: x509bundle.FromX509Authorities(td, []*x509.Certificate{ca.Cert})}
+
+	body := []byte(`{"durationSeconds":3600,"profileArn":"` + testProfileARN + `","roleArn":"` + testRoleARN + `","trustAnchorArn":"` + testTrustAnchorARN + `"}`)
+	req := httptest.NewRequest(http.MethodPost, "https://rolesanywhere.eu-west-2.amazonaws.com/sessions", strings.NewReader(string(body)))
+	require.NoError(t, signX509(req, body, ca.Issue(t, "spiffe://example.org/customer"), "eu-west-2", time.Now()))
+	_, err := fake.verify(req)
+	require.NoError(t, err)
+
+	req.Body = io.NopCloser(strings.NewReader(strings.Replace(string(body), "3600", "43200", 1)))
+	_, err = fake.verify(req)
+	assert.ErrorContains(t, err, "signature doesn't match")
+}
+
+func TestX509SigningAlgorithm(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	algorithm, err := x509SigningAlgorithm(rsaKey)
+	require.NoError(t, err)
+	assert.Equal(t, "AWS4-X509-RSA-SHA256", algorithm)
+
+	ca := spiffetest.NewCA(t, spiffeid.RequireTrustDomainFromString("example.org"))
+	algorithm, err = x509SigningAlgorithm(ca.Key)
+	require.NoError(t, err)
+	assert.Equal(t, "AWS4-X509-ECDSA-SHA256", algorithm)
+}
@@ -0,0 +1,489 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/mattiasgees/spiffe-demo/pkg/metrics"
+)
+
+// The largest file the S3 browser uploads.
+const maxS3Upload = 32 << 20
+
+// The S3 browser lists this many objects per page.
+const s3BrowserPageSize = 100
+
+// s3Listing is a page of the objects under a prefix of the bucket.
+type s3Listing struct {
+	Target string
+	Bucket string
+	Prefix string
+	// Parent is the prefix one level up, Root is true at the top of the bucket.
+	Parent string
+	Root   bool
+	// Folders are the prefixes right under the prefix.
+	Folders []s3Folder
+	Objects []s3Object
+	// Next is the continuation token of the next page, if there is one.
+	Next string
+}
+
+type s3Folder struct {
+	Prefix string
+	Name   string
+}
+
+type s3Object struct {
+	Key          string
+	Name         string
+	Size         int64
+	LastModified time.Time
+}
+
+// s3ObjectInfo is the metadata of an object.
+type s3ObjectInfo struct {
+	Target       string
+	Bucket       string
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+	ETag         string
+	StorageClass string
+	VersionID    string
+	Encryption   string
+	Metadata     map[string]string
+}
+
+var s3BrowserTmpl = template.Must(template.New("s3browser").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<title>S3 browser {{ .Bucket }}</title>
+	<style>
+		body { font-family: Arial, sans-serif; max-width: 1000px; margin: auto; padding: 20px; }
+		table { border-collapse: collapse; width: 100%; }
+		th, td { border-bottom: 1px solid #ddd; padding: 6px; text-align: left; }
+		form { display: inline; }
+	</style>
+</head>
+<body>
+	<h1>s3://{{ .Bucket }}/{{ .Prefix }}</h1>
+	<p>Every call to S3 is made with AWS credentials the customer got with its SPIFFE identity.</p>
+	<form action="/{{ .Target }}/browse/upload" method="post" enctype="multipart/form-data">
+		<input type="hidden" name="prefix" value="{{ .Prefix }}">
+		<input type="file" name="file" required>
+		<button type="submit">Upload to {{ if .Prefix }}{{ .Prefix }}{{ else }}the bucket{{ end }}</button>
+	</form>
+	<table>
+		<tr><th>Name</th><th>Size</th><th>Last modified</th><th></th></tr>
+		{{- if not .Root }}
+		<tr><td><a href="/{{ .Target }}/browse?prefix={{ .Parent }}">..</a></td><td></td><td></td><td></td></tr>
+		{{- end }}
+		{{- range .Folders }}
+		<tr><td><a href="/{{ $.Target }}/browse?prefix={{ .Prefix }}">{{ .Name }}</a></td><td></td><td></td><td></td></tr>
+		{{- end }}
+		{{- range .Objects }}
+		<tr>
+			<td><a href="/{{ $.Target }}/browse/object?key={{ .Key }}">{{ .Name }}</a></td>
+			<td>{{ .Size }}</td>
+			<td>{{ .LastModified.Format "02/01/06 15:04:05" }}</td>
+			<td>
+				<a href="/{{ $.Target }}/browse/object?key={{ .Key }}&download=1">Download</a>
+				<a href="/{{ $.Target }}/browse/info?key={{ .Key }}">Info</a>
+				<form action="/{{ $.Target }}/browse/delete" method="post" onsubmit="return confirm('Delete {{ .Key }}?')">
+					<input type="hidden" name="key" value="{{ .Key }}">
+					<button type="submit">Delete</button>
+				</form>
+			</td>
+		</tr>
+		{{- end }}
+	</table>
+	{{- if and (not .Folders) (not .Objects) }}
+	<p>There are no objects under this prefix.</p>
+	{{- end }}
+	{{- if .Next }}
+	<p><a href="/{{ .Target }}/browse?prefix={{ .Prefix }}&token={{ .Next }}">Next page</a></p>
+	{{- end }}
+</body>
+</html>
+`))
+
+var s3InfoTmpl = template.Must(template.New("s3info").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<title>{{ .Key }}</title>
+	<style>
+		body { font-family: Arial, sans-serif; max-width: 1000px; margin: auto; padding: 20px; }
+		th, td { border-bottom: 1px solid #ddd; padding: 6px; text-align: left; }
+	</style>
+</head>
+<body>
+	<h1>s3://{{ .Bucket }}/{{ .Key }}</h1>
+	<table>
+		<tr><th>Size</th><td>{{ .Size }}</td></tr>
+		<tr><th>Content type</th><td>{{ .ContentType }}</td></tr>
+		<tr><th>Last modified</th><td>{{ .LastModified.Format "02/01/06 15:04:05" }}</td></tr>
+		<tr><th>ETag</th><td>{{ .ETag }}</td></tr>
+		{{- if .StorageClass }}
+		<tr><th>Storage class</th><td>{{ .StorageClass }}</td></tr>
+		{{- end }}
+		{{- if .VersionID }}
+		<tr><th>Version</th><td>{{ .VersionID }}</td></tr>
+		{{- end }}
+		{{- if .Encryption }}
+		<tr><th>Encryption</th><td>{{ .Encryption }}</td></tr>
+		{{- end }}
+		{{- range $key, $value := .Metadata }}
+		<tr><th>x-amz-meta-{{ $key }}</th><td>{{ $value }}</td></tr>
+		{{- end }}
+	</table>
+	<p><a href="/{{ .Target }}/browse/object?key={{ .Key }}&download=1">Download</a> <a href="/{{ .Target }}/browse">Back to the bucket</a></p>
+</body>
+</html>
+`))
+
+// browseHandler lists the folders and objects under a prefix of the bucket.
+//
+// SPIFFE CONCEPT: One Identity, Every Permission
+// Listing, reading, uploading and deleting all use the same short-lived credentials the customer got for its
+// SPIFFE ID. What the browser can do is decided by the policy of the role that identity maps to, so a rogue
+// workload with another SPIFFE ID gets denied, even with the same page.
+func (t *s3Target) browseHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling a request in the S3 browse handler", "target", t.name, logging.RemoteKey, r.RemoteAddr)
+
+	ctx, cancel := demoContext(r, t.timeout)
+	defer cancel()
+
+	prefix := r.URL.Query().Get("prefix")
+	listing := s3Listing{Target: t.name, Bucket: t.bucket, Prefix: prefix, Root: prefix == "", Parent: parentPrefix(prefix)}
+
+	client, err := t.client(ctx)
+	if err != nil {
+		demoError(ctx, w, "Failed to load AWS config", err)
+		return
+	}
+
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(t.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+		MaxKeys:   aws.Int32(s3BrowserPageSize),
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		input.ContinuationToken = aws.String(token)
+	}
+
+	start := time.Now()
+	result, err := client.ListObjectsV2(ctx, input)
+	metrics.ObserveOutbound(t.name+"_list", start, err)
+	if err != nil {
+		demoError(ctx, w, fmt.Sprintf("Unable to list %q in %q", prefix, t.bucket), err)
+		return
+	}
+
+	for _, folder := range result.CommonPrefixes {
+		listing.Folders = append(listing.Folders, s3Folder{Prefix: aws.ToString(folder.Prefix), Name: strings.TrimPrefix(aws.ToString(folder.Prefix), prefix)})
+	}
+	for _, object := range result.Contents {
+		key := aws.ToString(object.Key)
+		if key == prefix {
+			// The placeholder of the folder itself.
+			continue
+		}
+		listing.Objects = append(listing.Objects, s3Object{
+			Key:          key,
+			Name:         strings.TrimPrefix(key, prefix),
+			Size:         aws.ToInt64(object.Size),
+			LastModified: aws.ToTime(object.LastModified),
+		})
+	}
+	if aws.ToBool(result.IsTruncated) {
+		listing.Next = aws.ToString(result.NextContinuationToken)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := s3BrowserTmpl.Execute(w, listing); err != nil {
+		slog.Error("Error executing template", logging.Err(err))
+	}
+}
+
+// objectHandler streams an object to the browser with its content type. With download set the browser
+// saves it instead of showing it.
+//
+// The content type is whatever the uploader sent, so the object is untrusted. Only plain text and images are
+// shown, everything else is always saved, and the browser can't sniff another type or run scripts of the object.
+func (t *s3Target) objectHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling a request in the S3 object handler", "target", t.name, logging.RemoteKey, r.RemoteAddr)
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "Provide the key of the object", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := demoContext(r, t.timeout)
+	defer cancel()
+
+	client, err := t.client(ctx)
+	if err != nil {
+		demoError(ctx, w, "Failed to load AWS config", err)
+		return
+	}
+
+	start := time.Now()
+	resp, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		metrics.ObserveOutbound(t.name, start, err)
+		demoError(ctx, w, fmt.Sprintf("Unable to get %q from %q", key, t.bucket), err)
+		return
+	}
+	defer resp.Body.Close()
+
+	contentType := aws.ToString(resp.ContentType)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	if resp.ContentLength != nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(*resp.ContentLength, 10))
+	}
+	if resp.ETag != nil {
+		w.Header().Set("ETag", *resp.ETag)
+	}
+	if resp.LastModified != nil {
+		w.Header().Set("Last-Modified", resp.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if r.URL.Query().Get("download") != "" || !inlineContentType(contentType) {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(key)}))
+	}
+
+	// The headers are sent, a failure halfway can only be logged.
+	_, err = io.Copy(w, resp.Body)
+	metrics.ObserveOutbound(t.name, start, err)
+	if err != nil {
+		slog.Error("Unable to stream the object", "target", t.name, "key", key, logging.Err(err))
+	}
+}
+
+// inlineContentType reports whether an object of the content type may be shown in the browser. SVG is an image
+// that can carry scripts, so it isn't.
+func inlineContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "text/plain" || strings.HasPrefix(mediaType, "image/") && mediaType != "image/svg+xml"
+}
+
+// infoHandler shows the metadata of an object, without downloading it.
+func (t *s3Target) infoHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling a request in the S3 info handler", "target", t.name, logging.RemoteKey, r.RemoteAddr)
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "Provide the key of the object", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := demoContext(r, t.timeout)
+	defer cancel()
+
+	client, err := t.client(ctx)
+	if err != nil {
+		demoError(ctx, w, "Failed to load AWS config", err)
+		return
+	}
+
+	start := time.Now()
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(key),
+	})
+	metrics.ObserveOutbound(t.name+"_head", start, err)
+	if err != nil {
+		demoError(ctx, w, fmt.Sprintf("Unable to get the metadata of %q in %q", key, t.bucket), err)
+		return
+	}
+
+	info := s3ObjectInfo{
+		Target:       t.name,
+		Bucket:       t.bucket,
+		Key:          key,
+		Size:         aws.ToInt64(head.ContentLength),
+		ContentType:  aws.ToString(head.ContentType),
+		LastModified: aws.ToTime(head.LastModified),
+		ETag:         aws.ToString(head.ETag),
+		StorageClass: string(head.StorageClass),
+		VersionID:    aws.ToString(head.VersionId),
+		Encryption:   string(head.ServerSideEncryption),
+		Metadata:     head.Metadata,
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := s3InfoTmpl.Execute(w, info); err != nil {
+		slog.Error("Error executing template", logging.Err(err))
+	}
+}
+
+// uploadHandler uploads a file of a form under the prefix and goes back to the listing.
+func (t *s3Target) uploadHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling a request in the S3 upload handler", "target", t.name, logging.RemoteKey, r.RemoteAddr)
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := crossOrigin.Check(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxS3Upload)
+	if err := r.ParseMultipartForm(maxS3Upload); err != nil {
+		status := http.StatusBadRequest
+		if maxBytes := (*http.MaxBytesError)(nil); errors.As(err, &maxBytes) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, fmt.Sprintf("Invalid upload: %v", err), status)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Provide a file to upload: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	prefix := r.FormValue("prefix")
+	key := prefix + path.Base(header.Filename)
+	contentType := header.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(key))
+	}
+
+	ctx, cancel := demoContext(r, t.timeout)
+	defer cancel()
+
+	client, err := t.client(ctx)
+	if err != nil {
+		demoError(ctx, w, "Failed to load AWS config", err)
+		return
+	}
+
+	start := time.Now()
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(t.bucket),
+		Key:           aws.String(key),
+		Body:          file,
+		ContentLength: aws.Int64(header.Size),
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	_, err = client.PutObject(ctx, input)
+	metrics.ObserveOutbound(t.name+"_put", start, err)
+	if err != nil {
+		demoError(ctx, w, fmt.Sprintf("Unable to upload %q to %q", key, t.bucket), err)
+		return
+	}
+
+	http.Redirect(w, r, t.browsePath(prefix), http.StatusSeeOther)
+}
+
+// deleteHandler deletes an object and goes back to the listing of its prefix.
+func (t *s3Target) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling a request in the S3 delete handler", "target", t.name, logging.RemoteKey, r.RemoteAddr)
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := crossOrigin.Check(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	key := r.FormValue("key")
+	if key == "" {
+		http.Error(w, "Provide the key of the object to delete", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := demoContext(r, t.timeout)
+	defer cancel()
+
+	client, err := t.client(ctx)
+	if err != nil {
+		demoError(ctx, w, "Failed to load AWS config", err)
+		return
+	}
+
+	start := time.Now()
+	_, err = client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(key),
+	})
+	metrics.ObserveOutbound(t.name+"_delete", start, err)
+	if err != nil {
+		demoError(ctx, w, fmt.Sprintf("Unable to delete %q from %q", key, t.bucket), err)
+		return
+	}
+
+	http.Redirect(w, r, t.browsePath(parentPrefix(key)), http.StatusSeeOther)
+}
+
+// browsePath returns the route of the listing of a prefix.
+func (t *s3Target) browsePath(prefix string) string {
+	if prefix == "" {
+		return "/" + t.name + "/browse"
+	}
+	return "/" + t.name + "/browse?prefix=" + url.QueryEscape(prefix)
+}
+
+// parentPrefix returns the prefix the key or prefix is in, "" for the top of the bucket.
+func parentPrefix(key string) string {
+	i := strings.LastIndex(strings.TrimSuffix(key, "/"), "/")
+	if i < 0 {
+		return ""
+	}
+	return key[:i+1]
+}
@@ -0,0 +1,421 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeS3Object struct {
+	body         []byte
+	contentType  string
+	lastModified time.Time
+	metadata     map[string]string
+}
+
+// fakeS3 is an in-memory stand-in for a single S3 bucket, with just enough of the API for the customer.
+type fakeS3 struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string]fakeS3Object
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{bucket: bucket, objects: map[string]fakeS3Object{}}
+}
+
+type fakeS3ListResult struct {
+	XMLName  xml.Name `xml:"ListBucketResult"`
+	Name     string
+	Prefix   string
+	KeyCount int
+	Contents []struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated bool
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.bucket {
+		http.Error(w, "<Error><Code>NoSuchBucket</Code></Error>", http.StatusNotFound)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key == "" && r.Method == http.MethodGet {
+		s.list(w, r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		metadata := map[string]string{}
+		for name, values := range r.Header {
+			if meta, ok := strings.CutPrefix(strings.ToLower(name), "x-amz-meta-"); ok {
+				metadata[meta] = values[0]
+			}
+		}
+		s.objects[key] = fakeS3Object{body: body, contentType: r.Header.Get("Content-Type"), lastModified: time.Now().UTC().Truncate(time.Second), metadata: metadata}
+		w.Header().Set("ETag", etag(body))
+	case http.MethodGet, http.MethodHead:
+		object, ok := s.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprint(w, "<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>")
+			}
+			return
+		}
+		w.Header().Set("Content-Type", object.contentType)
+		w.Header().Set("Content-Length", fmt.Sprint(len(object.body)))
+		w.Header().Set("Last-Modified", object.lastModified.Format(http.TimeFormat))
+		w.Header().Set("ETag", etag(object.body))
+		w.Header().Set("X-Amz-Checksum-Crc32", checksumCRC32(object.body))
+		for name, value := range object.metadata {
+			w.Header().Set("X-Amz-Meta-"+name, value)
+		}
+		if r.Method == http.MethodGet {
+			w.Write(object.body)
+		}
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, prefix, delimiter string) {
+	result := fakeS3ListResult{Name: s.bucket, Prefix: prefix}
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	seen := map[string]bool{}
+	for _, key := range keys {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			folder := prefix + rest[:i+len(delimiter)]
+			if !seen[folder] {
+				seen[folder] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, struct{ Prefix string }{folder})
+			}
+			continue
+		}
+		result.Contents = append(result.Contents, struct {
+			Key          string
+			Size         int
+			LastModified string
+		}{key, len(s.objects[key].body), s.objects[key].lastModified.Format(time.RFC3339)})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (s *fakeS3) object(key string) (fakeS3Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, ok := s.objects[key]
+	return object, ok
+}
+
+// checksumCRC32 is the checksum the SDK validates downloads with.
+func checksumCRC32(body []byte) string {
+	return base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(body)))
+}
+
+func etag(body []byte) string {
+	sum := md5.Sum(body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// startFakeS3 returns a target for a bucket of a fake S3, which accepts any credentials.
+func startFakeS3(t *testing.T, bucket string) (*s3Target, *fakeS3) {
+	fake := newFakeS3(bucket)
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	target := newS3Target(Target{Name: "aws", Type: TargetS3, Address: bucket, Options: map[string]string{"endpoint": server.URL, "path-style": "true"}}, nil)
+	target.credentials = aws.AnonymousCredentials{}
+	return target, fake
+}
+
+// upload posts a file to the upload handler like the form of the page.
+func upload(t *testing.T, target *s3Target, prefix, filename, contentType, content string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	require.NoError(t, form.WriteField("prefix", prefix))
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, filename))
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	part, err := form.CreatePart(header)
+	require.NoError(t, err)
+	_, err = part.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, form.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/aws/browse/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rr := httptest.NewRecorder()
+	target.uploadHandler(rr, req)
+	return rr
+}
+
+func TestS3Browser(t *testing.T) {
+	target, fake := startFakeS3(t, "demo-bucket")
+
+	rr := upload(t, target, "reports/", "q1.csv", "text/csv", "quarter,total\nq1,42\n")
+	require.Equal(t, http.StatusSeeOther, rr.Code, rr.Body.String())
+	assert.Equal(t, "/aws/browse?prefix=reports%2F", rr.Header().Get("Location"))
+	object, ok := fake.object("reports/q1.csv")
+	require.True(t, ok)
+	assert.Equal(t, "text/csv", object.contentType)
+
+	// Without a content type in the form it comes from the extension.
+	require.Equal(t, http.StatusSeeOther, upload(t, target, "", "index.html", "", "<h1>hi</h1>").Code)
+	object, _ = fake.object("index.html")
+	assert.Contains(t, object.contentType, "text/html")
+
+	rr = httptest.NewRecorder()
+	target.browseHandler(rr, httptest.NewRequest(http.MethodGet, "/aws/browse", nil))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), `<a href="/aws/browse?prefix=reports%2f">reports/</a>`)
+	assert.Contains(t, rr.Body.String(), `<a href="/aws/browse/object?key=index.html">index.html</a>`)
+
+	rr = httptest.NewRecorder()
+	target.browseHandler(rr, httptest.NewRequest(http.MethodGet, "/aws/browse?prefix=reports/", nil))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), `>q1.csv</a>`)
+	assert.Contains(t, rr.Body.String(), `<td>20</td>`)
+	assert.Contains(t, rr.Body.String(), `<a href="/aws/browse?prefix=">..</a>`)
+
+	rr = httptest.NewRecorder()
+	target.objectHandler(rr, httptest.NewRequest(http.MethodGet, "/aws/browse/object?key=reports/q1.csv&download=1", nil))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "quarter,total\nq1,42\n", rr.Body.String())
+	assert.Equal(t, "text/csv", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "20", rr.Header().Get("Content-Length"))
+	assert.Equal(t, `attachment; filename=q1.csv`, rr.Header().Get("Content-Disposition"))
+	assert.Equal(t, "nosniff", rr.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "sandbox", rr.Header().Get("Content-Security-Policy"))
+
+	// An uploaded page is never rendered on the origin of the customer.
+	rr = httptest.NewRecorder()
+	target.objectHandler(rr, httptest.NewRequest(http.MethodGet, "/aws/browse/object?key=index.html", nil))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, `attachment; filename=index.html`, rr.Header().Get("Content-Disposition"))
+	assert.Equal(t, "sandbox", rr.Header().Get("Content-Security-Policy"))
+
+	rr = httptest.NewRecorder()
+	target.infoHandler(rr, httptest.NewRequest(http.MethodGet, "/aws/browse/info?key=reports/q1.csv", nil))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), "<tr><th>Content type</th><td>text/csv</td></tr>")
+	assert.Contains(t, rr.Body.String(), strings.Trim(etag([]byte("quarter,total\nq1,42\n")), `"`))
+
+	req := httptest.NewRequest(http.MethodPost, "/aws/browse/delete", strings.NewReader("key=reports%2Fq1.csv"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	target.deleteHandler(rr, req)
+	require.Equal(t, http.StatusSeeOther, rr.Code, rr.Body.String())
+	assert.Equal(t, "/aws/browse?prefix=reports%2F", rr.Header().Get("Location"))
+	_, ok = fake.object("reports/q1.csv")
+	assert.False(t, ok)
+}
+
+func TestS3BrowserRejectsCrossSiteForms(t *testing.T) {
+	target, fake := startFakeS3(t, "demo-bucket")
+	require.Equal(t, http.StatusSeeOther, upload(t, target, "", "a.txt", "text/plain", "a").Code)
+
+	// A form on another site posts with the credentials of the customer, the browser says where it comes from.
+	req := httptest.NewRequest(http.MethodPost, "/aws/browse/delete", strings.NewReader("key=a.txt"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	rr := httptest.NewRecorder()
+	target.deleteHandler(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	_, ok := fake.object("a.txt")
+	assert.True(t, ok, "the object isn't deleted")
+
+	req = httptest.NewRequest(http.MethodPost, "/aws/browse/upload", strings.NewReader("not a form"))
+	req.Header.Set("Origin", "https://evil.org")
+	rr = httptest.NewRecorder()
+	target.uploadHandler(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestS3BrowserErrors(t *testing.T) {
+	target, _ := startFakeS3(t, "demo-bucket")
+
+	rr := httptest.NewRecorder()
+	target.objectHandler(rr, httptest.NewRequest(http.MethodGet, "/aws/browse/object?key=missing", nil))
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Contains(t, rr.Body.String(), `Unable to get "missing" from "demo-bucket"`)
+
+	rr = httptest.NewRecorder()
+	target.objectHandler(rr, httptest.NewRequest(http.MethodGet, "/aws/browse/object", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = httptest.NewRecorder()
+	target.deleteHandler(rr, httptest.NewRequest(http.MethodGet, "/aws/browse/delete?key=a", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+
+	rr = httptest.NewRecorder()
+	target.uploadHandler(rr, httptest.NewRequest(http.MethodPost, "/aws/browse/upload", strings.NewReader("not a form")))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// A bucket the credentials can't reach.
+	target.bucket = "other-bucket"
+	rr = httptest.NewRecorder()
+	target.browseHandler(rr, httptest.NewRequest(http.MethodGet, "/aws/browse", nil))
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Contains(t, rr.Body.String(), `Unable to list "" in "other-bucket"`)
+}
+
+func TestS3TargetEndpoint(t *testing.T) {
+	// The existing demos and the probe use the endpoint too.
+	target, fake := startFakeS3(t, "demo-bucket")
+	assert.Error(t, target.probe(context.Background()))
+
+	rr := httptest.NewRecorder()
+	target.putHandler(rr, httptest.NewRequest(http.MethodGet, "/aws/put", nil))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	_, ok := fake.object("testfile")
+	assert.True(t, ok)
+	assert.NoError(t, target.probe(context.Background()))
+
+	rr = httptest.NewRecorder()
+	target.retrievalHandler(rr, httptest.NewRequest(http.MethodGet, "/aws", nil))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), "This is a test to write to an S3 bucket")
+}
+
+func TestInlineContentType(t *testing.T) {
+	for contentType, inline := range map[string]bool{
+		"text/plain; charset=utf-8": true,
+		"image/png":                 true,
+		"image/svg+xml":             false,
+		"text/html":                 false,
+		"application/xhtml+xml":     false,
+		"application/octet-stream":  false,
+		"":                          false,
+	} {
+		assert.Equal(t, inline, inlineContentType(contentType), contentType)
+	}
+}
+
+func TestParentPrefix(t *testing.T) {
+	tests := map[string]string{
+		"":              "",
+		"file":          "",
+		"reports/":      "",
+		"reports/q1":    "reports/",
+		"a/b/":          "a/",
+		"a/b/c.txt":     "a/b/",
+		"reports//q1":   "reports//",
+		"reports/2024/": "reports/",
+	}
+	for key, want := range tests {
+		assert.Equal(t, want, parentPrefix(key), key)
+	}
+}
+
+// countingCredentials hands out credentials that are valid for an hour and counts how often it is asked.
+type countingCredentials struct {
+	mu    sync.Mutex
+	count int
+}
+
+func (c *countingCredentials) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.count++
+	return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret", CanExpire: true, Expires: time.Now().Add(time.Hour)}, nil
+}
+
+func (c *countingCredentials) calls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.count
+}
+
+func TestS3TargetReusesClient(t *testing.T) {
+	target, _ := startFakeS3(t, "demo-bucket")
+	credentials := &countingCredentials{}
+	target.credentials = credentials
+
+	first, err := target.client(context.Background())
+	require.NoError(t, err)
+	second, err := target.client(context.Background())
+	require.NoError(t, err)
+	assert.Same(t, first, second)
+
+	// Every demo uses the same client, so the credentials are only fetched once.
+	for range 3 {
+		rr := httptest.NewRecorder()
+		target.putHandler(rr, httptest.NewRequest(http.MethodGet, "/aws/put", nil))
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		rr = httptest.NewRecorder()
+		target.browseHandler(rr, httptest.NewRequest(http.MethodGet, "/aws/browse", nil))
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	}
+	assert.Equal(t, 1, credentials.calls())
+}
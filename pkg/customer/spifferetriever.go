@@ -16,16 +16,16 @@ limitations under the License.
 package customer
 
 import (
-	"context"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/json"
 	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
-	"time"
 
+	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
 )
 
@@ -122,16 +122,15 @@ const htmlTemplate = `
 
 // Based upon https://github.com/spiffe/go-spiffe/tree/main/v2/examples/spiffe-watcher but instead of watching for changes it fetches them upon a web request.
 func (c *CustomerService) spiffeRetriever(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Handling a request in the SPIFFE Retriever from %s", r.RemoteAddr)
-	ctx := context.Background()
-	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	slog.Debug("Handling a request in the SPIFFE retriever", logging.RemoteKey, r.RemoteAddr)
+	ctx, cancel := demoContext(r, common.DefaultTimeout)
 	defer cancel()
 
 	// Create a `workloadapi.New`, it will connect to Workload API using provided socket path.
 	// If socket path is not defined using `workloadapi.New`, value from environment variable `SPIFFE_ENDPOINT_SOCKET` is used.
 	client, err := workloadapi.New(ctx)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Unable to create workload API client: %v", err), http.StatusInternalServerError)
+		demoError(ctx, w, "Unable to create workload API client", err)
 		return
 	}
 	defer client.Close()
@@ -139,7 +138,7 @@ func (c *CustomerService) spiffeRetriever(w http.ResponseWriter, r *http.Request
 	// Fetch its own X.509 SVID from the Workload API.
 	x509SVIDs, err := client.FetchX509SVIDs(ctx)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Unable to fetch X.509 SVIDs: %v", err), http.StatusInternalServerError)
+		demoError(ctx, w, "Unable to fetch X.509 SVIDs", err)
 		return
 	}
 
@@ -169,7 +168,7 @@ func (c *CustomerService) spiffeRetriever(w http.ResponseWriter, r *http.Request
 	// Fetch the JWT bundles from the Workload API.
 	JWTBundles, err := client.FetchJWTBundles(ctx)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Unable to fetch JWT Bundles: %v", err), http.StatusInternalServerError)
+		demoError(ctx, w, "Unable to fetch JWT Bundles", err)
 		return
 	}
 
@@ -0,0 +1,276 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Types of targets the customer can demo.
+const (
+	// TargetMTLSHTTP is an HTTP server that speaks SPIFFE mTLS, natively or through a proxy like Envoy.
+	TargetMTLSHTTP = "mtls-http"
+	// TargetPostgres is a PostgreSQL database that authenticates the customer with its X.509-SVID.
+	TargetPostgres = "postgres"
+	// TargetS3 is an AWS S3 bucket.
+	TargetS3 = "s3"
+	// TargetGCS is a Google Cloud Storage bucket.
+	TargetGCS = "gcs"
+)
+
+var targetTypes = []string{TargetMTLSHTTP, TargetPostgres, TargetS3, TargetGCS}
+
+// Names of targets become routes, so they have to be a single path segment.
+var targetName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Routes of the customer itself, which targets can't use as their name.
+var reservedNames = []string{"breakers", "chain", "console", "handshakefailures", "matrix", "metrics", "orders", "spifferetriever", "ws"}
+
+// Config describes the targets the customer shows on its page.
+//
+// An example config:
+//
+//	targets:
+//	- name: mtls
+//	  type: mtls-http
+//	  description: SPIFFE Native mTLS
+//	  address: https://backend:8443
+//	  spiffeId: spiffe://example.org/backend
+//	- name: orders-db
+//	  type: postgres
+//	  description: the orders database
+//	  address: postgres.example.org
+//	  options:
+//	    user: customer
+//	    database: orders
+type Config struct {
+	Targets []Target `yaml:"targets"`
+}
+
+// Target is something the customer connects to with its SPIFFE identity.
+type Target struct {
+	// Name of the target, the demos of the target are served under /<name>.
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	// Description is shown on the buttons of the page.
+	Description string `yaml:"description"`
+	// Address is the URL of an mTLS HTTP server, the host of a database or the name of a bucket.
+	Address string `yaml:"address"`
+	// SPIFFEID is the SPIFFE ID the target has to present. When a database has none, any certificate
+	// signed by the trust bundle is accepted.
+	SPIFFEID string `yaml:"spiffeId"`
+	// Options are specific to the type of the target, except for the timeout of its demos (10s).
+	//   postgres: user (required), database (testdb), port (5432)
+	//   s3: region (eu-west-2), filepath (testfile), endpoint, path-style (false), role-arn, auth (jwt), audience (demo), sts-endpoint,
+	//       trust-anchor-arn, profile-arn, rolesanywhere-endpoint. With a role-arn the customer exchanges its
+	//       SVID for credentials of the role itself: a JWT-SVID with STS, or with auth x509 its X509-SVID
+	//       with IAM Roles Anywhere, which needs the trust-anchor-arn and profile-arn.
+	//   gcs: object (Hello), proxy (http://localhost:8080)
+	Options map[string]string `yaml:"options"`
+}
+
+// demo is an action of a target that gets a route and a button on the page.
+type demo struct {
+	Path  string
+	Label string
+	// Window demos are a page of their own, the button opens them in a new window instead of showing the
+	// response below the buttons.
+	Window bool
+	// Hidden demos only get a route, like the actions of a Window demo.
+	Hidden  bool
+	handler http.HandlerFunc
+}
+
+// LoadConfig reads and validates a config file.
+func LoadConfig(file string) (*Config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config: %w", err)
+	}
+	return ParseConfig(data)
+}
+
+// ParseConfig parses and validates a config in YAML.
+func ParseConfig(data []byte) (*Config, error) {
+	config := &Config{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("unable to parse config: %w", err)
+	}
+
+	for _, target := range config.Targets {
+		if target.Address == "" {
+			return nil, fmt.Errorf("target %q needs an address", target.Name)
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate checks the targets of the config. Targets without an address are skipped, like the targets of the
+// individual flags of the customer that aren't set. A config file needs an address for every target.
+func (c *Config) Validate() error {
+	seen := map[string]bool{}
+	for _, target := range c.Targets {
+		if seen[target.Name] {
+			return fmt.Errorf("duplicate target %q", target.Name)
+		}
+		seen[target.Name] = true
+		if target.Address == "" {
+			continue
+		}
+		if err := target.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t Target) validate() error {
+	if !targetName.MatchString(t.Name) {
+		return fmt.Errorf("invalid target name %q, use lower case letters, digits, - and _", t.Name)
+	}
+	if slices.Contains(reservedNames, t.Name) {
+		return fmt.Errorf("target name %q is already used by the customer", t.Name)
+	}
+	if !slices.Contains(targetTypes, t.Type) {
+		return fmt.Errorf("target %q has unknown type %q, use one of %v", t.Name, t.Type, targetTypes)
+	}
+	if value := t.option("timeout", ""); value != "" {
+		if timeout, err := time.ParseDuration(value); err != nil || timeout <= 0 {
+			return fmt.Errorf("target %q has invalid timeout %q", t.Name, value)
+		}
+	}
+
+	switch t.Type {
+	case TargetMTLSHTTP:
+		if t.SPIFFEID == "" {
+			return fmt.Errorf("target %q needs the SPIFFE ID of the server", t.Name)
+		}
+	case TargetPostgres:
+		if t.option("user", "") == "" {
+			return fmt.Errorf("target %q needs the user option", t.Name)
+		}
+	case TargetS3:
+		if _, err := strconv.ParseBool(t.option("path-style", "false")); err != nil {
+			return fmt.Errorf("target %q has invalid path-style %q, use true or false", t.Name, t.option("path-style", ""))
+		}
+		return t.validateAWSAuth()
+	}
+	return nil
+}
+
+// validateAWSAuth checks the options of an S3 target that exchanges its SVID for credentials of a role.
+func (t Target) validateAWSAuth() error {
+	auth := t.option("auth", AWSAuthJWT)
+	if !slices.Contains(AWSAuths, auth) {
+		return fmt.Errorf("target %q has unknown auth %q, use one of %v", t.Name, auth, AWSAuths)
+	}
+	if auth == AWSAuthX509 && t.option("role-arn", "") != "" && (t.option("trust-anchor-arn", "") == "" || t.option("profile-arn", "") == "") {
+		return fmt.Errorf("target %q needs the trust-anchor-arn and profile-arn options for IAM Roles Anywhere", t.Name)
+	}
+	return nil
+}
+
+// option returns an option of the target, or the fallback when it isn't set.
+func (t Target) option(key, fallback string) string {
+	if value, ok := t.Options[key]; ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+func (t Target) description() string {
+	if t.Description != "" {
+		return t.Description
+	}
+	return t.Name
+}
+
+// demos returns the actions of a target, in the order they are shown on the page. The demos make their
+// outbound calls with the source and the clients of the pool, and the client of the target.
+func (t Target) demos(pool *clientPool, clients *targetClients) []demo {
+	path := "/" + t.Name
+
+	switch t.Type {
+	case TargetMTLSHTTP:
+		return []demo{
+			{Path: path, Label: t.description(), handler: mTLSTargetHandler(pool, t)},
+		}
+	case TargetPostgres:
+		db := clients.postgres[t.Name]
+		return []demo{
+			{Path: path + "/put", Label: "Write to " + t.description(), handler: db.putHandler},
+			{Path: path, Label: "Retrieve from " + t.description(), handler: db.retrievalHandler},
+		}
+	case TargetS3:
+		bucket := clients.s3[t.Name]
+		return []demo{
+			{Path: path + "/put", Label: "Write a file to " + t.description(), handler: bucket.putHandler},
+			{Path: path, Label: "Retrieve a file from " + t.description(), handler: bucket.retrievalHandler},
+			{Path: path + "/browse", Label: "Browse " + t.description(), Window: true, handler: bucket.browseHandler},
+			{Path: path + "/browse/object", Hidden: true, handler: bucket.objectHandler},
+			{Path: path + "/browse/info", Hidden: true, handler: bucket.infoHandler},
+			{Path: path + "/browse/upload", Hidden: true, handler: bucket.uploadHandler},
+			{Path: path + "/browse/delete", Hidden: true, handler: bucket.deleteHandler},
+		}
+	case TargetGCS:
+		bucket := clients.gcs[t.Name]
+		return []demo{
+			{Path: path + "/put", Label: "Write a file to " + t.description(), handler: bucket.putHandler},
+			{Path: path, Label: "Retrieve a file from " + t.description(), handler: bucket.retrievalHandler},
+		}
+	}
+	return nil
+}
+
+// targetClients are the clients of the postgres, s3 and gcs targets, by the name of the target. They are created
+// once, so the demos, the probes and the page share the connections and the cached credentials of a target.
+type targetClients struct {
+	postgres map[string]*postgresTarget
+	s3       map[string]*s3Target
+	gcs      map[string]*gcsTarget
+}
+
+// newTargetClients creates the clients of the targets. The X509-SVID is only used by s3 targets that authenticate
+// with IAM Roles Anywhere, the pool only by the postgres targets.
+func newTargetClients(targets []Target, pool *clientPool, svid svidFunc) *targetClients {
+	clients := &targetClients{
+		postgres: map[string]*postgresTarget{},
+		s3:       map[string]*s3Target{},
+		gcs:      map[string]*gcsTarget{},
+	}
+	for _, target := range targets {
+		switch target.Type {
+		case TargetPostgres:
+			clients.postgres[target.Name] = newPostgresTarget(target, pool)
+		case TargetS3:
+			clients.s3[target.Name] = newS3Target(target, svid)
+		case TargetGCS:
+			clients.gcs[target.Name] = newGCSTarget(target)
+		}
+	}
+	return clients
+}
@@ -0,0 +1,121 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testConfig = `
+targets:
+- name: mtls
+  type: mtls-http
+  description: SPIFFE Native mTLS
+  address: https://backend:8443
+  spiffeId: spiffe://example.org/backend
+- name: orders-db
+  type: postgres
+  description: the orders database
+  address: postgres.example.org
+  options:
+    user: customer
+    database: orders
+- name: reports
+  type: s3
+  address: reports-bucket
+`
+
+func demoPaths(config *Config) []string {
+	var paths []string
+	clients := newTargetClients(config.Targets, nil, nil)
+	for _, target := range config.Targets {
+		for _, demo := range target.demos(nil, clients) {
+			paths = append(paths, demo.Path)
+		}
+	}
+	return paths
+}
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig([]byte(testConfig))
+	require.NoError(t, err)
+	require.Len(t, config.Targets, 3)
+
+	assert.Equal(t, []string{
+		"/mtls", "/orders-db/put", "/orders-db", "/reports/put", "/reports",
+		"/reports/browse", "/reports/browse/object", "/reports/browse/info", "/reports/browse/upload", "/reports/browse/delete",
+	}, demoPaths(config))
+
+	clients := newTargetClients(config.Targets, nil, nil)
+	require.Len(t, clients.postgres, 1)
+	require.Len(t, clients.s3, 1)
+	assert.Empty(t, clients.gcs)
+
+	db := clients.postgres["orders-db"]
+	assert.Equal(t, "orders", db.database)
+	assert.Equal(t, "5432", db.port, "options that aren't set should get their default")
+
+	bucket := clients.s3["reports"]
+	assert.Equal(t, "reports-bucket", bucket.bucket)
+	assert.Equal(t, "eu-west-2", bucket.region)
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	tests := map[string]string{
+		"unknown type":       `targets: [{name: a, type: ftp, address: x}]`,
+		"invalid name":       `targets: [{name: "a/b", type: s3, address: x}]`,
+		"reserved name":      `targets: [{name: orders, type: s3, address: x}]`,
+		"missing address":    `targets: [{name: a, type: s3}]`,
+		"missing SPIFFE ID":  `targets: [{name: a, type: mtls-http, address: https://a}]`,
+		"missing user":       `targets: [{name: a, type: postgres, address: db}]`,
+		"duplicate name":     `targets: [{name: a, type: s3, address: x}, {name: a, type: gcs, address: y}]`,
+		"unknown AWS auth":   `targets: [{name: a, type: s3, address: x, options: {auth: keys}}]`,
+		"x509 without ARNs":  `targets: [{name: a, type: s3, address: x, options: {auth: x509, role-arn: arn}}]`,
+		"invalid path-style": `targets: [{name: a, type: s3, address: x, options: {path-style: maybe}}]`,
+		"invalid YAML":       `targets: {`,
+	}
+	for name, config := range tests {
+		_, err := ParseConfig([]byte(config))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestWebpageShowsTargets(t *testing.T) {
+	config, err := ParseConfig([]byte(testConfig))
+	require.NoError(t, err)
+	c := &CustomerService{targets: config.Targets, clients: newTargetClients(config.Targets, nil, nil)}
+
+	rr := httptest.NewRecorder()
+	c.webpageHandler(rr, httptest.NewRequest("GET", "/", nil))
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	body := rr.Body.String()
+	assert.Contains(t, body, "SPIFFE Native mTLS")
+	assert.Contains(t, body, "Write to the orders database")
+	assert.Contains(t, body, "Retrieve a file from reports")
+	assert.Contains(t, body, `makeRequest(&#34;/orders-db/put&#34;, &#34;demo1&#34;)`)
+	assert.Contains(t, body, `id="demo1"`)
+
+	// The browser of the bucket opens in a new window, its actions get no button.
+	assert.Contains(t, body, `window.open(&#34;/reports/browse&#34;, '_blank')`)
+	assert.NotContains(t, body, "/reports/browse/delete")
+	assert.NotContains(t, body, `id="demo5"`)
+}
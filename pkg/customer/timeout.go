@@ -0,0 +1,77 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+)
+
+// How long a demo of a target may take, unless the target sets the timeout option.
+const defaultDemoTimeout = 10 * time.Second
+
+// timeout returns how long a demo of the target may take. The option is validated when the config is parsed.
+func (t Target) timeout() time.Duration {
+	timeout, err := time.ParseDuration(t.option("timeout", ""))
+	if err != nil || timeout <= 0 {
+		return defaultDemoTimeout
+	}
+	return timeout
+}
+
+// demoContext derives the context of a demo from the request, so the outbound calls stop as soon as the
+// browser goes away or the demo takes longer than its timeout.
+func demoContext(r *http.Request, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// demoError reports the failure of a demo with the status of errorStatus. When the browser went away nobody
+// reads the response anymore, so it is only logged.
+func demoError(ctx context.Context, w http.ResponseWriter, message string, err error) {
+	switch status := errorStatus(ctx, err); status {
+	case 0:
+		slog.Info(message+", the request was canceled", logging.Err(err))
+	case http.StatusGatewayTimeout:
+		http.Error(w, fmt.Sprintf("%s: timed out: %v", message, err), status)
+	default:
+		http.Error(w, fmt.Sprintf("%s: %v", message, err), status)
+	}
+}
+
+// errorStatus returns the status of a failed demo. Running out of time is a 504, so it can be told apart from
+// the target failing, and an open circuit breaker is a 503. A 403 or 404 of the target is passed on, as it
+// is the answer of the target and not a failure of the demo. It is 0 when the request was canceled.
+func errorStatus(ctx context.Context, err error) int {
+	var upstream *upstreamStatusError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, errBreakerOpen):
+		return http.StatusServiceUnavailable
+	case errors.As(err, &upstream) && (upstream.Status == http.StatusForbidden || upstream.Status == http.StatusNotFound):
+		return upstream.Status
+	case errors.Is(ctx.Err(), context.Canceled):
+		return 0
+	default:
+		return http.StatusInternalServerError
+	}
+}
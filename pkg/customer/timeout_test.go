@@ -0,0 +1,84 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDemoErrorStatus(t *testing.T) {
+	r := httptest.NewRequest("GET", "/mtls", nil)
+
+	// The demo ran out of time, even when the error doesn't say so.
+	ctx, cancel := demoContext(r, time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	rr := httptest.NewRecorder()
+	demoError(ctx, rr, "Error connecting", errors.New("read: connection reset"))
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+
+	// The target timed out by itself.
+	rr = httptest.NewRecorder()
+	demoError(context.Background(), rr, "Error connecting", fmt.Errorf("dial: %w", context.DeadlineExceeded))
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+
+	rr = httptest.NewRecorder()
+	demoError(context.Background(), rr, "Error connecting", errors.New("x509svid: could not verify leaf certificate"))
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Error connecting: x509svid")
+
+	// The answer of the target is passed on.
+	for _, status := range []int{http.StatusForbidden, http.StatusNotFound} {
+		rr = httptest.NewRecorder()
+		demoError(context.Background(), rr, "Unable to update the order", fmt.Errorf("orders: %w", &upstreamStatusError{Status: status, err: errors.New("denied")}))
+		assert.Equal(t, status, rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	demoError(context.Background(), rr, "Unable to update the order", &upstreamStatusError{Status: http.StatusBadGateway, err: errors.New("bad gateway")})
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+}
+
+func TestDemoErrorCanceledRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("GET", "/mtls", nil).WithContext(ctx)
+	demoCtx, demoCancel := demoContext(r, time.Minute)
+	defer demoCancel()
+
+	// Closing the browser tab cancels the request and with it the demo.
+	cancel()
+	require.ErrorIs(t, demoCtx.Err(), context.Canceled)
+
+	rr := httptest.NewRecorder()
+	demoError(demoCtx, rr, "Error connecting", demoCtx.Err())
+	assert.Empty(t, rr.Body.String(), "nobody reads the response of a canceled request")
+}
+
+func TestTargetTimeout(t *testing.T) {
+	assert.Equal(t, defaultDemoTimeout, Target{}.timeout())
+	assert.Equal(t, 2*time.Second, Target{Options: map[string]string{"timeout": "2s"}}.timeout())
+
+	_, err := ParseConfig([]byte(`targets: [{name: a, type: s3, address: x, options: {timeout: soon}}]`))
+	assert.Error(t, err)
+}
@@ -17,24 +17,28 @@ package customer
 
 import (
 	"embed"
-	"io/fs"
-	"log"
+	"html/template"
+	"log/slog"
 	"net/http"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
 )
 
 //go:embed index.html
 var content embed.FS
 
+var webpageTmpl = template.Must(template.ParseFS(content, "index.html"))
+
 // Main webpage of the customer service. This is the starting point where all the demos can be executed from within the browser.
+// The buttons of the targets are generated from the config.
 func (c *CustomerService) webpageHandler(w http.ResponseWriter, r *http.Request) {
-	data, err := fs.ReadFile(content, "index.html")
-	if err != nil {
-		http.Error(w, "Could not read requested file", http.StatusInternalServerError)
-		return
+	var demos []demo
+	for _, target := range c.targets {
+		demos = append(demos, target.demos(c.pool, c.clients)...)
 	}
 
 	w.Header().Set("Content-Type", "text/html")
-	if _, err := w.Write(data); err != nil {
-		log.Printf("Error writing response: %v", err)
+	if err := webpageTmpl.Execute(w, struct{ Demos []demo }{Demos: demos}); err != nil {
+		slog.Error("Error executing template", logging.Err(err))
 	}
 }
@@ -0,0 +1,266 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+// How often the customer checks whether its own SVID was rotated during a session.
+const rotationCheckInterval = 5 * time.Second
+
+var browserUpgrader = websocket.Upgrader{}
+
+// Message the customer sends to the browser about its own SVID.
+type localSVIDMessage struct {
+	Type          string `json:"type"`
+	SessionSerial string `json:"sessionSerial"`
+	CurrentSerial string `json:"currentSerial"`
+	Rotated       bool   `json:"rotated"`
+}
+
+const webSocketPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<title>SPIFFE WebSocket session</title>
+	<style>
+		body { font-family: Arial, sans-serif; max-width: 800px; margin: auto; padding: 20px; }
+		#log { border: 1px solid #ddd; padding: 10px; height: 400px; overflow-y: scroll; font-family: monospace; font-size: 0.9em; }
+		.rotated { color: #b35900; }
+		.expired { color: red; }
+	</style>
+</head>
+<body>
+	<h1>SPIFFE WebSocket session</h1>
+	<p>The customer keeps a WebSocket session open with the backend over SPIFFE mTLS. The backend binds the session to the SPIFFE ID and certificate presented during the TLS handshake.</p>
+	<input id="message" type="text" placeholder="Message to send to the backend">
+	<button onclick="send()">Send</button>
+	<div id="log"></div>
+	<script>
+		const log = document.getElementById('log');
+		const scheme = window.location.protocol === 'https:' ? 'wss://' : 'ws://';
+		const socket = new WebSocket(scheme + window.location.host + '/ws/stream');
+		function append(text, className) {
+			const line = document.createElement('div');
+			line.textContent = new Date().toLocaleTimeString() + ' ' + text;
+			if (className) { line.className = className; }
+			log.appendChild(line);
+			log.scrollTop = log.scrollHeight;
+		}
+		socket.onmessage = function(event) {
+			const msg = JSON.parse(event.data);
+			if (msg.type === 'local') {
+				if (msg.rotated) {
+					append('Customer SVID rotated to serial ' + msg.currentSerial + ', the session still uses serial ' + msg.sessionSerial, 'rotated');
+				}
+				return;
+			}
+			let text = '[' + msg.type + '] peer=' + msg.peerId + ' serial=' + msg.peerSerial + ' notAfter=' + msg.peerNotAfter;
+			if (msg.text) { text += ' : ' + msg.text; }
+			append(text, msg.type === 'expired' ? 'expired' : '');
+		};
+		socket.onclose = function(event) { append('Session closed (' + event.code + ') ' + event.reason, 'expired'); };
+		function send() {
+			socket.send(document.getElementById('message').value);
+		}
+	</script>
+</body>
+</html>
+`
+
+// Serves the page that shows a WebSocket session with the backend.
+func (c *CustomerService) webSocketPageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	if _, err := fmt.Fprint(w, webSocketPage); err != nil {
+		slog.Error("Error writing response", logging.Err(err))
+	}
+}
+
+// Bridges a WebSocket session from the browser to a WebSocket session with the backend over SPIFFE mTLS.
+//
+// SPIFFE CONCEPT: SVID Rotation and Long-Lived Connections
+// The X509Source always hands out the latest SVID, but only to new TLS handshakes. The session with the backend
+// keeps using the certificate that was presented when it was opened. The customer shows when its SVID rotates,
+// so you can see the session is still bound to the old certificate until the backend closes it at expiry.
+func (c *CustomerService) webSocketStreamHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling a request in the WebSocket stream handler", logging.RemoteKey, r.RemoteAddr)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	browser, err := browserUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Warn("Unable to upgrade the browser connection", logging.Err(err))
+		return
+	}
+	defer browser.Close()
+
+	sourceCtx, sourceCancel := context.WithTimeout(ctx, common.DefaultTimeout)
+	source, err := c.pool.x509Source(sourceCtx)
+	sourceCancel()
+	if err != nil {
+		closeWithError(browser, fmt.Sprintf("Unable to get an X509Source: %v", err))
+		return
+	}
+
+	backendConn, sessionSerial, err := c.dialBackendWebSocket(ctx, source)
+	if err != nil {
+		closeWithError(browser, err.Error())
+		return
+	}
+	defer backendConn.Close()
+
+	// Forward everything the browser sends to the backend.
+	go func() {
+		defer cancel()
+		for {
+			messageType, data, err := browser.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := backendConn.WriteMessage(messageType, data); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Forward everything the backend sends to the browser. This goroutine and the rotation check below
+	// both write to the browser, so the writes are serialized through a channel.
+	toBrowser := make(chan any)
+	go func() {
+		defer cancel()
+		for {
+			var message common.SessionMessage
+			if err := backendConn.ReadJSON(&message); err != nil {
+				// Let the browser know why the backend closed the session.
+				if closeErr, ok := err.(*websocket.CloseError); ok {
+					select {
+					case toBrowser <- closeErr:
+					case <-ctx.Done():
+					}
+				}
+				return
+			}
+			select {
+			case toBrowser <- message:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(rotationCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message := <-toBrowser:
+			if closeErr, ok := message.(*websocket.CloseError); ok {
+				closeWithError(browser, closeErr.Text)
+				return
+			}
+			if err := browser.WriteJSON(message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			svid, err := source.GetX509SVID()
+			if err != nil {
+				continue
+			}
+			currentSerial := svid.Certificates[0].SerialNumber.String()
+			if err := browser.WriteJSON(localSVIDMessage{
+				Type:          "local",
+				SessionSerial: sessionSerial,
+				CurrentSerial: currentSerial,
+				Rotated:       currentSerial != sessionSerial,
+			}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// dialBackendWebSocket opens a WebSocket session with the backend over SPIFFE mTLS. It returns the serial number
+// of the SVID the customer presented during the handshake.
+func (c *CustomerService) dialBackendWebSocket(ctx context.Context, source probeSource) (*websocket.Conn, string, error) {
+	serverID, err := spiffeid.FromString(c.spiffeAuthz)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid SPIFFE ID configuration: %w", err)
+	}
+
+	wsURL, err := url.Parse(c.backendService)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid backend address %q: %w", c.backendService, err)
+	}
+	wsURL.Scheme = "wss"
+	wsURL = wsURL.JoinPath(common.WebSocketPath)
+
+	// The SVID can rotate at any time, so the serial comes from the certificate the handshake presented.
+	tlsConfig := tlsconfig.MTLSClientConfig(source, source, tlsconfig.AuthorizeID(serverID))
+	var presented *tls.Certificate
+	getClientCertificate := tlsConfig.GetClientCertificate
+	tlsConfig.GetClientCertificate = func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		cert, err := getClientCertificate(info)
+		presented = cert
+		return cert, err
+	}
+
+	dialer := websocket.Dialer{
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: common.DefaultTimeout,
+	}
+	conn, _, err := dialer.DialContext(ctx, wsURL.String(), nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("error opening a WebSocket session with %q: %w", wsURL, err)
+	}
+
+	if presented == nil || len(presented.Certificate) == 0 {
+		conn.Close()
+		return nil, "", errors.New("the handshake with the backend presented no client certificate")
+	}
+	leaf, err := x509.ParseCertificate(presented.Certificate[0])
+	if err != nil {
+		conn.Close()
+		return nil, "", fmt.Errorf("unable to parse the presented certificate: %w", err)
+	}
+	return conn, leaf.SerialNumber.String(), nil
+}
+
+// closeWithError closes a WebSocket session with the browser and shows the reason.
+func closeWithError(conn *websocket.Conn, reason string) {
+	// Close reasons are limited to 123 bytes.
+	if len(reason) > 120 {
+		reason = reason[:120]
+	}
+	message := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, reason)
+	_ = conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+}
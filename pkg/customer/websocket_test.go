@@ -0,0 +1,65 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package customer
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/mattiasgees/spiffe-demo/internal/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// renewingSource hands out a new SVID every time, like an X509Source during a rotation.
+type renewingSource struct {
+	*x509bundle.Bundle
+	t  *testing.T
+	ca *spiffetest.CA
+}
+
+func (s renewingSource) GetX509SVID() (*x509svid.SVID, error) {
+	return s.ca.Issue(s.t, "spiffe://example.org/customer"), nil
+}
+
+func TestDialBackendWebSocketReportsThePresentedSerial(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	ca := spiffetest.NewCA(t, td)
+	bundle := x509bundle.FromX509Authorities(td, []*x509.Certificate{ca.Cert})
+
+	presented := make(chan string, 1)
+	upgrader := websocket.Upgrader{}
+	backend := startMTLSHandler(t, ca, bundle, "spiffe://example.org/backend", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented <- r.TLS.PeerCertificates[0].SerialNumber.String()
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err == nil {
+			conn.Close()
+		}
+	}))
+
+	c := &CustomerService{spiffeAuthz: "spiffe://example.org/backend", backendService: backend.URL}
+	conn, serial, err := c.dialBackendWebSocket(context.Background(), renewingSource{Bundle: bundle, t: t, ca: ca})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, <-presented, serial)
+}
@@ -0,0 +1,231 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package extauthz
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/mattiasgees/spiffe-demo/pkg/metrics"
+	"github.com/mattiasgees/spiffe-demo/pkg/xfcc"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Name of the service used in the metrics.
+const serviceName = "extauthz"
+
+// Header the server adds to allowed requests, so the upstream knows which SPIFFE ID was authorized.
+const AuthorizedIDHeader = "x-spiffe-authorized-id"
+
+// Decision is the outcome of a check. It is written to the audit log and returned as the body of a denial.
+type Decision struct {
+	Time     time.Time `json:"time"`
+	Decision string    `json:"decision"`
+	SPIFFEID string    `json:"spiffeId,omitempty"`
+	// Source tells where the SPIFFE ID came from, the principal of the TLS connection or the XFCC header.
+	Source string `json:"source,omitempty"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Rule   string `json:"rule,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// Server implements the Envoy external authorization Check API with a SPIFFE ID based policy.
+//
+// SPIFFE CONCEPT: Fine-Grained Authorization at the Proxy
+// Envoy authenticates the caller during the mTLS handshake, but its own validation context can only say
+// "this SPIFFE ID may connect". With ext_authz Envoy asks this server about every single request, with the
+// SPIFFE ID of the caller attached. That allows rules like "the customer may only GET /" without changing
+// the application behind Envoy.
+type Server struct {
+	authv3.UnimplementedAuthorizationServer
+
+	policy *Policy
+	// trustXFCC lets the XFCC header name the caller when the request has no source principal.
+	trustXFCC bool
+
+	mu    sync.Mutex
+	audit io.Writer
+}
+
+// Main function that creates the ext_authz server and starts it. This is called from the CLI.
+func StartServer(serverAddress, metricsAddress, policyFile, auditLog string, trustXFCC bool) {
+	if err := run(serverAddress, metricsAddress, policyFile, auditLog, trustXFCC); err != nil {
+		logging.Fatal("ext_authz server stopped", err)
+	}
+}
+
+func run(serverAddress, metricsAddress, policyFile, auditLog string, trustXFCC bool) error {
+	policy, err := LoadPolicy(policyFile)
+	if err != nil {
+		return err
+	}
+
+	audit := io.Writer(os.Stdout)
+	if auditLog != "" && auditLog != "-" {
+		file, err := os.OpenFile(auditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("unable to open audit log: %w", err)
+		}
+		defer file.Close()
+		audit = file
+	}
+
+	if metricsAddress != "" {
+		metrics.Serve(metricsAddress)
+	}
+
+	listener, err := net.Listen("tcp", serverAddress)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %w", serverAddress, err)
+	}
+
+	grpcServer := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(grpcServer, NewServer(policy, audit, trustXFCC))
+
+	slog.Info("Serving ext_authz", "address", serverAddress, "rules", len(policy.Rules))
+	if err := grpcServer.Serve(listener); err != nil {
+		return fmt.Errorf("failed to serve: %w", err)
+	}
+	return nil
+}
+
+// NewServer creates an ext_authz server that writes every decision to the audit writer as a JSON line. With
+// trustXFCC the server takes the caller from the XFCC header of requests without a source principal.
+func NewServer(policy *Policy, audit io.Writer, trustXFCC bool) *Server {
+	return &Server{policy: policy, audit: audit, trustXFCC: trustXFCC}
+}
+
+// Check decides whether Envoy may forward a request.
+func (s *Server) Check(_ context.Context, request *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	httpRequest := request.GetAttributes().GetRequest().GetHttp()
+	path, _, _ := strings.Cut(httpRequest.GetPath(), "?")
+
+	decision := Decision{
+		Time:   time.Now(),
+		Method: httpRequest.GetMethod(),
+		Path:   path,
+	}
+
+	id, source, err := callerID(request, s.trustXFCC)
+	if err != nil {
+		decision.Decision = ActionDeny
+		decision.Reason = err.Error()
+	} else {
+		decision.SPIFFEID = id.String()
+		decision.Source = source
+		decision.Decision, decision.Rule = s.policy.Decide(id, decision.Method, decision.Path)
+		decision.Reason = reason(decision)
+	}
+	s.record(decision)
+
+	if decision.Decision == ActionAllow {
+		return &authv3.CheckResponse{
+			Status: &status.Status{Code: int32(codes.OK)},
+			HttpResponse: &authv3.CheckResponse_OkResponse{OkResponse: &authv3.OkHttpResponse{
+				Headers: []*corev3.HeaderValueOption{header(AuthorizedIDHeader, decision.SPIFFEID)},
+			}},
+		}, nil
+	}
+
+	metrics.AuthzDenied(serviceName, decision.SPIFFEID)
+	body, err := json.Marshal(decision)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal decision: %w", err)
+	}
+	return &authv3.CheckResponse{
+		Status: &status.Status{Code: int32(codes.PermissionDenied), Message: decision.Reason},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{DeniedResponse: &authv3.DeniedHttpResponse{
+			Status:  &typev3.HttpStatus{Code: typev3.StatusCode_Forbidden},
+			Headers: []*corev3.HeaderValueOption{header("content-type", "application/json")},
+			Body:    string(body),
+		}},
+	}, nil
+}
+
+// callerID returns the SPIFFE ID of the caller. Envoy sets the source principal to the URI SAN of the client
+// certificate when it terminates mTLS itself. When ext_authz sits behind another proxy, the identity comes from
+// the XFCC header that proxy added, but only with trustXFCC. Anyone who can reach Envoy without mTLS could set
+// the header, so without a principal the request is denied by default.
+func callerID(request *authv3.CheckRequest, trustXFCC bool) (spiffeid.ID, string, error) {
+	if principal := request.GetAttributes().GetSource().GetPrincipal(); principal != "" {
+		id, err := spiffeid.FromString(principal)
+		if err != nil {
+			return spiffeid.ID{}, "", fmt.Errorf("source principal %q is not a SPIFFE ID", principal)
+		}
+		return id, "principal", nil
+	}
+	if !trustXFCC {
+		return spiffeid.ID{}, "", errors.New("the request has no source principal and the XFCC header isn't trusted")
+	}
+
+	// Envoy passes the header names in lower case.
+	header := request.GetAttributes().GetRequest().GetHttp().GetHeaders()[strings.ToLower(xfcc.Header)]
+	if header == "" {
+		return spiffeid.ID{}, "", errors.New("the request carries no SPIFFE ID")
+	}
+	elements, err := xfcc.Parse(header)
+	if err != nil {
+		return spiffeid.ID{}, "", err
+	}
+	id, err := spiffeid.FromString(elements[len(elements)-1].URI)
+	if err != nil {
+		return spiffeid.ID{}, "", fmt.Errorf("the XFCC header carries no SPIFFE ID: %w", err)
+	}
+	return id, "xfcc", nil
+}
+
+func reason(decision Decision) string {
+	if decision.Rule == "" {
+		return fmt.Sprintf("no rule matched, the default is %s", decision.Decision)
+	}
+	return fmt.Sprintf("rule %q matched", decision.Rule)
+}
+
+// record writes a decision to the audit log.
+func (s *Server) record(decision Decision) {
+	data, err := json.Marshal(decision)
+	if err != nil {
+		slog.Error("Unable to marshal decision", logging.Err(err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.audit.Write(append(data, '\n')); err != nil {
+		slog.Error("Unable to write to the audit log", logging.Err(err))
+	}
+}
+
+func header(key, value string) *corev3.HeaderValueOption {
+	return &corev3.HeaderValueOption{Header: &corev3.HeaderValue{Key: key, Value: value}}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package extauthz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func checkRequest(principal, method, path string, headers map[string]string) *authv3.CheckRequest {
+	return &authv3.CheckRequest{Attributes: &authv3.AttributeContext{
+		Source: &authv3.AttributeContext_Peer{Principal: principal},
+		Request: &authv3.AttributeContext_Request{Http: &authv3.AttributeContext_HttpRequest{
+			Method:  method,
+			Path:    path,
+			Headers: headers,
+		}},
+	}}
+}
+
+// startServer serves ext_authz on a local port and returns a gRPC client for it, like Envoy would use.
+func startServer(t *testing.T, audit *bytes.Buffer, trustXFCC bool) authv3.AuthorizationClient {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	grpcServer := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(grpcServer, NewServer(policy, audit, trustXFCC))
+	go func() { _ = grpcServer.Serve(listener) }()
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return authv3.NewAuthorizationClient(conn)
+}
+
+func TestCheckAllowsBySourcePrincipal(t *testing.T) {
+	audit := &bytes.Buffer{}
+	client := startServer(t, audit, false)
+
+	response, err := client.Check(context.Background(), checkRequest("spiffe://example.org/customer", "GET", "/?refresh=1", nil))
+	require.NoError(t, err)
+
+	assert.Equal(t, int32(codes.OK), response.GetStatus().GetCode())
+	headers := response.GetOkResponse().GetHeaders()
+	require.Len(t, headers, 1)
+	assert.Equal(t, AuthorizedIDHeader, headers[0].GetHeader().GetKey())
+	assert.Equal(t, "spiffe://example.org/customer", headers[0].GetHeader().GetValue())
+
+	var decision Decision
+	require.NoError(t, json.Unmarshal(audit.Bytes(), &decision))
+	assert.Equal(t, ActionAllow, decision.Decision)
+	assert.Equal(t, "principal", decision.Source)
+	assert.Equal(t, "/", decision.Path)
+	assert.Equal(t, "customer-can-read", decision.Rule)
+}
+
+func TestCheckDeniesWithStructuredResponse(t *testing.T) {
+	audit := &bytes.Buffer{}
+	client := startServer(t, audit, false)
+
+	response, err := client.Check(context.Background(), checkRequest("spiffe://example.org/rogue-customer", "GET", "/", nil))
+	require.NoError(t, err)
+
+	assert.Equal(t, int32(codes.PermissionDenied), response.GetStatus().GetCode())
+	denied := response.GetDeniedResponse()
+	require.NotNil(t, denied)
+	assert.Equal(t, typev3.StatusCode_Forbidden, denied.GetStatus().GetCode())
+
+	var decision Decision
+	require.NoError(t, json.Unmarshal([]byte(denied.GetBody()), &decision))
+	assert.Equal(t, ActionDeny, decision.Decision)
+	assert.Equal(t, "spiffe://example.org/rogue-customer", decision.SPIFFEID)
+	assert.Equal(t, "rogue-is-blocked", decision.Rule)
+
+	assert.Contains(t, audit.String(), `"decision":"deny"`)
+}
+
+func TestCheckReadsXFCC(t *testing.T) {
+	audit := &bytes.Buffer{}
+	client := startServer(t, audit, true)
+
+	headers := map[string]string{"x-forwarded-client-cert": "By=spiffe://example.org/proxy;URI=spiffe://example.org/customer"}
+	response, err := client.Check(context.Background(), checkRequest("", "GET", "/chain", headers))
+	require.NoError(t, err)
+	assert.Equal(t, int32(codes.OK), response.GetStatus().GetCode())
+	assert.Contains(t, audit.String(), `"source":"xfcc"`)
+}
+
+func TestCheckIgnoresXFCCByDefault(t *testing.T) {
+	audit := &bytes.Buffer{}
+	client := startServer(t, audit, false)
+
+	headers := map[string]string{"x-forwarded-client-cert": "By=spiffe://example.org/proxy;URI=spiffe://example.org/customer"}
+	response, err := client.Check(context.Background(), checkRequest("", "GET", "/chain", headers))
+	require.NoError(t, err)
+	assert.Equal(t, int32(codes.PermissionDenied), response.GetStatus().GetCode())
+	assert.Contains(t, audit.String(), "XFCC header isn't trusted")
+}
+
+func TestCheckDeniesWithoutIdentity(t *testing.T) {
+	audit := &bytes.Buffer{}
+	client := startServer(t, audit, false)
+
+	for _, request := range []*authv3.CheckRequest{
+		checkRequest("", "GET", "/", nil),
+		checkRequest("CN=not-spiffe", "GET", "/", nil),
+	} {
+		response, err := client.Check(context.Background(), request)
+		require.NoError(t, err)
+		assert.Equal(t, int32(codes.PermissionDenied), response.GetStatus().GetCode())
+	}
+	assert.Equal(t, 2, strings.Count(audit.String(), "\n"), "every decision should be audited")
+}
@@ -0,0 +1,148 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package extauthz
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"gopkg.in/yaml.v3"
+)
+
+// Actions of a policy rule.
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+// Policy decides which SPIFFE IDs may call which paths with which methods. The first rule that matches
+// a request decides, when none matches the default action applies.
+//
+// An example policy:
+//
+//	default: deny
+//	rules:
+//	- name: customer-can-read
+//	  ids: ["spiffe://example.org/ns/demo/sa/customer"]
+//	  methods: ["GET"]
+//	  paths: ["/", "/chain"]
+//	  action: allow
+//	- name: partners-can-read-status
+//	  ids: ["spiffe://partner.org"]
+//	  paths: ["/status/*"]
+//	  action: allow
+type Policy struct {
+	Default string `yaml:"default"`
+	Rules   []Rule `yaml:"rules"`
+}
+
+// Rule matches requests on the SPIFFE ID of the caller, the HTTP method and the path. An empty list matches everything.
+type Rule struct {
+	Name string `yaml:"name"`
+	// IDs are SPIFFE IDs, which match exactly, or trust domains like spiffe://example.org, which match all of their members.
+	IDs     []string `yaml:"ids"`
+	Methods []string `yaml:"methods"`
+	// Paths match exactly, unless they end with a *, then they match as a prefix.
+	Paths  []string `yaml:"paths"`
+	Action string   `yaml:"action"`
+
+	ids          []spiffeid.ID
+	trustDomains []spiffeid.TrustDomain
+}
+
+// LoadPolicy reads and validates a policy file.
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read policy: %w", err)
+	}
+	return ParsePolicy(data)
+}
+
+// ParsePolicy parses and validates a policy in YAML.
+func ParsePolicy(data []byte) (*Policy, error) {
+	policy := &Policy{}
+	if err := yaml.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("unable to parse policy: %w", err)
+	}
+
+	if policy.Default == "" {
+		policy.Default = ActionDeny
+	}
+	if !validAction(policy.Default) {
+		return nil, fmt.Errorf("invalid default action %q, use %q or %q", policy.Default, ActionAllow, ActionDeny)
+	}
+
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if !validAction(rule.Action) {
+			return nil, fmt.Errorf("invalid action %q in rule %q, use %q or %q", rule.Action, rule.Name, ActionAllow, ActionDeny)
+		}
+		for _, authorized := range rule.IDs {
+			id, err := spiffeid.FromString(authorized)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SPIFFE ID or trust domain %q in rule %q: %w", authorized, rule.Name, err)
+			}
+			if id.Path() == "" {
+				rule.trustDomains = append(rule.trustDomains, id.TrustDomain())
+			} else {
+				rule.ids = append(rule.ids, id)
+			}
+		}
+	}
+	return policy, nil
+}
+
+func validAction(action string) bool {
+	return action == ActionAllow || action == ActionDeny
+}
+
+// Decide returns the action for a request and the name of the rule that matched. The name is empty when
+// the default action applied.
+func (p *Policy) Decide(id spiffeid.ID, method, path string) (string, string) {
+	for _, rule := range p.Rules {
+		if rule.matches(id, method, path) {
+			return rule.Action, rule.Name
+		}
+	}
+	return p.Default, ""
+}
+
+func (r *Rule) matches(id spiffeid.ID, method, path string) bool {
+	if len(r.IDs) > 0 && !slices.Contains(r.ids, id) && !slices.Contains(r.trustDomains, id.TrustDomain()) {
+		return false
+	}
+	if len(r.Methods) > 0 && !slices.ContainsFunc(r.Methods, func(m string) bool { return strings.EqualFold(m, method) }) {
+		return false
+	}
+	if len(r.Paths) > 0 && !slices.ContainsFunc(r.Paths, func(p string) bool { return matchPath(p, path) }) {
+		return false
+	}
+	return true
+}
+
+func matchPath(pattern, path string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(path, prefix)
+	}
+	return pattern == path
+}
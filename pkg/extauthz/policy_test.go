@@ -0,0 +1,83 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package extauthz
+
+import (
+	"testing"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPolicy = `
+default: deny
+rules:
+- name: rogue-is-blocked
+  ids: ["spiffe://example.org/rogue-customer"]
+  action: deny
+- name: customer-can-read
+  ids: ["spiffe://example.org/customer"]
+  methods: ["GET"]
+  paths: ["/", "/chain"]
+  action: allow
+- name: partners-can-read-status
+  ids: ["spiffe://partner.org"]
+  paths: ["/status/*"]
+  action: allow
+`
+
+func TestPolicyDecide(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	require.NoError(t, err)
+
+	tests := []struct {
+		id, method, path string
+		action, rule     string
+	}{
+		{"spiffe://example.org/customer", "GET", "/", ActionAllow, "customer-can-read"},
+		{"spiffe://example.org/customer", "get", "/chain", ActionAllow, "customer-can-read"},
+		{"spiffe://example.org/customer", "POST", "/", ActionDeny, ""},
+		{"spiffe://example.org/customer", "GET", "/admin", ActionDeny, ""},
+		{"spiffe://example.org/rogue-customer", "GET", "/", ActionDeny, "rogue-is-blocked"},
+		{"spiffe://partner.org/any/workload", "GET", "/status/health", ActionAllow, "partners-can-read-status"},
+		{"spiffe://partner.org/any/workload", "GET", "/", ActionDeny, ""},
+	}
+	for _, tt := range tests {
+		action, rule := policy.Decide(spiffeid.RequireFromString(tt.id), tt.method, tt.path)
+		assert.Equal(t, tt.action, action, "%s %s %s", tt.id, tt.method, tt.path)
+		assert.Equal(t, tt.rule, rule, "%s %s %s", tt.id, tt.method, tt.path)
+	}
+}
+
+func TestParsePolicyDefaults(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`rules: [{action: allow}]`))
+	require.NoError(t, err)
+	assert.Equal(t, ActionDeny, policy.Default)
+	assert.Equal(t, "rule-1", policy.Rules[0].Name)
+}
+
+func TestParsePolicyInvalid(t *testing.T) {
+	for _, policy := range []string{
+		`default: maybe`,
+		`rules: [{action: permit}]`,
+		`rules: [{action: allow, ids: ["not-a-spiffe-id"]}]`,
+		`rules: {`,
+	} {
+		_, err := ParsePolicy([]byte(policy))
+		assert.Error(t, err, policy)
+	}
+}
@@ -16,36 +16,62 @@ limitations under the License.
 package httpservice
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"time"
 
 	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/mattiasgees/spiffe-demo/pkg/instrument"
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/mattiasgees/spiffe-demo/pkg/metrics"
 )
 
+// Name of the service used in the metrics.
+const serviceName = "httpservice"
+
 type HTTPService struct {
-	serverAddress string
+	serverAddress  string
+	metricsAddress string
+	// Policy for the XFCC header set by the SPIFFE proxy, nil when the header is ignored.
+	xfcc *xfccPolicy
 }
 
 // Main function that creates the httpbackend server and starts it. This is called from the CLI.
-func StartServer(serverAddress string) {
+func StartServer(serverAddress, metricsAddress string, xfccEnabled bool, xfccTrustedProxies, xfccAllowedIDs []string) {
 	svc := HTTPService{
-		serverAddress: serverAddress,
+		serverAddress:  serverAddress,
+		metricsAddress: metricsAddress,
+	}
+
+	if xfccEnabled {
+		policy, err := newXFCCPolicy(xfccTrustedProxies, xfccAllowedIDs)
+		if err != nil {
+			logging.Fatal("Invalid XFCC settings", err)
+		}
+		svc.xfcc = policy
 	}
 
 	if err := svc.run(); err != nil {
-		log.Fatal(err)
+		logging.Fatal("HTTP service stopped", err)
 	}
 }
 
 // This gets called from the main function and actually starts an HTTP server.
 func (h *HTTPService) run() error {
 	// Set up a `/` resource handler
-	http.HandleFunc("/", h.rootHandler)
+	handle("/", h.enforce(h.rootHandler))
+	handle(common.CallChainPath, h.enforce(h.chainHandler))
 
-	log.Printf("Starting server at %s", h.serverAddress)
+	if h.metricsAddress != "" {
+		metrics.Serve(h.metricsAddress)
+	} else {
+		http.Handle(metrics.Path, metrics.Handler())
+	}
+
+	slog.Info("Starting server", "address", h.serverAddress)
 
 	// Serve the HTTP server
 	if err := http.ListenAndServe(h.serverAddress, nil); err != nil {
@@ -55,13 +81,37 @@ func (h *HTTPService) run() error {
 	return nil
 }
 
+// handle registers a handler for a route. The requests are counted and traced by route.
+func handle(route string, handler http.HandlerFunc) {
+	http.HandleFunc(route, instrument.Handler(serviceName, route, handler))
+}
+
 // function that handles calls to `/`. This will just respond with a simple message and the date and time.
+// When the SPIFFE proxy passed on the identity of the caller, it is shown as well.
 func (h *HTTPService) rootHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Request received from %s", r.RemoteAddr)
+	slog.Debug("Request received", logging.RemoteKey, r.RemoteAddr)
 	currentTime := time.Now()
 	formattedTime := currentTime.Format(common.TimeFormat)
 	text := fmt.Sprintf("%s: Successfully connected to the HTTP service!!!", formattedTime)
+	if caller := h.caller(r); caller != nil {
+		text += fmt.Sprintf(" Caller: %s (certificate hash: %s, subject: %q)", caller.ID, caller.Hash, caller.Subject)
+	}
 	if _, err := io.WriteString(w, text); err != nil {
-		log.Printf("Error writing response: %v", err)
+		slog.Error("Error writing response", logging.Err(err))
+	}
+}
+
+// function that handles calls to `/chain`. The HTTP service is the last hop in a call chain and has no SPIFFE ID of its own,
+// it is the SPIFFE proxy in front of it that authenticates the caller and passes it on in the XFCC header.
+func (h *HTTPService) chainHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Call chain request received", logging.RemoteKey, r.RemoteAddr)
+	hop := common.Hop{Service: "httpservice"}
+	if caller := h.caller(r); caller != nil {
+		hop.CallerID = caller.ID.String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(hop); err != nil {
+		slog.Error("Error writing response", logging.Err(err))
 	}
 }
@@ -0,0 +1,180 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package httpservice
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/mattiasgees/spiffe-demo/pkg/tracing"
+	"github.com/mattiasgees/spiffe-demo/pkg/xfcc"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+var errNoCallerIdentity = errors.New("no caller identity in the request")
+
+// callerIdentity is the identity of the caller as reported by the SPIFFE proxy in front of the HTTP service.
+type callerIdentity struct {
+	ID      spiffeid.ID
+	Hash    string
+	Subject string
+}
+
+// xfccPolicy decides whether the XFCC header of a request can be trusted and whether the caller is allowed.
+type xfccPolicy struct {
+	trustedProxies []netip.Prefix
+	allowedIDs     []spiffeid.ID
+}
+
+// newXFCCPolicy parses the trusted proxy addresses (IPs or CIDRs) and the allowed SPIFFE IDs.
+func newXFCCPolicy(trustedProxies, allowedIDs []string) (*xfccPolicy, error) {
+	policy := &xfccPolicy{}
+	for _, proxy := range trustedProxies {
+		prefix, err := parsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		policy.trustedProxies = append(policy.trustedProxies, prefix)
+	}
+	for _, allowedID := range allowedIDs {
+		id, err := spiffeid.FromString(allowedID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed SPIFFE ID %q: %w", allowedID, err)
+		}
+		policy.allowedIDs = append(policy.allowedIDs, id)
+	}
+	return policy, nil
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// trusts returns whether the request comes directly from one of the trusted proxies.
+func (p *xfccPolicy) trusts(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	return slices.ContainsFunc(p.trustedProxies, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr)
+	})
+}
+
+// identify returns the identity of the caller from the XFCC header.
+//
+// SPIFFE CONCEPT: Identity Behind a Proxy
+// Envoy terminates the mTLS connection and authenticates the caller with its SVID. It then passes the
+// identity on to the application in the x-forwarded-client-cert header. Anyone who can reach the
+// application directly can set that header as well, so it is only trusted when the request comes from
+// the proxy itself. The element the proxy appended last describes the client it talked to.
+func (p *xfccPolicy) identify(r *http.Request) (*callerIdentity, error) {
+	header := r.Header.Get(xfcc.Header)
+	if header == "" {
+		return nil, errNoCallerIdentity
+	}
+	if !p.trusts(r.RemoteAddr) {
+		return nil, fmt.Errorf("%s header received from %s, which is not a trusted proxy", xfcc.Header, r.RemoteAddr)
+	}
+
+	elements, err := xfcc.Parse(header)
+	if err != nil {
+		return nil, err
+	}
+	element := elements[len(elements)-1]
+
+	id, err := spiffeid.FromString(element.URI)
+	if err != nil {
+		return nil, fmt.Errorf("client certificate has no valid SPIFFE ID: %w", err)
+	}
+	return &callerIdentity{ID: id, Hash: element.Hash, Subject: element.Subject}, nil
+}
+
+// allowed returns whether the caller is on the allow-list. Everybody is allowed when the list is empty.
+func (p *xfccPolicy) allowed(caller *callerIdentity) bool {
+	return len(p.allowedIDs) == 0 || slices.Contains(p.allowedIDs, caller.ID)
+}
+
+// enforce wraps a handler so it only gets called when the caller passes the policy.
+// Without an allow-list, requests without a (trusted) identity still get through.
+func (h *HTTPService) enforce(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.xfcc == nil {
+			next(w, r)
+			return
+		}
+
+		caller, err := h.xfcc.identify(r)
+		switch {
+		case err != nil && !errors.Is(err, errNoCallerIdentity):
+			slog.Warn("Rejected request", logging.RemoteKey, r.RemoteAddr, logging.Err(err))
+			tracing.Deny(r.Context(), err.Error())
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case caller == nil && len(h.xfcc.allowedIDs) > 0:
+			slog.Warn("Rejected request", logging.RemoteKey, r.RemoteAddr, logging.Err(err))
+			tracing.Deny(r.Context(), err.Error())
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		case caller != nil && !h.xfcc.allowed(caller):
+			slog.Warn("Rejected request, the caller is not allowed", logging.RemoteKey, r.RemoteAddr, logging.PeerIDKey, caller.ID.String())
+			tracing.SetPeerID(r.Context(), caller.ID.String())
+			logging.SetPeerID(r.Context(), caller.ID.String())
+			tracing.Deny(r.Context(), "the SPIFFE ID is not on the allow-list")
+			http.Error(w, fmt.Sprintf("%s is not allowed to call the HTTP service", caller.ID), http.StatusForbidden)
+			return
+		case caller != nil:
+			// SPIFFE CONCEPT: Identity Behind a Proxy in Traces
+			// The HTTP service doesn't terminate mTLS itself, so the caller in its spans is the one the proxy
+			// authenticated and passed on in the XFCC header.
+			tracing.SetPeerID(r.Context(), caller.ID.String())
+			logging.SetPeerID(r.Context(), caller.ID.String())
+			tracing.Allow(r.Context(), "SPIFFE ID passed on by a trusted proxy")
+		}
+		next(w, r)
+	}
+}
+
+// caller returns the identity of the caller, or nil when XFCC parsing is disabled or the request carries none.
+func (h *HTTPService) caller(r *http.Request) *callerIdentity {
+	if h.xfcc == nil {
+		return nil
+	}
+	caller, err := h.xfcc.identify(r)
+	if err != nil {
+		return nil
+	}
+	return caller
+}
@@ -0,0 +1,129 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package httpservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/mattiasgees/spiffe-demo/pkg/xfcc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testXFCC = `By=spiffe://example.org/httpbackend;Hash=abc123;Subject="O=SPIRE,C=US";URI=spiffe://example.org/customer`
+
+func newXFCCService(t *testing.T, allowedIDs ...string) *HTTPService {
+	policy, err := newXFCCPolicy([]string{"127.0.0.1", "10.0.0.0/8"}, allowedIDs)
+	require.NoError(t, err)
+	return &HTTPService{serverAddress: ":8080", xfcc: policy}
+}
+
+func xfccRequest(t *testing.T, path, remoteAddr, header string) *http.Request {
+	req, err := http.NewRequest("GET", path, nil)
+	require.NoError(t, err)
+	req.RemoteAddr = remoteAddr
+	if header != "" {
+		req.Header.Set(xfcc.Header, header)
+	}
+	return req
+}
+
+func TestNewXFCCPolicyInvalid(t *testing.T) {
+	_, err := newXFCCPolicy([]string{"not-an-ip"}, nil)
+	assert.Error(t, err)
+
+	_, err = newXFCCPolicy(nil, []string{"https://example.org/customer"})
+	assert.Error(t, err)
+}
+
+func TestRootHandlerShowsCaller(t *testing.T) {
+	svc := newXFCCService(t)
+
+	rr := httptest.NewRecorder()
+	svc.enforce(svc.rootHandler).ServeHTTP(rr, xfccRequest(t, "/", "127.0.0.1:40000", testXFCC))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Caller: spiffe://example.org/customer")
+	assert.Contains(t, rr.Body.String(), "abc123")
+	assert.Contains(t, rr.Body.String(), "O=SPIRE,C=US")
+}
+
+func TestXFCCFromUntrustedAddressIsRejected(t *testing.T) {
+	svc := newXFCCService(t)
+
+	rr := httptest.NewRecorder()
+	svc.enforce(svc.rootHandler).ServeHTTP(rr, xfccRequest(t, "/", "192.168.1.10:40000", testXFCC))
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), "not a trusted proxy")
+}
+
+func TestXFCCWithoutSPIFFEIDIsRejected(t *testing.T) {
+	svc := newXFCCService(t)
+
+	rr := httptest.NewRecorder()
+	svc.enforce(svc.rootHandler).ServeHTTP(rr, xfccRequest(t, "/", "10.1.2.3:40000", "Hash=abc123;Subject=CN=test"))
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestXFCCAllowList(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"allowed caller", testXFCC, http.StatusOK},
+		{"other caller", "URI=spiffe://example.org/rogue-customer", http.StatusForbidden},
+		{"no identity", "", http.StatusUnauthorized},
+	}
+
+	svc := newXFCCService(t, "spiffe://example.org/customer")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			svc.enforce(svc.rootHandler).ServeHTTP(rr, xfccRequest(t, "/", "[::ffff:127.0.0.1]:40000", tt.header))
+			assert.Equal(t, tt.want, rr.Code)
+		})
+	}
+}
+
+func TestXFCCDisabledIgnoresHeader(t *testing.T) {
+	svc := HTTPService{serverAddress: ":8080"}
+
+	rr := httptest.NewRecorder()
+	svc.enforce(svc.rootHandler).ServeHTTP(rr, xfccRequest(t, "/", "192.168.1.10:40000", testXFCC))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "Caller:")
+}
+
+func TestChainHandlerReportsCaller(t *testing.T) {
+	svc := newXFCCService(t)
+
+	rr := httptest.NewRecorder()
+	svc.enforce(svc.chainHandler).ServeHTTP(rr, xfccRequest(t, common.CallChainPath, "127.0.0.1:40000", testXFCC))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var hop common.Hop
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &hop))
+	assert.Equal(t, "httpservice", hop.Service)
+	assert.Equal(t, "spiffe://example.org/customer", hop.CallerID)
+}
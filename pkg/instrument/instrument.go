@@ -0,0 +1,31 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package instrument puts the metrics, request logs and traces in front of the routes of a service.
+package instrument
+
+import (
+	"net/http"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/mattiasgees/spiffe-demo/pkg/metrics"
+	"github.com/mattiasgees/spiffe-demo/pkg/tracing"
+)
+
+// Handler counts, logs and traces every request of a route. The metrics and the request log share the recorder
+// of the response, so they always agree on the status code.
+func Handler(service, route string, next http.HandlerFunc) http.HandlerFunc {
+	return metrics.InstrumentHandler(service, route, logging.InstrumentHandler(service, route, tracing.InstrumentHandler(route, next)))
+}
@@ -0,0 +1,177 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package logging
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/spiffe/go-spiffe/v2/spiffetls"
+)
+
+// Formats of the log lines.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Formats lists the valid values of the format.
+var Formats = []string{FormatText, FormatJSON}
+
+// Fields every service uses, so the log pipeline can filter on them across services.
+const (
+	PeerIDKey   = "peer_spiffe_id"
+	LocalIDKey  = "local_spiffe_id"
+	ServiceKey  = "service"
+	RouteKey    = "route"
+	MethodKey   = "method"
+	StatusKey   = "status"
+	DurationKey = "duration_ms"
+	RemoteKey   = "remote_addr"
+	ErrorKey    = "error"
+)
+
+// Setup makes a slog logger with the format and level the default logger. Lines of the log package end up
+// in the same logger.
+func Setup(w io.Writer, format, level string) error {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q, valid levels are debug, info, warn and error", level)
+	}
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch format {
+	case FormatText:
+		handler = slog.NewTextHandler(w, options)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return fmt.Errorf("invalid log format %q, valid formats are %v", format, Formats)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// Err is the field of an error.
+func Err(err error) slog.Attr {
+	return slog.Any(ErrorKey, err)
+}
+
+// Fatal logs the error and exits.
+func Fatal(msg string, err error) {
+	slog.Error(msg, Err(err))
+	os.Exit(1)
+}
+
+type peerKey struct{}
+
+// SetPeerID records the SPIFFE ID of a caller that was authenticated by a proxy in front of the service, for
+// the request log line.
+func SetPeerID(ctx context.Context, id string) {
+	if peer, ok := ctx.Value(peerKey{}).(*string); ok {
+		*peer = id
+	}
+}
+
+// ResponseRecorder captures the status code written by a handler. The instrumentation of a route shares one
+// recorder per request, see RecordResponse.
+type ResponseRecorder struct {
+	http.ResponseWriter
+	Status int
+}
+
+// RecordResponse returns the recorder of the response, wrapping it in a new one when no middleware in front did.
+func RecordResponse(w http.ResponseWriter) *ResponseRecorder {
+	if recorder, ok := w.(*ResponseRecorder); ok {
+		return recorder
+	}
+	return &ResponseRecorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (s *ResponseRecorder) WriteHeader(status int) {
+	s.Status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap allows http.ResponseController to reach the underlying ResponseWriter.
+func (s *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Flush allows handlers that stream their response to flush it through an instrumented handler.
+func (s *ResponseRecorder) Flush() {
+	_ = http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+// Hijack allows WebSocket upgrades through an instrumented handler.
+func (s *ResponseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	s.Status = http.StatusSwitchingProtocols
+	return http.NewResponseController(s.ResponseWriter).Hijack()
+}
+
+// InstrumentHandler logs a line for every request of a route once it is handled. Like the spans of the route,
+// every line carries the SPIFFE ID of the caller and of the service itself.
+func InstrumentHandler(service, route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		peer := ""
+		if r.TLS != nil {
+			if id, err := spiffetls.PeerIDFromConnectionState(*r.TLS); err == nil {
+				peer = id.String()
+			}
+		}
+		r = r.WithContext(context.WithValue(r.Context(), peerKey{}, &peer))
+
+		recorder := RecordResponse(w)
+		next(recorder, r)
+
+		slog.Info("Request handled",
+			slog.String(ServiceKey, service),
+			slog.String(RouteKey, route),
+			slog.String(MethodKey, r.Method),
+			slog.Int(StatusKey, recorder.Status),
+			slog.Float64(DurationKey, float64(time.Since(start).Microseconds())/1000),
+			slog.String(PeerIDKey, peer),
+			slog.String(LocalIDKey, common.LocalID()),
+			slog.String(RemoteKey, r.RemoteAddr),
+		)
+	}
+}
+
+// ServerErrors returns a writer for the http.Server ErrorLog. net/http writes lines of text to it, they are
+// logged as warnings.
+func ServerErrors(service string) io.Writer {
+	return serverErrorWriter{service: service}
+}
+
+type serverErrorWriter struct {
+	service string
+}
+
+func (s serverErrorWriter) Write(p []byte) (int, error) {
+	slog.Warn(strings.TrimSpace(string(p)), slog.String(ServiceKey, s.service))
+	return len(p), nil
+}
@@ -0,0 +1,124 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package logging
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type staticSVIDSource struct {
+	svid *x509svid.SVID
+}
+
+func (s staticSVIDSource) GetX509SVID() (*x509svid.SVID, error) {
+	return s.svid, nil
+}
+
+// captureJSON makes a JSON logger that writes to a buffer the default logger, until the test ends.
+func captureJSON(t *testing.T, level string) *bytes.Buffer {
+	previous := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	var buf bytes.Buffer
+	require.NoError(t, Setup(&buf, FormatJSON, level))
+	return &buf
+}
+
+func lines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		entry := map[string]any{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestInstrumentHandlerLogsIdentities(t *testing.T) {
+	buf := captureJSON(t, "info")
+	common.RegisterLocalSVID(staticSVIDSource{svid: &x509svid.SVID{ID: spiffeid.RequireFromString("spiffe://example.org/backend")}})
+	defer common.RegisterLocalSVID(nil)
+
+	handler := InstrumentHandler("backend", "/orders", func(w http.ResponseWriter, r *http.Request) {
+		slog.Debug("Not logged at the info level")
+		w.WriteHeader(http.StatusForbidden)
+	})
+	req := httptest.NewRequest(http.MethodDelete, "/orders/1", nil)
+	peer := spiffeid.RequireFromString("spiffe://example.org/customer")
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{URIs: []*url.URL{peer.URL()}}}}
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	entries := lines(t, buf)
+	require.Len(t, entries, 1)
+	entry := entries[0]
+	assert.Equal(t, "Request handled", entry["msg"])
+	assert.Equal(t, "backend", entry[ServiceKey])
+	assert.Equal(t, "/orders", entry[RouteKey])
+	assert.Equal(t, http.MethodDelete, entry[MethodKey])
+	assert.Equal(t, float64(http.StatusForbidden), entry[StatusKey])
+	assert.Contains(t, entry, DurationKey)
+	assert.Equal(t, "spiffe://example.org/customer", entry[PeerIDKey])
+	assert.Equal(t, "spiffe://example.org/backend", entry[LocalIDKey])
+	assert.Equal(t, req.RemoteAddr, entry[RemoteKey])
+}
+
+func TestSetPeerID(t *testing.T) {
+	buf := captureJSON(t, "debug")
+
+	// A proxy authenticated the caller, the request itself is plain HTTP.
+	handler := InstrumentHandler("httpservice", "/", func(w http.ResponseWriter, r *http.Request) {
+		SetPeerID(r.Context(), "spiffe://example.org/customer")
+	})
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	entries := lines(t, buf)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "spiffe://example.org/customer", entries[0][PeerIDKey])
+	assert.Equal(t, float64(http.StatusOK), entries[0][StatusKey])
+}
+
+func TestSetup(t *testing.T) {
+	previous := slog.Default()
+	defer slog.SetDefault(previous)
+
+	var buf bytes.Buffer
+	require.NoError(t, Setup(&buf, FormatText, "warn"))
+	slog.Info("dropped")
+	slog.Warn("kept", Err(assert.AnError))
+	assert.NotContains(t, buf.String(), "dropped")
+	assert.Contains(t, buf.String(), "msg=kept")
+	assert.Contains(t, buf.String(), "error=")
+
+	assert.Error(t, Setup(&buf, "xml", "info"))
+	assert.Error(t, Setup(&buf, FormatJSON, "verbose"))
+}
@@ -0,0 +1,195 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package metrics
+
+import (
+	"bytes"
+	"crypto/x509"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// Path on which all services expose their metrics.
+const Path = "/metrics"
+
+// Label value used when a request or handshake can't be attributed to a SPIFFE ID.
+const unknownID = "unknown"
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "spiffe_demo_http_requests_total",
+		Help: "Number of HTTP requests handled, by route, peer SPIFFE ID and status code.",
+	}, []string{"service", "route", "peer_spiffe_id", "code"})
+
+	handshakeFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "spiffe_demo_tls_handshake_failures_total",
+		Help: "Number of failed TLS handshakes, by reason.",
+	}, []string{"service", "reason"})
+
+	authzDenialsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "spiffe_demo_authz_denials_total",
+		Help: "Number of peers that were denied because their SPIFFE ID is not authorized.",
+	}, []string{"service", "peer_spiffe_id"})
+
+	outboundDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "spiffe_demo_outbound_request_duration_seconds",
+		Help:    "Latency of outbound calls made by a demo, by result.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"demo", "result"})
+
+	svidExpiryDesc = prometheus.NewDesc(
+		"spiffe_demo_svid_expiry_seconds",
+		"Seconds until the current X.509-SVID of the service expires.",
+		[]string{"service", "spiffe_id"}, nil,
+	)
+)
+
+// Handler returns the HTTP handler that serves the metrics in the Prometheus format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Serve exposes the metrics on a separate plain HTTP listener. This is needed for services
+// whose main listener only accepts SPIFFE mTLS connections, which Prometheus can't scrape.
+func Serve(address string) {
+	mux := http.NewServeMux()
+	mux.Handle(Path, Handler())
+	server := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+
+	go func() {
+		slog.Info("Serving metrics", "address", address)
+		if err := server.ListenAndServe(); err != nil {
+			slog.Error("Metrics server stopped", logging.Err(err))
+		}
+	}()
+}
+
+// InstrumentHandler counts the requests handled by a route, labelled with the SPIFFE ID of the peer.
+func InstrumentHandler(service, route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recorder := logging.RecordResponse(w)
+		next(recorder, r)
+
+		requestsTotal.WithLabelValues(service, route, peerID(r), strconv.Itoa(recorder.Status)).Inc()
+	}
+}
+
+// peerID returns the SPIFFE ID of the peer of an mTLS request, if there is one.
+func peerID(r *http.Request) string {
+	if r.TLS == nil {
+		return unknownID
+	}
+	id, err := spiffetls.PeerIDFromConnectionState(*r.TLS)
+	if err != nil {
+		return unknownID
+	}
+	return id.String()
+}
+
+// Authorizer wraps a SPIFFE authorizer to count the peers it denies.
+//
+// SPIFFE CONCEPT: Observing Authorization Decisions
+// The authorizer is called during the TLS handshake with the already verified SPIFFE ID of the peer.
+// A sudden spike of denied identities is a strong signal that a workload is misconfigured or that
+// someone is trying to reach a service they are not entitled to.
+func Authorizer(service string, authorizer tlsconfig.Authorizer) tlsconfig.Authorizer {
+	return func(id spiffeid.ID, verifiedChains [][]*x509.Certificate) error {
+		err := authorizer(id, verifiedChains)
+		if err != nil {
+			AuthzDenied(service, id.String())
+		}
+		return err
+	}
+}
+
+// AuthzDenied counts a peer that was denied by an authorization decision made outside of the TLS handshake.
+func AuthzDenied(service, peerID string) {
+	if peerID == "" {
+		peerID = unknownID
+	}
+	authzDenialsTotal.WithLabelValues(service, peerID).Inc()
+}
+
+// HandshakeFailed counts a failed TLS handshake.
+func HandshakeFailed(service, reason string) {
+	handshakeFailuresTotal.WithLabelValues(service, reason).Inc()
+}
+
+// HandshakeErrorLog returns a logger to use as http.Server ErrorLog. net/http only reports failed
+// TLS handshakes to this log, so this is the place where we can count them.
+func HandshakeErrorLog(service string) *log.Logger {
+	return log.New(&handshakeErrorWriter{service: service}, "", 0)
+}
+
+type handshakeErrorWriter struct {
+	service string
+}
+
+func (h *handshakeErrorWriter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("TLS handshake error")) {
+		HandshakeFailed(h.service, "tls_handshake_error")
+	}
+	return logging.ServerErrors(h.service).Write(p)
+}
+
+// ObserveOutbound records the latency of an outbound call made by a demo.
+func ObserveOutbound(demo string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	outboundDuration.WithLabelValues(demo, result).Observe(time.Since(start).Seconds())
+}
+
+// RegisterSVIDExpiry exposes the number of seconds until the current X.509-SVID of the service expires.
+// The value is calculated on every scrape, so it always reflects the SVID after the latest rotation.
+func RegisterSVIDExpiry(service string, source x509svid.Source) {
+	prometheus.MustRegister(&svidExpiryCollector{service: service, source: source})
+}
+
+type svidExpiryCollector struct {
+	service string
+	source  x509svid.Source
+}
+
+func (s *svidExpiryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- svidExpiryDesc
+}
+
+func (s *svidExpiryCollector) Collect(ch chan<- prometheus.Metric) {
+	svid, err := s.source.GetX509SVID()
+	if err != nil || len(svid.Certificates) == 0 {
+		return
+	}
+	seconds := time.Until(svid.Certificates[0].NotAfter).Seconds()
+	ch <- prometheus.MustNewConstMetric(svidExpiryDesc, prometheus.GaugeValue, seconds, s.service, svid.ID.String())
+}
@@ -0,0 +1,91 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package metrics
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstrumentHandlerCountsStatusCodes(t *testing.T) {
+	handler := InstrumentHandler("test", "/teapot", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	req, err := http.NewRequest("GET", "/teapot", nil)
+	require.NoError(t, err)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	counter := requestsTotal.WithLabelValues("test", "/teapot", unknownID, "418")
+	assert.Equal(t, float64(1), testutil.ToFloat64(counter))
+}
+
+func TestAuthorizerCountsDenials(t *testing.T) {
+	allowed := spiffeid.RequireFromString("spiffe://example.org/customer")
+	rogue := spiffeid.RequireFromString("spiffe://example.org/rogue")
+	authorizer := Authorizer("test", tlsconfig.AuthorizeID(allowed))
+
+	assert.NoError(t, authorizer(allowed, nil))
+	assert.Error(t, authorizer(rogue, nil))
+
+	assert.Equal(t, float64(0), testutil.ToFloat64(authzDenialsTotal.WithLabelValues("test", allowed.String())))
+	assert.Equal(t, float64(1), testutil.ToFloat64(authzDenialsTotal.WithLabelValues("test", rogue.String())))
+}
+
+func TestObserveOutboundLabelsResult(t *testing.T) {
+	ObserveOutbound("test", time.Now(), nil)
+	ObserveOutbound("test", time.Now(), errors.New("boom"))
+
+	assert.Equal(t, 2, testutil.CollectAndCount(outboundDuration, "spiffe_demo_outbound_request_duration_seconds"))
+}
+
+type staticSVIDSource struct {
+	svid *x509svid.SVID
+}
+
+func (s staticSVIDSource) GetX509SVID() (*x509svid.SVID, error) {
+	return s.svid, nil
+}
+
+func TestSVIDExpiryCollector(t *testing.T) {
+	svid := &x509svid.SVID{
+		ID:           spiffeid.RequireFromString("spiffe://example.org/backend"),
+		Certificates: []*x509.Certificate{{NotAfter: time.Now().Add(time.Hour)}},
+	}
+	collector := &svidExpiryCollector{service: "test", source: staticSVIDSource{svid: svid}}
+
+	registry := prometheus.NewPedanticRegistry()
+	require.NoError(t, registry.Register(collector))
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	require.Len(t, families, 1)
+
+	value := families[0].GetMetric()[0].GetGauge().GetValue()
+	assert.InDelta(t, time.Hour.Seconds(), value, 60)
+}
@@ -0,0 +1,262 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/mattiasgees/spiffe-demo/pkg/instrument"
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/mattiasgees/spiffe-demo/pkg/metrics"
+	"github.com/mattiasgees/spiffe-demo/pkg/xfcc"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// Name of the service used in the metrics.
+const serviceName = "proxy"
+
+// Modes the proxy can run in.
+const (
+	// ModeInbound terminates SPIFFE mTLS and forwards to a plaintext upstream, like Envoy in front of the httpservice.
+	ModeInbound = "inbound"
+	// ModeOutbound accepts plaintext calls from a local client and forwards them over SPIFFE mTLS.
+	ModeOutbound = "outbound"
+)
+
+type Proxy struct {
+	mode           string
+	listenAddress  string
+	metricsAddress string
+	upstream       *url.URL
+	// Inbound: the callers that are allowed. Outbound: the SPIFFE ID of the upstream.
+	authorizer tlsconfig.Authorizer
+}
+
+// Main function that creates the proxy and starts it. This is called from the CLI.
+func StartProxy(mode, listenAddress, metricsAddress, upstream string, authorizedIDs []string) {
+	p := Proxy{
+		mode:           mode,
+		listenAddress:  listenAddress,
+		metricsAddress: metricsAddress,
+	}
+
+	upstreamURL, err := url.Parse(upstream)
+	if err != nil || upstreamURL.Host == "" {
+		logging.Fatal("Invalid upstream", fmt.Errorf("%q needs to be a URL like http://127.0.0.1:8080", upstream))
+	}
+	p.upstream = upstreamURL
+
+	switch mode {
+	case ModeInbound:
+		p.authorizer, err = inboundAuthorizer(authorizedIDs)
+	case ModeOutbound:
+		if err = loopbackAddress(listenAddress); err != nil {
+			break
+		}
+		p.authorizer, err = outboundAuthorizer(authorizedIDs)
+		p.upstream.Scheme = "https"
+	default:
+		err = fmt.Errorf("unknown mode %q, use %q or %q", mode, ModeInbound, ModeOutbound)
+	}
+	if err != nil {
+		logging.Fatal("Invalid proxy settings", err)
+	}
+
+	if err := p.run(context.Background()); err != nil {
+		logging.Fatal("Proxy stopped", err)
+	}
+}
+
+// inboundAuthorizer builds the policy for callers. Every entry is either a SPIFFE ID, which is allowed exactly,
+// or a trust domain like spiffe://example.org, which allows all of its members.
+func inboundAuthorizer(authorizedIDs []string) (tlsconfig.Authorizer, error) {
+	if len(authorizedIDs) == 0 {
+		return nil, errors.New("the inbound proxy needs at least one authorized SPIFFE ID or trust domain")
+	}
+
+	var ids []spiffeid.ID
+	var trustDomains []spiffeid.TrustDomain
+	for _, authorized := range authorizedIDs {
+		id, err := spiffeid.FromString(authorized)
+		if err != nil {
+			return nil, fmt.Errorf("invalid authorized SPIFFE ID or trust domain %q: %w", authorized, err)
+		}
+		if id.Path() == "" {
+			trustDomains = append(trustDomains, id.TrustDomain())
+		} else {
+			ids = append(ids, id)
+		}
+	}
+
+	return func(id spiffeid.ID, _ [][]*x509.Certificate) error {
+		if slices.Contains(ids, id) || slices.Contains(trustDomains, id.TrustDomain()) {
+			return nil
+		}
+		return fmt.Errorf("unexpected ID %q", id)
+	}, nil
+}
+
+// outboundAuthorizer builds the policy for the upstream, which has to present exactly this SPIFFE ID.
+func outboundAuthorizer(authorizedIDs []string) (tlsconfig.Authorizer, error) {
+	if len(authorizedIDs) != 1 {
+		return nil, errors.New("the outbound proxy needs exactly one SPIFFE ID of the upstream")
+	}
+	id, err := spiffeid.FromString(authorizedIDs[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid SPIFFE ID of the upstream %q: %w", authorizedIDs[0], err)
+	}
+	return tlsconfig.AuthorizeID(id), nil
+}
+
+// loopbackAddress checks that the outbound proxy only listens on a loopback address. It serves plaintext and calls
+// the upstream with the SVID of the workload, so anybody who can reach the listener gets the identity of the workload.
+func loopbackAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", address, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("the outbound proxy hands out the identity of the workload to every caller, so it only listens on a loopback address like 127.0.0.1, not %q", address)
+}
+
+// This gets called from the main function and starts the listener of the proxy.
+func (p *Proxy) run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// All paths are forwarded to the upstream, so the metrics need their own listener.
+	if p.metricsAddress != "" {
+		metrics.Serve(p.metricsAddress)
+	}
+
+	source, err := workloadapi.NewX509Source(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to create X509Source: %w", err)
+	}
+	defer source.Close()
+	metrics.RegisterSVIDExpiry(serviceName, source)
+	common.RegisterLocalSVID(source)
+
+	server := &http.Server{
+		Addr:              p.listenAddress,
+		ReadHeaderTimeout: time.Second * 10,
+		ErrorLog:          metrics.HandshakeErrorLog(serviceName),
+	}
+
+	if p.mode == ModeOutbound {
+		server.Handler = instrument.Handler(serviceName, "/", newOutboundHandler(p.upstream, source, source, p.authorizer).ServeHTTP)
+
+		slog.Info("Forwarding plaintext calls over SPIFFE mTLS", "address", p.listenAddress, "upstream", p.upstream.String())
+		if err := server.ListenAndServe(); err != nil {
+			return fmt.Errorf("failed to serve: %w", err)
+		}
+		return nil
+	}
+
+	// SPIFFE CONCEPT: SPIFFE-Aware Sidecar
+	// The proxy does the SPIFFE work on behalf of an application that doesn't know anything about it:
+	// it gets an SVID from the Workload API, terminates mTLS with it and only lets authorized callers through.
+	server.TLSConfig = tlsconfig.MTLSServerConfig(source, source, metrics.Authorizer(serviceName, p.authorizer))
+	server.Handler = instrument.Handler(serviceName, "/", newInboundHandler(p.upstream, source).ServeHTTP)
+
+	slog.Info("Forwarding SPIFFE mTLS calls", "address", p.listenAddress, "upstream", p.upstream.String())
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		return fmt.Errorf("failed to serve: %w", err)
+	}
+	return nil
+}
+
+// newInboundHandler forwards authenticated requests to the plaintext upstream.
+//
+// SPIFFE CONCEPT: Passing the Identity On
+// The upstream never sees the TLS connection, so the proxy tells it who the caller is in the
+// x-forwarded-client-cert header, in the same format Envoy uses. Any XFCC header the caller sent
+// is dropped first, otherwise a caller could claim to be somebody else.
+func newInboundHandler(upstream *url.URL, source x509svid.Source) http.Handler {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(upstream)
+			r.SetXForwarded()
+			r.Out.Header.Del(xfcc.Header)
+
+			if r.In.TLS == nil || len(r.In.TLS.PeerCertificates) == 0 {
+				return
+			}
+			peerCert := r.In.TLS.PeerCertificates[0]
+			peerID, err := x509svid.IDFromCert(peerCert)
+			if err != nil {
+				return
+			}
+
+			hash := sha256.Sum256(peerCert.Raw)
+			element := xfcc.Element{
+				Hash:    hex.EncodeToString(hash[:]),
+				Subject: peerCert.Subject.String(),
+				URI:     peerID.String(),
+			}
+			if svid, err := source.GetX509SVID(); err == nil {
+				element.By = svid.ID.String()
+			}
+			r.Out.Header.Set(xfcc.Header, element.String())
+		},
+		ErrorHandler: proxyErrorHandler,
+	}
+}
+
+// newOutboundHandler forwards plaintext requests of a local client to the upstream over SPIFFE mTLS.
+//
+// SPIFFE CONCEPT: Upgrading Outbound Calls
+// The client talks plain HTTP to the proxy on localhost. The proxy presents the SVID of the workload to
+// the upstream and verifies the upstream has the expected SPIFFE ID, so the call is mutually authenticated
+// as soon as it leaves the pod.
+func newOutboundHandler(upstream *url.URL, svidSource x509svid.Source, bundleSource x509bundle.Source, authorizer tlsconfig.Authorizer) http.Handler {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(upstream)
+		},
+		Transport: &http.Transport{
+			TLSClientConfig: tlsconfig.MTLSClientConfig(svidSource, bundleSource, authorizer),
+		},
+		ErrorHandler: proxyErrorHandler,
+	}
+}
+
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	slog.Error("Error forwarding", logging.MethodKey, r.Method, "path", r.URL.Path, logging.Err(err))
+	http.Error(w, fmt.Sprintf("Error forwarding the request: %v", err), http.StatusBadGateway)
+}
@@ -0,0 +1,161 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/mattiasgees/spiffe-demo/internal/spiffetest"
+	"github.com/mattiasgees/spiffe-demo/pkg/xfcc"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newEchoUpstream starts a plaintext upstream that responds with the XFCC header it received.
+func newEchoUpstream(t *testing.T) *url.URL {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Header.Get(xfcc.Header))
+	}))
+	t.Cleanup(upstream.Close)
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	return upstreamURL
+}
+
+func TestInboundAuthorizer(t *testing.T) {
+	authorizer, err := inboundAuthorizer([]string{"spiffe://example.org/customer", "spiffe://partner.org"})
+	require.NoError(t, err)
+
+	assert.NoError(t, authorizer(spiffeid.RequireFromString("spiffe://example.org/customer"), nil))
+	assert.NoError(t, authorizer(spiffeid.RequireFromString("spiffe://partner.org/anything"), nil))
+	assert.Error(t, authorizer(spiffeid.RequireFromString("spiffe://example.org/rogue-customer"), nil))
+
+	_, err = inboundAuthorizer(nil)
+	assert.Error(t, err)
+	_, err = inboundAuthorizer([]string{"not-a-spiffe-id"})
+	assert.Error(t, err)
+}
+
+func TestOutboundAuthorizer(t *testing.T) {
+	_, err := outboundAuthorizer([]string{"spiffe://example.org/backend"})
+	assert.NoError(t, err)
+
+	_, err = outboundAuthorizer(nil)
+	assert.Error(t, err)
+	_, err = outboundAuthorizer([]string{"spiffe://example.org/a", "spiffe://example.org/b"})
+	assert.Error(t, err)
+}
+
+func TestOutboundOnlyListensOnLoopback(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:8080", "[::1]:8080", "localhost:8080"} {
+		assert.NoError(t, loopbackAddress(address), address)
+	}
+	for _, address := range []string{":8080", "0.0.0.0:8080", "10.0.0.1:8080", "backend:8080", "8080"} {
+		assert.Error(t, loopbackAddress(address), address)
+	}
+}
+
+func TestInboundHandlerInjectsIdentity(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	ca := spiffetest.NewCA(t, td)
+	proxySVID := ca.Issue(t, "spiffe://example.org/httpbackend")
+	customerSVID := ca.Issue(t, "spiffe://example.org/customer")
+
+	handler := newInboundHandler(newEchoUpstream(t), proxySVID)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(xfcc.Header, "URI=spiffe://example.org/admin")
+	req.TLS = &tls.ConnectionState{PeerCertificates: customerSVID.Certificates}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	elements, err := xfcc.Parse(rr.Body.String())
+	require.NoError(t, err)
+	require.Len(t, elements, 1, "the spoofed element should be removed")
+
+	hash := sha256.Sum256(customerSVID.Certificates[0].Raw)
+	assert.Equal(t, "spiffe://example.org/customer", elements[0].URI)
+	assert.Equal(t, "spiffe://example.org/httpbackend", elements[0].By)
+	assert.Equal(t, hex.EncodeToString(hash[:]), elements[0].Hash)
+}
+
+func TestInboundHandlerStripsSpoofedHeader(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	proxySVID := spiffetest.NewCA(t, td).Issue(t, "spiffe://example.org/httpbackend")
+
+	handler := newInboundHandler(newEchoUpstream(t), proxySVID)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(xfcc.Header, "URI=spiffe://example.org/admin")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Body.String())
+}
+
+func TestOutboundHandlerUpgradesToMTLS(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	ca := spiffetest.NewCA(t, td)
+	bundle := x509bundle.FromX509Authorities(td, []*x509.Certificate{ca.Cert})
+	backendSVID := ca.Issue(t, "spiffe://example.org/backend")
+	customerSVID := ca.Issue(t, "spiffe://example.org/customer")
+
+	backendID := backendSVID.ID
+	customerID := customerSVID.ID
+
+	// The upstream only accepts the customer and responds with the SPIFFE ID it saw.
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := x509svid.IDFromCert(r.TLS.PeerCertificates[0])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = io.WriteString(w, id.String())
+	}))
+	upstream.Listener = tls.NewListener(upstream.Listener, tlsconfig.MTLSServerConfig(backendSVID, bundle, tlsconfig.AuthorizeID(customerID)))
+	upstream.Start()
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	upstreamURL.Scheme = "https"
+
+	rr := httptest.NewRecorder()
+	newOutboundHandler(upstreamURL, customerSVID, bundle, tlsconfig.AuthorizeID(backendID)).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "spiffe://example.org/customer", rr.Body.String())
+
+	// An upstream with another SPIFFE ID than expected is refused.
+	rr = httptest.NewRecorder()
+	wrongID := spiffeid.RequireFromString("spiffe://example.org/other")
+	newOutboundHandler(upstreamURL, customerSVID, bundle, tlsconfig.AuthorizeID(wrongID)).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+}
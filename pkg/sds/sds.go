@@ -0,0 +1,326 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	secretv3 "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+	"github.com/mattiasgees/spiffe-demo/pkg/logging"
+	"github.com/mattiasgees/spiffe-demo/pkg/metrics"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// Name of the service used in the metrics.
+const serviceName = "sds"
+
+// Type URL of the secrets in the discovery responses.
+const secretTypeURL = "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret"
+
+// Resource names Envoy can ask for besides a SPIFFE ID or trust domain. These are the same as the SPIRE agent uses.
+const (
+	defaultSVIDName   = "default"
+	defaultBundleName = "ROOTCA"
+)
+
+// source is what the SDS server needs from the Workload API. The X509Source implements it.
+type source interface {
+	x509svid.Source
+	x509bundle.Source
+	Updated() <-chan struct{}
+}
+
+// Server implements the Envoy Secret Discovery Service with the SVIDs and bundles of the Workload API.
+//
+// SPIFFE CONCEPT: Delivering SVIDs to Envoy
+// Envoy can't talk to the Workload API itself, it gets its certificates through SDS. The SPIRE agent offers
+// SDS as well, but that isn't available when workloads only get the Workload API, like with the SPIFFE CSI
+// driver. This server translates between the two: the X509-SVID becomes a tls_certificate secret and the
+// trust bundle becomes a validation_context secret. Every rotation is pushed to Envoy right away.
+type Server struct {
+	secretv3.UnimplementedSecretDiscoveryServiceServer
+
+	source source
+
+	mu      sync.Mutex
+	version int
+	// Closed and replaced on every update, so all streams get notified.
+	changed chan struct{}
+}
+
+// Main function that creates the SDS server and starts it. This is called from the CLI.
+func StartServer(socketPath, metricsAddress string) {
+	if err := run(context.Background(), socketPath, metricsAddress); err != nil {
+		logging.Fatal("SDS server stopped", err)
+	}
+}
+
+func run(ctx context.Context, socketPath, metricsAddress string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if metricsAddress != "" {
+		metrics.Serve(metricsAddress)
+	}
+
+	x509Source, err := workloadapi.NewX509Source(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to create X509Source: %w", err)
+	}
+	defer x509Source.Close()
+	metrics.RegisterSVIDExpiry(serviceName, x509Source)
+
+	listener, err := listen(socketPath)
+	if err != nil {
+		return err
+	}
+
+	server := NewServer(ctx, x509Source)
+	grpcServer := grpc.NewServer()
+	secretv3.RegisterSecretDiscoveryServiceServer(grpcServer, server)
+
+	slog.Info("Serving SDS", "socket", socketPath)
+	if err := grpcServer.Serve(listener); err != nil {
+		return fmt.Errorf("failed to serve: %w", err)
+	}
+	return nil
+}
+
+// listen listens on the Unix socket. The secrets include the private key of the X509-SVID, so only the user
+// of the SDS server, which Envoy has to run as, may connect to the socket.
+func listen(socketPath string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0o700); err != nil {
+		return nil, fmt.Errorf("unable to create the directory of the socket: %w", err)
+	}
+	// Remove the socket of a previous run, otherwise we can't listen on it.
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("unable to remove old socket: %w", err)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %w", socketPath, err)
+	}
+	if err := os.Chmod(socketPath, 0o600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("unable to restrict access to %s: %w", socketPath, err)
+	}
+	return listener, nil
+}
+
+// NewServer creates an SDS server that watches the source for updates until the context is done.
+func NewServer(ctx context.Context, source source) *Server {
+	s := &Server{
+		source:  source,
+		version: 1,
+		changed: make(chan struct{}),
+	}
+	go s.watch(ctx)
+	return s
+}
+
+// watch turns the updates of the source into a notification for all streams.
+func (s *Server) watch(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.source.Updated():
+			s.mu.Lock()
+			s.version++
+			close(s.changed)
+			s.changed = make(chan struct{})
+			s.mu.Unlock()
+			slog.Info("SVID or bundle updated, pushing the new secrets")
+		}
+	}
+}
+
+// current returns the version of the secrets and a channel that is closed when they change.
+func (s *Server) current() (int, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.version, s.changed
+}
+
+// StreamSecrets serves the state of the world protocol Envoy uses for SDS. Envoy sends the names of the secrets it
+// wants, we respond with those secrets and send them again whenever they change. Envoy acknowledges every response
+// with a request that has the nonce of that response.
+func (s *Server) StreamSecrets(stream secretv3.SecretDiscoveryService_StreamSecretsServer) error {
+	requests := make(chan *discoveryv3.DiscoveryRequest)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			request, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case requests <- request:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+
+	var names []string
+	nonce := 0
+	sentVersion := 0
+
+	for {
+		version, changed := s.current()
+		if names != nil && version != sentVersion {
+			nonce++
+			if err := s.send(stream, names, version, strconv.Itoa(nonce)); err != nil {
+				return err
+			}
+			sentVersion = version
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case err := <-errs:
+			if status.Code(err) == codes.Canceled {
+				return nil
+			}
+			return err
+		case <-changed:
+		case request := <-requests:
+			if request.GetErrorDetail() != nil {
+				slog.Warn("Envoy rejected secrets", "secrets", request.GetResourceNames(), "detail", request.GetErrorDetail().GetMessage())
+				continue
+			}
+			// An acknowledgement of a response for the same secrets doesn't need an answer. Newer versions
+			// are pushed anyway, so it doesn't matter whether it acknowledges the last one.
+			if request.GetResponseNonce() != "" && names != nil && slices.Equal(names, request.GetResourceNames()) {
+				continue
+			}
+			names = slices.Clone(request.GetResourceNames())
+			if names == nil {
+				names = []string{}
+			}
+			// Force a response for the new subscription.
+			sentVersion = 0
+		}
+	}
+}
+
+// FetchSecrets returns the requested secrets once.
+func (s *Server) FetchSecrets(_ context.Context, request *discoveryv3.DiscoveryRequest) (*discoveryv3.DiscoveryResponse, error) {
+	version, _ := s.current()
+	return s.response(request.GetResourceNames(), version, "")
+}
+
+func (s *Server) send(stream secretv3.SecretDiscoveryService_StreamSecretsServer, names []string, version int, nonce string) error {
+	response, err := s.response(names, version, nonce)
+	if err != nil {
+		return err
+	}
+	return stream.Send(response)
+}
+
+func (s *Server) response(names []string, version int, nonce string) (*discoveryv3.DiscoveryResponse, error) {
+	response := &discoveryv3.DiscoveryResponse{
+		VersionInfo: strconv.Itoa(version),
+		TypeUrl:     secretTypeURL,
+		Nonce:       nonce,
+	}
+	for _, name := range names {
+		secret, err := s.secret(name)
+		if err != nil {
+			// Envoy keeps waiting for a secret it doesn't get, which shows up as a warming listener or cluster.
+			slog.Warn("Not sending secret", "secret", name, logging.Err(err))
+			continue
+		}
+		resource, err := anypb.New(secret)
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal secret %q: %w", name, err)
+		}
+		response.Resources = append(response.Resources, resource)
+	}
+	return response, nil
+}
+
+// secret translates a resource name to a secret. The name is either the SPIFFE ID of the workload (or "default")
+// for its SVID, or a trust domain like spiffe://example.org (or "ROOTCA") for the bundle of that trust domain.
+func (s *Server) secret(name string) (*tlsv3.Secret, error) {
+	svid, err := s.source.GetX509SVID()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get X509-SVID: %w", err)
+	}
+
+	if name == defaultSVIDName || name == svid.ID.String() {
+		certificates, key, err := svid.Marshal()
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal X509-SVID: %w", err)
+		}
+		return &tlsv3.Secret{
+			Name: name,
+			Type: &tlsv3.Secret_TlsCertificate{TlsCertificate: &tlsv3.TlsCertificate{
+				CertificateChain: inlineBytes(certificates),
+				PrivateKey:       inlineBytes(key),
+			}},
+		}, nil
+	}
+
+	trustDomain := svid.ID.TrustDomain()
+	if name != defaultBundleName {
+		id, err := spiffeid.FromString(name)
+		if err != nil || id.Path() != "" {
+			return nil, fmt.Errorf("unknown secret %q, it is neither the SPIFFE ID of the workload nor a trust domain", name)
+		}
+		trustDomain = id.TrustDomain()
+	}
+
+	bundle, err := s.source.GetX509BundleForTrustDomain(trustDomain)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get X.509 bundle for %q: %w", trustDomain, err)
+	}
+	authorities, err := bundle.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal X.509 bundle: %w", err)
+	}
+	return &tlsv3.Secret{
+		Name: name,
+		Type: &tlsv3.Secret_ValidationContext{ValidationContext: &tlsv3.CertificateValidationContext{
+			TrustedCa: inlineBytes(authorities),
+		}},
+	}, nil
+}
+
+func inlineBytes(data []byte) *corev3.DataSource {
+	return &corev3.DataSource{Specifier: &corev3.DataSource_InlineBytes{InlineBytes: data}}
+}
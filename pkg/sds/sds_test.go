@@ -0,0 +1,181 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sds
+
+import (
+	"context"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	secretv3 "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+	"github.com/mattiasgees/spiffe-demo/internal/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// fakeSource stands in for the X509Source and lets the test rotate the SVID.
+type fakeSource struct {
+	mu      sync.Mutex
+	svid    *x509svid.SVID
+	bundle  *x509bundle.Bundle
+	updated chan struct{}
+}
+
+func (f *fakeSource) GetX509SVID() (*x509svid.SVID, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.svid, nil
+}
+
+func (f *fakeSource) GetX509BundleForTrustDomain(td spiffeid.TrustDomain) (*x509bundle.Bundle, error) {
+	return f.bundle.GetX509BundleForTrustDomain(td)
+}
+
+func (f *fakeSource) Updated() <-chan struct{} {
+	return f.updated
+}
+
+func (f *fakeSource) rotate(svid *x509svid.SVID) {
+	f.mu.Lock()
+	f.svid = svid
+	f.mu.Unlock()
+	f.updated <- struct{}{}
+}
+
+// startServer serves SDS on a Unix socket and returns a client for it.
+func startServer(t *testing.T, source *fakeSource) secretv3.SecretDiscoveryServiceClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	socketPath := filepath.Join(t.TempDir(), "sds.sock")
+	listener, err := listen(socketPath)
+	require.NoError(t, err)
+
+	grpcServer := grpc.NewServer()
+	secretv3.RegisterSecretDiscoveryServiceServer(grpcServer, NewServer(ctx, source))
+	go func() { _ = grpcServer.Serve(listener) }()
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient("unix://"+socketPath, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return secretv3.NewSecretDiscoveryServiceClient(conn)
+}
+
+func unmarshalSecrets(t *testing.T, response *discoveryv3.DiscoveryResponse) []*tlsv3.Secret {
+	var secrets []*tlsv3.Secret
+	for _, resource := range response.GetResources() {
+		secret := &tlsv3.Secret{}
+		require.NoError(t, resource.UnmarshalTo(secret))
+		secrets = append(secrets, secret)
+	}
+	return secrets
+}
+
+func newFakeSource(t *testing.T) (*fakeSource, *spiffetest.CA) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	ca := spiffetest.NewCA(t, td)
+	return &fakeSource{
+		svid:    ca.Issue(t, "spiffe://example.org/httpbackend"),
+		bundle:  x509bundle.FromX509Authorities(td, []*x509.Certificate{ca.Cert}),
+		updated: make(chan struct{}),
+	}, ca
+}
+
+func TestListenRestrictsTheSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "run", "sds.sock")
+	listener, err := listen(socketPath)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	info, err := os.Stat(socketPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	info, err = os.Stat(filepath.Dir(socketPath))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o700), info.Mode().Perm())
+}
+
+func TestFetchSecrets(t *testing.T) {
+	source, _ := newFakeSource(t)
+	client := startServer(t, source)
+
+	response, err := client.FetchSecrets(context.Background(), &discoveryv3.DiscoveryRequest{
+		ResourceNames: []string{"spiffe://example.org/httpbackend", "spiffe://example.org", "ROOTCA", "spiffe://example.org/other"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, secretTypeURL, response.GetTypeUrl())
+
+	secrets := unmarshalSecrets(t, response)
+	require.Len(t, secrets, 3, "the SVID of another workload should not be returned")
+
+	certificates, key, err := source.svid.Marshal()
+	require.NoError(t, err)
+	assert.Equal(t, certificates, secrets[0].GetTlsCertificate().GetCertificateChain().GetInlineBytes())
+	assert.Equal(t, key, secrets[0].GetTlsCertificate().GetPrivateKey().GetInlineBytes())
+
+	authorities, err := source.bundle.Marshal()
+	require.NoError(t, err)
+	assert.Equal(t, authorities, secrets[1].GetValidationContext().GetTrustedCa().GetInlineBytes())
+	assert.Equal(t, authorities, secrets[2].GetValidationContext().GetTrustedCa().GetInlineBytes())
+}
+
+func TestStreamSecretsPushesRotation(t *testing.T) {
+	source, ca := newFakeSource(t)
+	client := startServer(t, source)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := client.StreamSecrets(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, stream.Send(&discoveryv3.DiscoveryRequest{ResourceNames: []string{"default"}}))
+	first, err := stream.Recv()
+	require.NoError(t, err)
+	firstSecrets := unmarshalSecrets(t, first)
+	require.Len(t, firstSecrets, 1)
+
+	// Acknowledge the response, which shouldn't trigger another one.
+	require.NoError(t, stream.Send(&discoveryv3.DiscoveryRequest{
+		ResourceNames: []string{"default"},
+		VersionInfo:   first.GetVersionInfo(),
+		ResponseNonce: first.GetNonce(),
+	}))
+
+	source.rotate(ca.Issue(t, "spiffe://example.org/httpbackend"))
+
+	second, err := stream.Recv()
+	require.NoError(t, err)
+	assert.NotEqual(t, first.GetVersionInfo(), second.GetVersionInfo())
+	assert.NotEqual(t, first.GetNonce(), second.GetNonce())
+
+	secondSecrets := unmarshalSecrets(t, second)
+	require.Len(t, secondSecrets, 1)
+	certificates, _, err := source.svid.Marshal()
+	require.NoError(t, err)
+	assert.Equal(t, certificates, secondSecrets[0].GetTlsCertificate().GetCertificateChain().GetInlineBytes())
+}
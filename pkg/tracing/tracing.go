@@ -0,0 +1,147 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/spiffe/go-spiffe/v2/spiffetls"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters the spans can be sent to.
+const (
+	// ExporterNone doesn't export the spans. The trace context is still passed on, so the other services can.
+	ExporterNone = "none"
+	// ExporterStdout writes the spans as JSON to stdout.
+	ExporterStdout = "stdout"
+	// ExporterOTLP sends the spans to an OpenTelemetry collector over OTLP/HTTP.
+	ExporterOTLP = "otlp"
+)
+
+// Exporters lists the valid values of the exporter.
+var Exporters = []string{ExporterNone, ExporterStdout, ExporterOTLP}
+
+// Attributes that put the SPIFFE identities of a request on its span.
+const (
+	// PeerIDKey is the SPIFFE ID of the authenticated caller.
+	PeerIDKey = attribute.Key("spiffe.peer.id")
+	// LocalIDKey is the SPIFFE ID of the SVID of the service itself.
+	LocalIDKey = attribute.Key("spiffe.local.id")
+	// AuthzDecisionKey is the authorization decision for the caller, "allow" or "deny".
+	AuthzDecisionKey = attribute.Key("spiffe.authz.decision")
+	// AuthzReasonKey explains the authorization decision.
+	AuthzReasonKey = attribute.Key("spiffe.authz.reason")
+)
+
+// Setup installs the tracer provider for the service and the W3C trace context propagator. The returned
+// function flushes the spans that haven't been exported yet.
+func Setup(ctx context.Context, service, exporter, otlpEndpoint string) (func(context.Context) error, error) {
+	// The trace context is passed on even when this service doesn't export its spans, so a trace isn't broken
+	// in the middle.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		spanExporter, err = stdouttrace.New()
+	case ExporterOTLP:
+		spanExporter, err = otlptracehttp.New(ctx, otlptracehttp.WithEndpoint(otlpEndpoint), otlptracehttp.WithInsecure())
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q, valid exporters are %v", exporter, Exporters)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to create the %s exporter: %w", exporter, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(service))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// InstrumentHandler starts a server span for every request of a route, as a child of the trace of the caller.
+//
+// SPIFFE CONCEPT: Identity in Traces
+// The span records the SPIFFE ID the caller authenticated with during the mTLS handshake and the SPIFFE ID of the
+// service itself. A request over mTLS only reaches a handler once the authorizer accepted the peer, so its
+// decision is "allow". Handlers that make an authorization decision of their own record it with Allow or Deny.
+func InstrumentHandler(route string, next http.HandlerFunc) http.HandlerFunc {
+	return otelhttp.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := trace.SpanFromContext(r.Context())
+		if id := common.LocalID(); id != "" {
+			span.SetAttributes(LocalIDKey.String(id))
+		}
+		if r.TLS != nil {
+			if id, err := spiffetls.PeerIDFromConnectionState(*r.TLS); err == nil {
+				span.SetAttributes(PeerIDKey.String(id.String()))
+				Allow(r.Context(), "peer SPIFFE ID authorized during the mTLS handshake")
+			}
+		}
+		next(w, r)
+	}), route).ServeHTTP
+}
+
+// SetPeerID records the SPIFFE ID of a caller that was authenticated by a proxy in front of the service.
+func SetPeerID(ctx context.Context, id string) {
+	trace.SpanFromContext(ctx).SetAttributes(PeerIDKey.String(id))
+}
+
+// Allow records that the caller is allowed.
+func Allow(ctx context.Context, reason string) {
+	trace.SpanFromContext(ctx).SetAttributes(AuthzDecisionKey.String("allow"), AuthzReasonKey.String(reason))
+}
+
+// Deny records that the caller was denied. It replaces an earlier decision.
+func Deny(ctx context.Context, reason string) {
+	trace.SpanFromContext(ctx).SetAttributes(AuthzDecisionKey.String("deny"), AuthzReasonKey.String(reason))
+}
+
+// Transport wraps a transport to start a client span for every request and pass on the W3C trace context
+// in the traceparent header. The trace context travels inside the mTLS connection, like any other header.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return &transport{RoundTripper: otelhttp.NewTransport(base), base: base}
+}
+
+// transport passes CloseIdleConnections on to the wrapped transport, which the otelhttp transport doesn't, so
+// http.Client.CloseIdleConnections keeps working.
+type transport struct {
+	http.RoundTripper
+	base http.RoundTripper
+}
+
+func (t *transport) CloseIdleConnections() {
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package tracing
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/mattiasgees/spiffe-demo/pkg/common"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type staticSVIDSource struct {
+	svid *x509svid.SVID
+}
+
+func (s staticSVIDSource) GetX509SVID() (*x509svid.SVID, error) {
+	return s.svid, nil
+}
+
+// recordSpans installs a tracer provider that keeps the spans in memory.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	_, err := Setup(context.Background(), "test", ExporterNone, "")
+	require.NoError(t, err)
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	return recorder
+}
+
+func attributes(span sdktrace.ReadOnlySpan) map[attribute.Key]string {
+	values := map[attribute.Key]string{}
+	for _, kv := range span.Attributes() {
+		values[kv.Key] = kv.Value.Emit()
+	}
+	return values
+}
+
+func TestInstrumentHandlerRecordsIdentities(t *testing.T) {
+	recorder := recordSpans(t)
+	common.RegisterLocalSVID(staticSVIDSource{svid: &x509svid.SVID{ID: spiffeid.RequireFromString("spiffe://example.org/backend")}})
+	defer common.RegisterLocalSVID(nil)
+
+	peer := spiffeid.RequireFromString("spiffe://example.org/customer")
+	handler := InstrumentHandler("/orders", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("deny") {
+			Deny(r.Context(), "not the owner")
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+
+	for _, target := range []string{"/orders", "/orders?deny"} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{URIs: []*url.URL{peer.URL()}}}}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	assert.Equal(t, trace.SpanKindServer, spans[0].SpanKind())
+
+	allowed := attributes(spans[0])
+	assert.Equal(t, "spiffe://example.org/customer", allowed[PeerIDKey])
+	assert.Equal(t, "spiffe://example.org/backend", allowed[LocalIDKey])
+	assert.Equal(t, "allow", allowed[AuthzDecisionKey])
+
+	denied := attributes(spans[1])
+	assert.Equal(t, "deny", denied[AuthzDecisionKey])
+	assert.Equal(t, "not the owner", denied[AuthzReasonKey])
+}
+
+func TestTransportPropagatesTraceContext(t *testing.T) {
+	recorder := recordSpans(t)
+
+	server := httptest.NewServer(InstrumentHandler("/", func(w http.ResponseWriter, r *http.Request) {
+		assert.NotEmpty(t, r.Header.Get("traceparent"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: Transport(http.DefaultTransport)}
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	serverSpan, clientSpan := spans[0], spans[1]
+	if serverSpan.SpanKind() != trace.SpanKindServer {
+		serverSpan, clientSpan = clientSpan, serverSpan
+	}
+	assert.Equal(t, clientSpan.SpanContext().TraceID(), serverSpan.SpanContext().TraceID(), "the server span is part of the trace of the client")
+	assert.Equal(t, clientSpan.SpanContext().SpanID(), serverSpan.Parent().SpanID())
+}
+
+func TestSetupRejectsUnknownExporter(t *testing.T) {
+	_, err := Setup(context.Background(), "test", "jaeger", "")
+	assert.Error(t, err)
+}
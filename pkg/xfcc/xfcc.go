@@ -0,0 +1,169 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package xfcc parses and formats the x-forwarded-client-cert (XFCC) header. A SPIFFE proxy like Envoy
+// terminates the mTLS connection and uses this header to tell the application behind it who the client was.
+// See https://www.envoyproxy.io/docs/envoy/latest/configuration/http/http_conn_man/headers#x-forwarded-client-cert
+package xfcc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Header is the name of the header that carries the client certificate details.
+const Header = "X-Forwarded-Client-Cert"
+
+// Element holds the details of one client certificate. Every proxy a request passes through can append one.
+type Element struct {
+	// By is the URI SAN of the proxy that added the element, the SPIFFE ID of the proxy.
+	By string
+	// Hash is the SHA 256 digest of the client certificate.
+	Hash string
+	// Subject is the subject of the client certificate.
+	Subject string
+	// URI is the URI SAN of the client certificate, the SPIFFE ID of the client.
+	URI string
+	// DNS are the DNS SANs of the client certificate.
+	DNS []string
+	// Cert and Chain are the URL encoded PEM client certificate and chain.
+	Cert  string
+	Chain string
+}
+
+// Parse parses the value of an XFCC header. Elements are separated by commas and key/value pairs by semicolons,
+// values that contain one of those characters are double quoted.
+func Parse(header string) ([]Element, error) {
+	var elements []Element
+	for _, rawElement := range split(header, ',') {
+		if strings.TrimSpace(rawElement) == "" {
+			continue
+		}
+
+		var element Element
+		for _, pair := range split(rawElement, ';') {
+			key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if !found {
+				return nil, fmt.Errorf("invalid XFCC pair %q", pair)
+			}
+			value, err := unquote(value)
+			if err != nil {
+				return nil, err
+			}
+
+			switch strings.ToLower(key) {
+			case "by":
+				element.By = value
+			case "hash":
+				element.Hash = value
+			case "subject":
+				element.Subject = value
+			case "uri":
+				element.URI = value
+			case "dns":
+				element.DNS = append(element.DNS, value)
+			case "cert":
+				element.Cert = value
+			case "chain":
+				element.Chain = value
+			default:
+				return nil, fmt.Errorf("unknown XFCC key %q", key)
+			}
+		}
+		elements = append(elements, element)
+	}
+
+	if len(elements) == 0 {
+		return nil, errors.New("empty XFCC header")
+	}
+	return elements, nil
+}
+
+// Format formats elements as the value of an XFCC header.
+func Format(elements ...Element) string {
+	formatted := make([]string, 0, len(elements))
+	for _, element := range elements {
+		formatted = append(formatted, element.String())
+	}
+	return strings.Join(formatted, ",")
+}
+
+// String formats the element in the XFCC format.
+func (e Element) String() string {
+	var pairs []string
+	add := func(key, value string) {
+		if value != "" {
+			pairs = append(pairs, key+"="+quote(value))
+		}
+	}
+
+	add("By", e.By)
+	add("Hash", e.Hash)
+	add("Cert", e.Cert)
+	add("Chain", e.Chain)
+	add("Subject", e.Subject)
+	add("URI", e.URI)
+	for _, dns := range e.DNS {
+		add("DNS", dns)
+	}
+	return strings.Join(pairs, ";")
+}
+
+// split splits s at every separator that isn't inside double quotes.
+func split(s string, separator byte) []string {
+	var parts []string
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && inQuotes:
+			i++
+		case s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == separator && !inQuotes:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unquote(value string) (string, error) {
+	if !strings.HasPrefix(value, `"`) {
+		return value, nil
+	}
+	if len(value) < 2 || !strings.HasSuffix(value, `"`) {
+		return "", fmt.Errorf("unterminated quoted XFCC value %q", value)
+	}
+
+	var unquoted strings.Builder
+	inner := value[1 : len(value)-1]
+	for i := 0; i < len(inner); i++ {
+		if inner[i] == '\\' && i+1 < len(inner) {
+			i++
+		}
+		unquoted.WriteByte(inner[i])
+	}
+	return unquoted.String(), nil
+}
+
+func quote(value string) string {
+	if !strings.ContainsAny(value, `,;="`) {
+		return value
+	}
+	return `"` + strings.ReplaceAll(strings.ReplaceAll(value, `\`, `\\`), `"`, `\"`) + `"`
+}
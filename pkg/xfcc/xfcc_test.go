@@ -0,0 +1,68 @@
+/*
+Copyright © 2024 Mattias Gees mattias.gees@venafi.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package xfcc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEnvoyHeader(t *testing.T) {
+	header := `By=spiffe://example.org/httpbackend;Hash=468ed33be74eee6556d90c0149c1309e9ba61d6425303443c0748a02dd8de688;Subject="/C=US/ST=CA/O=SPIRE";URI=spiffe://example.org/customer;DNS=customer.local`
+
+	elements, err := Parse(header)
+	require.NoError(t, err)
+	require.Len(t, elements, 1)
+
+	assert.Equal(t, "spiffe://example.org/httpbackend", elements[0].By)
+	assert.Equal(t, "468ed33be74eee6556d90c0149c1309e9ba61d6425303443c0748a02dd8de688", elements[0].Hash)
+	assert.Equal(t, "/C=US/ST=CA/O=SPIRE", elements[0].Subject)
+	assert.Equal(t, "spiffe://example.org/customer", elements[0].URI)
+	assert.Equal(t, []string{"customer.local"}, elements[0].DNS)
+}
+
+func TestParseMultipleElements(t *testing.T) {
+	header := `By=spiffe://example.org/a;URI=spiffe://example.org/client,By=spiffe://example.org/b;URI=spiffe://example.org/a;Subject="CN=a,O=b"`
+
+	elements, err := Parse(header)
+	require.NoError(t, err)
+	require.Len(t, elements, 2)
+	assert.Equal(t, "spiffe://example.org/client", elements[0].URI)
+	assert.Equal(t, "CN=a,O=b", elements[1].Subject)
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, header := range []string{"", "URI", `Subject="unterminated`, "Unknown=value"} {
+		_, err := Parse(header)
+		assert.Error(t, err, "parsing %q should fail", header)
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	element := Element{
+		By:      "spiffe://example.org/proxy",
+		Hash:    "abc",
+		Subject: `CN=quote " and ; semicolon`,
+		URI:     "spiffe://example.org/customer",
+		DNS:     []string{"a.local", "b.local"},
+	}
+
+	elements, err := Parse(Format(element, element))
+	require.NoError(t, err)
+	assert.Equal(t, []Element{element, element}, elements)
+}